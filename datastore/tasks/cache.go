@@ -0,0 +1,107 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL is how long listings are cached when no TTL is configured.
+const defaultCacheTTL = 5 * time.Second
+
+// maxCacheEntries bounds the number of listings a taskCache holds.
+const maxCacheEntries = 1000
+
+// taskCache is a read-through cache of task listings, safe for concurrent
+// use. The cached slices are shared, so callers must not modify them.
+type taskCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time // Replaced in tests.
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	gen     int // Incremented by each invalidation.
+}
+
+type cacheEntry struct {
+	tasks   []*Task
+	expires time.Time
+}
+
+// newTaskCache returns an empty cache whose listings expire after ttl.
+func newTaskCache(ttl time.Duration) *taskCache {
+	return &taskCache{
+		ttl:        ttl,
+		maxEntries: maxCacheEntries,
+		now:        time.Now,
+		entries:    make(map[string]cacheEntry),
+	}
+}
+
+// get returns the listing cached under key, or calls load and caches its
+// result if there is none or it has expired. Errors are not cached.
+func (c *taskCache) get(key string, load func() ([]*Task, error)) ([]*Task, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && c.now().Before(e.expires) {
+		return e.tasks, nil
+	}
+
+	tasks, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Don't cache a listing that may have been loaded before a change.
+	if c.gen != gen {
+		return tasks, nil
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[key] = cacheEntry{tasks: tasks, expires: c.now().Add(c.ttl)}
+	return tasks, nil
+}
+
+// evict makes room for a new entry, removing the expired entries or, if
+// there are none, an arbitrary one. c.mu must be held.
+func (c *taskCache) evict() {
+	now := c.now()
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// invalidate empties the cache, for use whenever tasks change.
+func (c *taskCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cacheEntry)
+	c.gen++
+}
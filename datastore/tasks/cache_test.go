@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// countingLoader stands in for the datastore, counting how often the cache
+// loads a listing.
+type countingLoader struct {
+	calls int
+	err   error
+}
+
+func (l *countingLoader) load() ([]*Task, error) {
+	l.calls++
+	if l.err != nil {
+		return nil, l.err
+	}
+	return []*Task{{Desc: fmt.Sprint("load ", l.calls)}}, nil
+}
+
+func newTestCache(ttl time.Duration) (*taskCache, *time.Time) {
+	c := newTaskCache(ttl)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestTaskCache(t *testing.T) {
+	c, now := newTestCache(5 * time.Second)
+	l := &countingLoader{}
+
+	for i := 0; i < 2; i++ {
+		tasks, err := c.get("key", l.load)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if got, want := tasks[0].Desc, "load 1"; got != want {
+			t.Errorf("get #%d got %q, want %q", i+1, got, want)
+		}
+	}
+	if l.calls != 1 {
+		t.Errorf("loads within TTL got %d, want 1", l.calls)
+	}
+
+	if _, err := c.get("other", l.load); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if l.calls != 2 {
+		t.Errorf("loads after another key got %d, want 2", l.calls)
+	}
+
+	*now = now.Add(5 * time.Second)
+	if _, err := c.get("key", l.load); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if l.calls != 3 {
+		t.Errorf("loads after TTL got %d, want 3", l.calls)
+	}
+
+	c.invalidate()
+	if _, err := c.get("key", l.load); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if l.calls != 4 {
+		t.Errorf("loads after invalidate got %d, want 4", l.calls)
+	}
+}
+
+func TestTaskCacheError(t *testing.T) {
+	c, _ := newTestCache(5 * time.Second)
+	l := &countingLoader{err: errors.New("unavailable")}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.get("key", l.load); err != l.err {
+			t.Errorf("get got err %v, want %v", err, l.err)
+		}
+	}
+	if l.calls != 2 {
+		t.Errorf("loads after errors got %d, want 2", l.calls)
+	}
+}
+
+func TestTaskCacheInvalidatedDuringLoad(t *testing.T) {
+	c, _ := newTestCache(5 * time.Second)
+	calls := 0
+	load := func() ([]*Task, error) {
+		calls++
+		if calls == 1 {
+			c.invalidate()
+		}
+		return nil, nil
+	}
+
+	c.get("key", load)
+	c.get("key", load)
+	if calls != 2 {
+		t.Errorf("loads got %d, want 2: a listing loaded before an invalidation was cached", calls)
+	}
+}
+
+func TestTaskCacheBounded(t *testing.T) {
+	c, _ := newTestCache(5 * time.Second)
+	c.maxEntries = 3
+	l := &countingLoader{}
+
+	for i := 0; i < 10; i++ {
+		if _, err := c.get(fmt.Sprint("key", i), l.load); err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if len(c.entries) > c.maxEntries {
+			t.Fatalf("entries got %d, want at most %d", len(c.entries), c.maxEntries)
+		}
+	}
+}
+
+func TestServerInvalidatesCache(t *testing.T) {
+	c, _ := newTestCache(5 * time.Second)
+	s := &server{cache: c}
+	h := s.routes()
+
+	tests := []struct {
+		method      string
+		invalidated bool
+	}{
+		{http.MethodGet, false},
+		{http.MethodHead, false},
+		{http.MethodPost, true},
+		{http.MethodPut, true},
+		{http.MethodPatch, true},
+		{http.MethodDelete, true},
+	}
+	for _, test := range tests {
+		c.entries["key"] = cacheEntry{}
+		req := httptest.NewRequest(test.method, "/tasks/not-an-id", nil)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		_, ok := c.entries["key"]
+		if got := !ok; got != test.invalidated {
+			t.Errorf("%s invalidated got %v, want %v", test.method, got, test.invalidated)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+// TaskTombstone records that a task was permanently deleted, so that clients
+// syncing with ListChangesSince learn of the deletion. It is stored as a
+// TaskTombstone entity with the task's ID, in the task's namespace and task
+// list. Tombstones are never removed.
+type TaskTombstone struct {
+	TaskID    int64     `datastore:"task_id"`
+	DeletedAt time.Time `datastore:"deleted_at"`
+}
+
+// tombstoneKey returns the key of the tombstone of the task with the given
+// key.
+func tombstoneKey(taskKey *datastore.Key) *datastore.Key {
+	key := datastore.IDKey("TaskTombstone", taskKey.ID, taskKey.Parent)
+	key.Namespace = taskKey.Namespace
+	return key
+}
+
+// newTombstones returns the keys and the tombstones to store for the tasks
+// with the given keys, deleted at the given time.
+func newTombstones(taskKeys []*datastore.Key, at time.Time) ([]*datastore.Key, []*TaskTombstone) {
+	keys := make([]*datastore.Key, len(taskKeys))
+	tombstones := make([]*TaskTombstone, len(taskKeys))
+	for i, key := range taskKeys {
+		keys[i] = tombstoneKey(key)
+		tombstones[i] = &TaskTombstone{TaskID: key.ID, DeletedAt: at}
+	}
+	return keys, tombstones
+}
+
+// ListChangesSince returns what changed in the context's namespace and task
+// list after since, for clients that keep a copy of the tasks: the tasks
+// created or changed, as by ListTasksModifiedSince, and the IDs of the tasks
+// permanently deleted, by DeleteTask, PurgeDoneTasks or MoveTask. Tasks moved
+// to the recycle bin are among the changed tasks, with Deleted set. Outside
+// the default task list, the queries need the ancestor indexes on updated_at
+// and deleted_at defined in index.yaml.
+func ListChangesSince(ctx context.Context, client *datastore.Client, since time.Time) (upserts []*Task, deletedIDs []int64, err error) {
+	upserts, err = ListTasksModifiedSince(ctx, client, since)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := scopeQuery(ctx, datastore.NewQuery("TaskTombstone")).Filter("deleted_at >", since).Order("deleted_at")
+	var tombstones []*TaskTombstone
+	if _, err := client.GetAll(ctx, query, &tombstones); err != nil {
+		return nil, nil, err
+	}
+	for _, tombstone := range tombstones {
+		deletedIDs = append(deletedIDs, tombstone.TaskID)
+	}
+	return upserts, deletedIDs, nil
+}
+
+// feedSettleDelay is how old a change must be before FeedTasks returns it. A
+// task's updated_at is set before the write that changes it commits, so a
+// feed reading right up to the present could pass over a write still in
+// flight and never return it. Waiting out the default request timeout covers
+// the writes made while serving a request. Tests may shorten it.
+var feedSettleDelay = defaultRequestTimeout
+
+// ErrInvalidCursor is returned by FeedTasks when given a cursor it did not
+// return.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FeedTasks returns up to limit tasks, and no more than maxPageSize, in order
+// of update time and then key, starting at the given cursor, for clients that
+// follow every change to the tasks. An empty cursor starts from the first
+// task. The returned cursor fetches the next page. Unlike ListTasksPage's, it
+// does not become empty at the end of the feed: it can be kept to fetch the
+// changes made later.
+//
+// The cursor marks a position in the index on updated_at rather than a
+// number of tasks, so paging neither skips nor repeats tasks as others are
+// changed: a task changed after it was returned moves past the cursor, and
+// is returned again, with its update, on a later page. Tasks changed within
+// the last feedSettleDelay are held back until they settle. Tasks moved to
+// the recycle bin are returned with Deleted set; those permanently deleted
+// are reported by ListChangesSince. As with ListTasksModifiedSince, tasks
+// without an update time are never returned. Within a task list, the query
+// uses the ancestor index on updated_at defined in index.yaml.
+func FeedTasks(ctx context.Context, client *datastore.Client, cursor string, limit int) ([]*Task, string, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	query := taskQuery(ctx).Order("updated_at").Order("__key__").Limit(limit)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		query = query.Start(c)
+	}
+
+	settled := time.Now().Add(-feedSettleDelay)
+	tasks := make([]*Task, 0, limit)
+	it := client.Run(ctx, query)
+	for {
+		// The cursor is taken before each task is read, so that the next
+		// page starts with the first task that is not returned.
+		c, err := it.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		next := c.String()
+		if next == "" {
+			// No task has been read yet from the start of the feed.
+			next = cursor
+		}
+
+		var task Task
+		key, err := it.Next(&task)
+		if err == iterator.Done || err == nil && task.UpdatedAt.After(settled) {
+			return tasks, next, nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		task.Id = key.ID
+		tasks = append(tasks, &task)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestListChangesSince(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("changes-", time.Now().UnixNano()))
+
+	updated, err := AddTask(ctx, client, "to update")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, updated.ID)
+	deleted, err := AddTask(ctx, client, "to delete")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	unchanged, err := AddTask(ctx, client, "unchanged")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, unchanged.ID)
+
+	since := time.Now()
+	added, err := AddTask(ctx, client, "added")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, added.ID)
+	if err := UpdateTaskDescription(ctx, client, updated.ID, "updated"); err != nil {
+		t.Fatalf("UpdateTaskDescription: %v", err)
+	}
+	if err := DeleteTask(ctx, client, deleted.ID); err != nil {
+		t.Fatalf("DeleteTask: %v", err)
+	}
+
+	upserts, deletedIDs, err := ListChangesSince(ctx, client, since)
+	if err != nil {
+		t.Fatalf("ListChangesSince: %v", err)
+	}
+	var got []string
+	for _, task := range upserts {
+		got = append(got, fmt.Sprint(task.Id, " ", task.Desc))
+	}
+	want := []string{fmt.Sprint(added.ID, " added"), fmt.Sprint(updated.ID, " updated")}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ListChangesSince got upserts %q, want %q", got, want)
+	}
+	if fmt.Sprint(deletedIDs) != fmt.Sprint([]int64{deleted.ID}) {
+		t.Errorf("ListChangesSince got deleted IDs %v, want [%d]", deletedIDs, deleted.ID)
+	}
+
+	// Nothing has changed since the deletion.
+	upserts, deletedIDs, err = ListChangesSince(ctx, client, time.Now())
+	if err != nil || len(upserts) != 0 || len(deletedIDs) != 0 {
+		t.Errorf("ListChangesSince(now) = %v, %v, %v, want no changes", upserts, deletedIDs, err)
+	}
+}
+
+func TestFeedTasks(t *testing.T) {
+	if _, _, err := FeedTasks(context.Background(), nil, "not a cursor", 10); err != ErrInvalidCursor {
+		t.Errorf("FeedTasks with a bad cursor got err %v, want %v", err, ErrInvalidCursor)
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	// Within a task list, the feed is strongly consistent.
+	ctx := WithList(WithNamespace(context.Background(), fmt.Sprint("feed-", time.Now().UnixNano())), "feed")
+	defer func(d time.Duration) { feedSettleDelay = d }(feedSettleDelay)
+	feedSettleDelay = 0
+
+	var ids []int64
+	for _, desc := range []string{"a", "b", "c", "d", "e"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		ids = append(ids, key.ID)
+	}
+	defer DeleteAllTasks(ctx, client)
+
+	// seen records each version of each task returned by the feed.
+	seen := make(map[string]bool)
+	var cursor string
+	fetch := func() int {
+		t.Helper()
+		tasks, next, err := FeedTasks(ctx, client, cursor, 2)
+		if err != nil {
+			t.Fatalf("FeedTasks: %v", err)
+		}
+		for _, task := range tasks {
+			v := fmt.Sprintf("task %d version %d", task.Id, task.Version)
+			if seen[v] {
+				t.Errorf("FeedTasks returned %s twice", v)
+			}
+			seen[v] = true
+		}
+		cursor = next
+		return len(tasks)
+	}
+
+	fetch()
+	// Change a task already returned and one not yet returned between pages.
+	for _, id := range []int64{ids[0], ids[3]} {
+		if err := UpdateTaskDescription(ctx, client, id, "changed"); err != nil {
+			t.Fatalf("UpdateTaskDescription: %v", err)
+		}
+	}
+	for i := 0; fetch() > 0; i++ {
+		if i == 10 {
+			t.Fatalf("FeedTasks did not reach the end of the feed")
+		}
+	}
+
+	// The feed returned every task, and the latest version of each.
+	tasks, err := GetTasks(ctx, client, ids)
+	if err != nil {
+		t.Fatalf("GetTasks: %v", err)
+	}
+	for _, task := range tasks {
+		if v := fmt.Sprintf("task %d version %d", task.Id, task.Version); !seen[v] {
+			t.Errorf("FeedTasks did not return %s", v)
+		}
+	}
+	if want := len(ids) + 2; len(seen) != want {
+		t.Errorf("FeedTasks returned %d task versions, want %d", len(seen), want)
+	}
+
+	// The cursor at the end of the feed picks up later changes, once they
+	// have settled.
+	if err := MarkDone(ctx, client, ids[1]); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	feedSettleDelay = time.Hour
+	if tasks, next, err := FeedTasks(ctx, client, cursor, 10); err != nil || len(tasks) != 0 || next != cursor {
+		t.Errorf("FeedTasks with an unsettled change = %v, %q, %v, want nothing and the same cursor", tasks, next, err)
+	}
+	feedSettleDelay = 0
+	if tasks, _, err := FeedTasks(ctx, client, cursor, 10); err != nil || len(tasks) != 1 || tasks[0].Id != ids[1] || !tasks[0].Done {
+		t.Errorf("FeedTasks after MarkDone = %v, %v, want the done task", tasks, err)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// clientRetryPolicy controls the attempts to create the datastore client
+// when the server starts.
+var clientRetryPolicy = retryPolicy{
+	Attempts: 5,
+	Initial:  time.Second,
+	Max:      10 * time.Second,
+}
+
+// clientRetryInterval is how often the datastore client is retried in the
+// background once the attempts made at startup have failed.
+const clientRetryInterval = 30 * time.Second
+
+// clientManager creates the server's datastore client, retrying until it
+// succeeds, so that a transient failure at startup does not stop the server.
+// It serves requests with the handler built for the client; until there is
+// one, every request, including /healthz, is answered with 503 Service
+// Unavailable.
+type clientManager struct {
+	// connect creates the client, and handler, if not nil, builds the
+	// handler that serves requests with it.
+	connect func(context.Context) (*datastore.Client, error)
+	handler func(*datastore.Client) http.Handler
+	// retry controls the attempts made by start, and interval how often the
+	// client is then retried in the background. Every error is retried.
+	retry    retryPolicy
+	interval time.Duration
+
+	mu     sync.RWMutex
+	client *datastore.Client
+	h      http.Handler
+}
+
+// start tries to create the client, making up to m.retry.Attempts attempts.
+// If they all fail, it keeps trying every m.interval in the background until
+// it succeeds or ctx is done, and returns false.
+func (m *clientManager) start(ctx context.Context) bool {
+	delay := m.retry.Initial
+	for attempt := 1; ; attempt++ {
+		err := m.tryConnect(ctx)
+		if err == nil {
+			return true
+		}
+		logError(nil, fmt.Sprintf("Could not create datastore client (attempt %d)", attempt), err)
+		if attempt >= m.retry.Attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > m.retry.Max {
+			delay = m.retry.Max
+		}
+	}
+
+	go m.retryInBackground(ctx)
+	return false
+}
+
+// retryInBackground tries to create the client every m.interval until it
+// succeeds or ctx is done.
+func (m *clientManager) retryInBackground(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := m.tryConnect(ctx)
+		if err == nil {
+			logInfo(nil, "Created datastore client")
+			return
+		}
+		logError(nil, "Could not create datastore client", err)
+	}
+}
+
+// tryConnect makes one attempt to create the client and, if it succeeds,
+// starts serving requests with it.
+func (m *clientManager) tryConnect(ctx context.Context) error {
+	client, err := m.connect(ctx)
+	if err != nil {
+		return err
+	}
+	var h http.Handler
+	if m.handler != nil {
+		h = m.handler(client)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client, m.h = client, h
+	return nil
+}
+
+// Client returns the datastore client, or nil if it has not been created.
+func (m *clientManager) Client() *datastore.Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.client
+}
+
+// ServeHTTP implements http.Handler.
+func (m *clientManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	h := m.h
+	m.mu.RUnlock()
+	if h == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(m.interval.Seconds()))))
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "datastore client not yet available; retry later")
+		return
+	}
+	h.ServeHTTP(w, r)
+}
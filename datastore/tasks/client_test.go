@@ -0,0 +1,98 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestClientManagerRecovers(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+
+	// The first three attempts fail: both made by start, and the first made
+	// in the background.
+	var mu sync.Mutex
+	attempts := 0
+	m := &clientManager{
+		connect: func(context.Context) (*datastore.Client, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts <= 3 {
+				return nil, errors.New("metadata server unavailable")
+			}
+			return client, nil
+		},
+		handler: func(c *datastore.Client) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, "ok")
+			})
+		},
+		retry:    retryPolicy{Attempts: 2, Initial: time.Millisecond, Max: time.Millisecond},
+		interval: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if m.start(ctx) {
+		t.Fatalf("start succeeded, want the attempts to fail")
+	}
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("GET /healthz without a client got status %d and Retry-After %q, want %d and a delay", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); m.Client() == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the client was not created in the background")
+		}
+	}
+	if m.Client() != client {
+		t.Errorf("Client() = %v, want the client created", m.Client())
+	}
+	rr = httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("GET /healthz with a client got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 4 {
+		t.Errorf("made %d attempts, want 4", attempts)
+	}
+}
+
+func TestClientManagerStart(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	m := &clientManager{
+		connect: func(context.Context) (*datastore.Client, error) { return client, nil },
+		retry:   clientRetryPolicy,
+	}
+	if !m.start(context.Background()) || m.Client() != client {
+		t.Errorf("start() with a working connect got Client() = %v, want the client", m.Client())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Default limits on the datastore calls in flight at once.
+const (
+	defaultMaxConcurrent  = 100
+	defaultConcurrentWait = 100 * time.Millisecond
+)
+
+// errTooManyCalls is returned for a datastore call that could not start
+// because too many others were in flight. Its code, ResourceExhausted, is the
+// one datastore uses when a quota runs out, which is served the same way.
+var errTooManyCalls = status.Error(codes.ResourceExhausted, "too many datastore calls in progress")
+
+// callLimiter bounds the number of datastore calls in flight at once, safe
+// for concurrent use.
+type callLimiter struct {
+	slots *semaphore.Weighted // Holds a slot for each call in flight.
+	wait  time.Duration       // How long a call waits for a slot.
+}
+
+// newCallLimiter returns a limiter allowing n calls at once, each of which
+// waits up to wait for a slot.
+func newCallLimiter(n int, wait time.Duration) *callLimiter {
+	return &callLimiter{slots: semaphore.NewWeighted(int64(n)), wait: wait}
+}
+
+// callLimiterFromEnv returns a limiter configured by MAX_CONCURRENT_CALLS, the
+// number of datastore calls allowed in flight at once, and
+// MAX_CONCURRENT_WAIT, how long a call waits for its turn, such as "250ms".
+// It returns nil if MAX_CONCURRENT_CALLS is 0.
+func callLimiterFromEnv() (*callLimiter, error) {
+	n, wait := defaultMaxConcurrent, defaultConcurrentWait
+	if v := os.Getenv("MAX_CONCURRENT_CALLS"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid MAX_CONCURRENT_CALLS %q (must be a non-negative integer)", v)
+		}
+	}
+	if v := os.Getenv("MAX_CONCURRENT_WAIT"); v != "" {
+		var err error
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			return nil, fmt.Errorf("invalid MAX_CONCURRENT_WAIT %q (must be a non-negative duration)", v)
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return newCallLimiter(n, wait), nil
+}
+
+// acquire takes a slot, waiting until one is released, the limiter's wait
+// has passed or ctx is done, and reports whether it got one. Each successful
+// acquire must be followed by a release.
+func (l *callLimiter) acquire(ctx context.Context) bool {
+	if l.slots.TryAcquire(1) {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+	return l.slots.Acquire(ctx, 1) == nil
+}
+
+// release returns a slot taken by acquire.
+func (l *callLimiter) release() {
+	l.slots.Release(1)
+}
+
+// intercept is a gRPC interceptor that holds a slot for the length of each
+// call, failing with errTooManyCalls if it cannot get one. Every datastore
+// operation the client makes, including each step of a transaction, is a
+// separate call, so no call waits for a slot while holding another.
+func (l *callLimiter) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if !l.acquire(ctx) {
+		return errTooManyCalls
+	}
+	defer l.release()
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// clientOption returns the option that makes a datastore client's calls go
+// through the limiter.
+func (l *callLimiter) clientOption() option.ClientOption {
+	return option.WithGRPCDialOption(grpc.WithUnaryInterceptor(l.intercept))
+}
+
+// isOverloaded reports whether err is from a datastore call that failed
+// because too many were in flight, or because a datastore quota ran out.
+// Either may succeed if retried later.
+func isOverloaded(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
@@ -0,0 +1,207 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+// blockingDatastore is a fake datastore server whose lookups block until the
+// test releases them, and which counts the most lookups in flight at once.
+// Its other methods are not implemented.
+type blockingDatastore struct {
+	pb.DatastoreServer
+	release chan struct{}
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (d *blockingDatastore) Lookup(ctx context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	d.mu.Lock()
+	d.inFlight++
+	if d.inFlight > d.maxInFlight {
+		d.maxInFlight = d.inFlight
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.inFlight--
+		d.mu.Unlock()
+	}()
+
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp := &pb.LookupResponse{}
+	for _, key := range req.Keys {
+		resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: key}})
+	}
+	return resp, nil
+}
+
+// waitInFlight waits until n lookups are blocked in d.
+func (d *blockingDatastore) waitInFlight(t *testing.T, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		d.mu.Lock()
+		got := d.inFlight
+		d.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d lookups in flight, want %d", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newBlockingClient starts a blockingDatastore and returns a client for it
+// whose calls go through l, and a function to stop them both.
+func newBlockingClient(t *testing.T, l *callLimiter) (*datastore.Client, *blockingDatastore, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	fake := &blockingDatastore{release: make(chan struct{})}
+	srv := grpc.NewServer()
+	pb.RegisterDatastoreServer(srv, fake)
+	go srv.Serve(lis)
+
+	client, err := datastore.NewClient(context.Background(), "blocking",
+		option.WithEndpoint(lis.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+		l.clientOption())
+	if err != nil {
+		srv.Stop()
+		t.Fatalf("datastore.NewClient: %v", err)
+	}
+	return client, fake, func() {
+		client.Close()
+		srv.Stop()
+	}
+}
+
+func TestCallLimiter(t *testing.T) {
+	const limit, calls = 3, 10
+	client, fake, stop := newBlockingClient(t, newCallLimiter(limit, time.Minute))
+	defer stop()
+
+	ctx := context.Background()
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			errs <- client.Get(ctx, datastore.IDKey("Task", 1, nil), &Task{})
+		}()
+	}
+	fake.waitInFlight(t, limit)
+	// Give the waiting calls a chance to exceed the limit, then let them
+	// through one at a time.
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < calls; i++ {
+		fake.release <- struct{}{}
+	}
+	for i := 0; i < calls; i++ {
+		if err := <-errs; err != datastore.ErrNoSuchEntity {
+			t.Errorf("Get got err %v, want %v", err, datastore.ErrNoSuchEntity)
+		}
+	}
+	if fake.maxInFlight != limit {
+		t.Errorf("%d calls with a limit of %d got %d in flight at once, want %d", calls, limit, fake.maxInFlight, limit)
+	}
+}
+
+func TestCallLimiterOverloaded(t *testing.T) {
+	client, fake, stop := newBlockingClient(t, newCallLimiter(1, 10*time.Millisecond))
+	defer stop()
+
+	ctx := context.Background()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Get(ctx, datastore.IDKey("Task", 1, nil), &Task{})
+	}()
+	fake.waitInFlight(t, 1)
+
+	if err := client.Get(ctx, datastore.IDKey("Task", 2, nil), &Task{}); !isOverloaded(err) {
+		t.Errorf("Get over the limit got err %v, want %v", err, errTooManyCalls)
+	}
+
+	s := &server{client: client}
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/2", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET over the limit got status %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("503 response got Retry-After %q, want %q", got, "1")
+	}
+
+	fake.release <- struct{}{}
+	if err := <-errs; err != datastore.ErrNoSuchEntity {
+		t.Errorf("Get within the limit got err %v, want %v", err, datastore.ErrNoSuchEntity)
+	}
+	if fake.maxInFlight != 1 {
+		t.Errorf("got %d lookups in flight at once, want 1", fake.maxInFlight)
+	}
+}
+
+// hasSlots reports whether l allows exactly n calls at once. It takes all of
+// the limiter's slots, so l must not be used afterwards.
+func hasSlots(l *callLimiter, n int64) bool {
+	return !l.slots.TryAcquire(n+1) && l.slots.TryAcquire(n)
+}
+
+func TestCallLimiterFromEnv(t *testing.T) {
+	defer os.Unsetenv("MAX_CONCURRENT_CALLS")
+	defer os.Unsetenv("MAX_CONCURRENT_WAIT")
+
+	l, err := callLimiterFromEnv()
+	if err != nil || l == nil || !hasSlots(l, defaultMaxConcurrent) || l.wait != defaultConcurrentWait {
+		t.Errorf("callLimiterFromEnv() = %+v, %v, want the defaults", l, err)
+	}
+
+	os.Setenv("MAX_CONCURRENT_CALLS", "5")
+	os.Setenv("MAX_CONCURRENT_WAIT", "1s")
+	if l, err := callLimiterFromEnv(); err != nil || l == nil || !hasSlots(l, 5) || l.wait != time.Second {
+		t.Errorf("callLimiterFromEnv() = %+v, %v, want 5 slots and a wait of 1s", l, err)
+	}
+
+	os.Setenv("MAX_CONCURRENT_CALLS", "0")
+	if l, err := callLimiterFromEnv(); err != nil || l != nil {
+		t.Errorf("callLimiterFromEnv() with MAX_CONCURRENT_CALLS=0 = %+v, %v, want nil", l, err)
+	}
+
+	os.Setenv("MAX_CONCURRENT_CALLS", "-1")
+	if _, err := callLimiterFromEnv(); err == nil {
+		t.Errorf("callLimiterFromEnv() with a negative limit got no error")
+	}
+}
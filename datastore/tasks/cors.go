@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The methods and headers that browsers are told cross-origin requests may
+// use, the response headers their scripts may read, and how many seconds they
+// may cache a preflight response.
+const (
+	corsMethods       = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsHeaders       = "Content-Type, If-Match, If-None-Match, " + idempotencyHeader + ", " + tenantHeader + ", " + userHeader + ", " + requestIDHeader
+	corsExposeHeaders = "ETag, Location, Retry-After, " + requestIDHeader
+	corsMaxAge        = "600"
+)
+
+// corsOrigins is the set of origins allowed to make cross-origin requests. It
+// allows every origin if it contains "*".
+type corsOrigins map[string]bool
+
+// corsOriginsFromEnv returns the origins in the comma-separated
+// CORS_ALLOWED_ORIGINS, such as "https://app.example.com", or nil if it is
+// empty.
+func corsOriginsFromEnv() corsOrigins {
+	var origins corsOrigins
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origins == nil {
+			origins = make(corsOrigins)
+		}
+		origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	return origins
+}
+
+// allows reports whether requests from origin are allowed.
+func (o corsOrigins) allows(origin string) bool {
+	return origin != "" && (o["*"] || o[origin])
+}
+
+// withCORS answers OPTIONS requests itself, with 204 No Content, so that
+// browsers' preflight requests succeed. For requests from one of the
+// server's allowed origins, it adds the CORS headers that let the browser make
+// the request and read the response. Other requests are passed to h
+// unchanged.
+func (s *server) withCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := s.corsOrigins.allows(origin)
+		if allowed {
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method != http.MethodOptions {
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", corsMethods)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	s := &server{store: &MemTaskStore{}, corsOrigins: corsOrigins{"https://app.example.com": true}}
+	h := s.routes()
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/tasks/1", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "PATCH")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, if-match")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := preflight("https://app.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": corsMethods,
+		"Access-Control-Allow-Headers": corsHeaders,
+		"Access-Control-Max-Age":       corsMaxAge,
+		"Vary":                         "Origin",
+	} {
+		if got := rr.Header().Get(header); got != want {
+			t.Errorf("preflight got %s %q, want %q", header, got, want)
+		}
+	}
+
+	// Other origins get no CORS headers, so the browser refuses the request.
+	rr = preflight("https://evil.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight from another origin got status %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("preflight from another origin got Access-Control-Allow-Origin %q", got)
+	}
+
+	// The request that follows the preflight is served as usual.
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("GET /tasks with an Origin got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("GET /tasks got Access-Control-Allow-Origin %q, want the origin", got)
+	}
+	if got := rr.Header().Get("Access-Control-Expose-Headers"); got != corsExposeHeaders {
+		t.Errorf("GET /tasks got Access-Control-Expose-Headers %q, want %q", got, corsExposeHeaders)
+	}
+}
+
+func TestCORSOriginsFromEnv(t *testing.T) {
+	defer os.Unsetenv("CORS_ALLOWED_ORIGINS")
+
+	if o := corsOriginsFromEnv(); o != nil {
+		t.Errorf("corsOriginsFromEnv() with no origins = %v, want nil", o)
+	}
+
+	os.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example.com/, https://b.example.com")
+	o := corsOriginsFromEnv()
+	for origin, want := range map[string]bool{
+		"https://a.example.com": true,
+		"https://b.example.com": true,
+		"https://c.example.com": false,
+		"":                      false,
+	} {
+		if got := o.allows(origin); got != want {
+			t.Errorf("allows(%q) = %v, want %v", origin, got, want)
+		}
+	}
+
+	os.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	if o := corsOriginsFromEnv(); !o.allows("https://c.example.com") {
+		t.Errorf("corsOriginsFromEnv() with * does not allow every origin")
+	}
+}
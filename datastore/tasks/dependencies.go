@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// A task's DependsOn lists the IDs of the tasks that must be done before it
+// is ready to start. A dependency that has since been deleted, permanently or
+// to the recycle bin, no longer holds the task up.
+
+// ErrDependencyCycle is returned when adding a dependency would make a task
+// depend, directly or through other tasks, on itself.
+var ErrDependencyCycle = errors.New("task dependencies must not form a cycle")
+
+// AddDependency records that the task with the given ID cannot start until
+// the task with the ID dependsOn is done. Both tasks must exist. The check
+// for cycles reads the tasks' dependencies outside the transaction that
+// adds the new one, so two concurrent calls could still form a cycle.
+func AddDependency(ctx context.Context, client *datastore.Client, taskID, dependsOn int64) error {
+	if err := checkDependency(ctx, client, taskID, dependsOn); err != nil {
+		return err
+	}
+
+	key := taskKey(ctx, taskID)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		for _, id := range task.DependsOn {
+			if id == dependsOn {
+				return nil
+			}
+		}
+		task.DependsOn = append(task.DependsOn, dependsOn)
+		task.Version++
+		task.UpdatedAt = time.Now()
+		if _, err := tx.Put(key, &task); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, ActionEdited, task.UpdatedAt, "depends_on")
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// checkDependency returns ErrDependencyCycle if the task with the ID
+// dependsOn already depends on taskID, directly or indirectly, and
+// ErrTaskNotFound if it does not exist. It follows the dependencies one level
+// at a time, reading each level's tasks in a single call.
+func checkDependency(ctx context.Context, client *datastore.Client, taskID, dependsOn int64) error {
+	if taskID == dependsOn {
+		return ErrDependencyCycle
+	}
+	seen := map[int64]bool{dependsOn: true}
+	level := []int64{dependsOn}
+	for first := true; len(level) > 0; first = false {
+		tasks, err := GetTasks(ctx, client, level)
+		if err != nil {
+			return err
+		}
+		level = nil
+		for _, task := range tasks {
+			if task == nil {
+				if first {
+					return ErrTaskNotFound
+				}
+				continue
+			}
+			for _, id := range task.DependsOn {
+				if id == taskID {
+					return ErrDependencyCycle
+				}
+				if !seen[id] {
+					seen[id] = true
+					level = append(level, id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TaskReady reports whether all the dependencies of the task with the given
+// ID are done.
+func TaskReady(ctx context.Context, client *datastore.Client, taskID int64) (bool, error) {
+	task, err := GetTask(ctx, client, taskID)
+	if err != nil {
+		return false, err
+	}
+	blocked, err := blockedTasks(ctx, client, []*Task{task})
+	if err != nil {
+		return false, err
+	}
+	return !blocked[task.Id], nil
+}
+
+// ListReadyTasks returns the open tasks, other than those in the recycle
+// bin, whose dependencies are all done, in ascending order of creation time.
+// It uses the same index as ListTasksByStatus.
+func ListReadyTasks(ctx context.Context, client *datastore.Client) ([]*Task, error) {
+	tasks, err := ListTasksByStatus(ctx, client, false)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := blockedTasks(ctx, client, tasks)
+	if err != nil {
+		return nil, err
+	}
+	ready := tasks[:0]
+	for _, task := range tasks {
+		if !blocked[task.Id] {
+			ready = append(ready, task)
+		}
+	}
+	return ready, nil
+}
+
+// blockedTasks returns the IDs of the given tasks that have a dependency that
+// is not yet done. The dependencies are read in batches of up to
+// maxGetTasks.
+func blockedTasks(ctx context.Context, client *datastore.Client, tasks []*Task) (map[int64]bool, error) {
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, task := range tasks {
+		for _, id := range task.DependsOn {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	open := make(map[int64]bool)
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxGetTasks {
+			n = maxGetTasks
+		}
+		deps, err := GetTasks(ctx, client, ids[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range deps {
+			if dep != nil && !dep.Done && !dep.Deleted {
+				open[dep.Id] = true
+			}
+		}
+		ids = ids[n:]
+	}
+
+	blocked := make(map[int64]bool)
+	for _, task := range tasks {
+		for _, id := range task.DependsOn {
+			if open[id] {
+				blocked[task.Id] = true
+			}
+		}
+	}
+	return blocked, nil
+}
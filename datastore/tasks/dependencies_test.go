@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDependencies(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("deps-", time.Now().UnixNano()))
+
+	// design <- build <- ship
+	var ids []int64
+	for _, desc := range []string{"design", "build", "ship"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		ids = append(ids, key.ID)
+	}
+	design, build, ship := ids[0], ids[1], ids[2]
+	if err := AddDependency(ctx, client, build, design); err != nil {
+		t.Fatalf("AddDependency(build, design): %v", err)
+	}
+	if err := AddDependency(ctx, client, ship, build); err != nil {
+		t.Fatalf("AddDependency(ship, build): %v", err)
+	}
+
+	for _, tt := range []struct {
+		taskID, dependsOn int64
+		want              error
+	}{
+		{design, ship, ErrDependencyCycle},
+		{build, ship, ErrDependencyCycle},
+		{design, design, ErrDependencyCycle},
+		{design, 1 << 62, ErrTaskNotFound},
+	} {
+		if err := AddDependency(ctx, client, tt.taskID, tt.dependsOn); err != tt.want {
+			t.Errorf("AddDependency(%d, %d) got err %v, want %v", tt.taskID, tt.dependsOn, err, tt.want)
+		}
+	}
+
+	check := func(when string, want ...int64) {
+		t.Helper()
+		tasks, err := ListReadyTasks(ctx, client)
+		if err != nil {
+			t.Fatalf("ListReadyTasks: %v", err)
+		}
+		var got []int64
+		for _, task := range tasks {
+			got = append(got, task.Id)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s, ListReadyTasks got %v, want %v", when, got, want)
+		}
+		for _, id := range []int64{build, ship} {
+			ready, err := TaskReady(ctx, client, id)
+			wantReady := false
+			for _, w := range want {
+				wantReady = wantReady || w == id
+			}
+			if err != nil || ready != wantReady {
+				t.Errorf("%s, TaskReady(%d) = %v, %v, want %v", when, id, ready, err, wantReady)
+			}
+		}
+	}
+	check("at first", design)
+	if err := MarkDone(ctx, client, design); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	check("with design done", build)
+	if err := MarkDone(ctx, client, build); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	check("with build done", ship)
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Types of taskEvent.
+const (
+	eventAdded     = "added"
+	eventCompleted = "completed"
+	eventDeleted   = "deleted"
+)
+
+// taskEvent describes a change to a task, and is sent to /stream clients as
+// the data of a server-sent event of the same type.
+type taskEvent struct {
+	Type      string `json:"type"`
+	ID        int64  `json:"id"`
+	namespace string // The tenant whose task changed.
+}
+
+// eventBufferSize is the most events held for a subscriber that has not
+// received them yet. Further events are dropped for that subscriber.
+const eventBufferSize = 64
+
+// broker fans out task events to subscribers, safe for concurrent use.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan taskEvent]bool
+}
+
+// taskEvents receives an event for each task added, completed or deleted by
+// this process.
+var taskEvents = &broker{subs: make(map[chan taskEvent]bool)}
+
+// subscribe returns a channel receiving the events published from now on,
+// and a function that cancels the subscription, which must be called once
+// the events are no longer wanted.
+func (b *broker) subscribe() (<-chan taskEvent, func()) {
+	ch := make(chan taskEvent, eventBufferSize)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends e to every subscriber without waiting for any of them.
+func (b *broker) publish(e taskEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// closeAll ends every subscription by closing its channel, such as when the
+// server is shutting down.
+func (b *broker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+}
+
+// subscribers returns the number of current subscribers.
+func (b *broker) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+// publishEvent publishes an event of the given type for each of the keys.
+func publishEvent(ctx context.Context, typ string, keys ...*datastore.Key) {
+	for _, key := range keys {
+		taskEvents.publish(taskEvent{Type: typ, ID: key.ID, namespace: namespace(ctx)})
+	}
+}
+
+// streamKeepAlive is how often a comment is sent to /stream clients when
+// there are no events, to keep proxies from closing the connection.
+var streamKeepAlive = 15 * time.Second
+
+// handleStream streams an event to the client, using server-sent events,
+// each time a task of the request's tenant is added, completed or deleted by
+// this server instance. The stream lasts until the client disconnects or the
+// server shuts down.
+func (s *server) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, codeInternal, "streaming is not supported")
+		return
+	}
+
+	events, cancel := taskEvents.subscribe()
+	defer cancel()
+	tenant := namespace(s.context(r))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.namespace != tenant {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logError(r, "Could not encode task event", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
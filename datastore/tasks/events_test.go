@@ -0,0 +1,186 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestBroker(t *testing.T) {
+	b := &broker{subs: make(map[chan taskEvent]bool)}
+	first, cancelFirst := b.subscribe()
+	second, cancelSecond := b.subscribe()
+	defer cancelSecond()
+
+	b.publish(taskEvent{Type: eventAdded, ID: 1})
+	for i, ch := range []<-chan taskEvent{first, second} {
+		if e := <-ch; e.ID != 1 {
+			t.Errorf("subscriber %d got %+v, want task 1", i+1, e)
+		}
+	}
+
+	cancelFirst()
+	b.publish(taskEvent{Type: eventDeleted, ID: 2})
+	if e := <-second; e.ID != 2 {
+		t.Errorf("remaining subscriber got %+v, want task 2", e)
+	}
+	select {
+	case e := <-first:
+		t.Errorf("canceled subscriber got %+v", e)
+	default:
+	}
+
+	// A subscriber that does not keep up misses events rather than blocking
+	// the publisher.
+	for i := 0; i < eventBufferSize+1; i++ {
+		b.publish(taskEvent{Type: eventAdded, ID: int64(i)})
+	}
+	if n := len(second); n != eventBufferSize {
+		t.Errorf("slow subscriber has %d events buffered, want %d", n, eventBufferSize)
+	}
+
+	b.closeAll()
+	for range second {
+	}
+	if n := b.subscribers(); n != 0 {
+		t.Errorf("after closeAll got %d subscribers, want 0", n)
+	}
+}
+
+// openStream connects to the /stream endpoint of srv as the given tenant.
+func openStream(t *testing.T, srv *httptest.Server, tenant string) (*bufio.Reader, func()) {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+"/stream", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set(tenantHeader, tenant)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /stream got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("GET /stream got Content-Type %q, want text/event-stream", ct)
+	}
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+// readEvent reads the next event from a stream, skipping comments, and
+// returns its type and data.
+func readEvent(t *testing.T, r *bufio.Reader) (string, taskEvent) {
+	t.Helper()
+	type result struct {
+		typ, data string
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				res.err = err
+				break
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" && res.typ != "" {
+				break
+			}
+			if strings.HasPrefix(line, "event: ") {
+				res.typ = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				res.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("reading event: %v", res.err)
+		}
+		var e taskEvent
+		if err := json.Unmarshal([]byte(res.data), &e); err != nil {
+			t.Fatalf("event data %q is not JSON: %v", res.data, err)
+		}
+		return res.typ, e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event received")
+	}
+	return "", taskEvent{}
+}
+
+func TestStream(t *testing.T) {
+	srv := httptest.NewServer((&server{timeout: 10 * time.Millisecond}).routes())
+	defer srv.Close()
+
+	r, closeStream := openStream(t, srv, "team-a")
+	// The other tenant's event is not sent, and the request timeout does
+	// not end the stream.
+	time.Sleep(20 * time.Millisecond)
+	publishEvent(WithNamespace(context.Background(), "team-b"), eventAdded, datastore.IDKey("Task", 1, nil))
+	publishEvent(WithNamespace(context.Background(), "team-a"), eventCompleted, datastore.IDKey("Task", 2, nil))
+
+	typ, e := readEvent(t, r)
+	if typ != eventCompleted || e.Type != eventCompleted || e.ID != 2 {
+		t.Errorf("stream got event %q with %+v, want %q for task 2", typ, e, eventCompleted)
+	}
+
+	// Disconnecting ends the subscription.
+	closeStream()
+	deadline := time.Now().Add(5 * time.Second)
+	for taskEvents.subscribers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("after disconnecting got %d subscribers, want 0", taskEvents.subscribers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamAddTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("stream-", time.Now().UnixNano()))
+	srv := httptest.NewServer((&server{client: client}).routes())
+	defer srv.Close()
+
+	r, closeStream := openStream(t, srv, namespace(ctx))
+	defer closeStream()
+
+	key, err := AddTask(ctx, client, "streamed")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+
+	typ, e := readEvent(t, r)
+	if typ != eventAdded || e.ID != key.ID {
+		t.Errorf("stream got event %q with %+v, want %q for task %d", typ, e, eventAdded, key.ID)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// csvHeader is the first row written by ExportTasksCSV.
+var csvHeader = []string{"id", "description", "created", "done"}
+
+// ExportTasksCSV writes all the tasks to w as CSV, in ascending order of
+// creation time, with a header row naming the columns id, description,
+// created and done. Tasks are written as they are read from the datastore
+// by IterateTasks rather than loaded all at once, so the export can be larger
+// than memory.
+func ExportTasksCSV(ctx context.Context, client *datastore.Client, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	err := IterateTasks(ctx, client, func(task *Task) error {
+		return cw.Write([]string{
+			strconv.FormatInt(task.Id, 10),
+			task.Desc,
+			task.Created.Format(time.RFC3339),
+			strconv.FormatBool(task.Done),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// markdownEscaper escapes the characters of a description that Markdown
+// would otherwise read as formatting, and joins its lines so that it stays a
+// single list item.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "#", `\#`, "|", `\|`, "~", `\~`, "&", `\&`,
+	"\r\n", " ", "\n", " ", "\r", " ",
+)
+
+// WriteChecklist writes the tasks to w as a Markdown checklist, one item per
+// task: "- [x] description" if the task is done and "- [ ] description"
+// otherwise.
+func WriteChecklist(w io.Writer, tasks []*Task) error {
+	bw := bufio.NewWriter(w)
+	for _, task := range tasks {
+		box := " "
+		if task.Done {
+			box = "x"
+		}
+		fmt.Fprintf(bw, "- [%s] %s\n", box, markdownEscaper.Replace(task.Desc))
+	}
+	return bw.Flush()
+}
+
+// ImportSummary reports the outcome of ImportTasks.
+type ImportSummary struct {
+	Imported int           `json:"imported"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"` // At most maxImportErrors of the failures.
+}
+
+// ImportError describes why the task on one line of an import failed.
+type ImportError struct {
+	Line    int    `json:"line"` // Counting from 1.
+	Message string `json:"message"`
+}
+
+// maxImportErrors is the most failures an ImportSummary describes, so that a
+// file of garbage cannot use unbounded memory.
+const maxImportErrors = 100
+
+// ImportTasks creates a task for each line of r, which holds newline-delimited
+// JSON objects in the form of a newTaskRequest, and returns the number of
+// tasks imported and the lines that could not be. Blank lines are skipped,
+// and lines longer than maxMsgSize fail. The tasks are decoded as they are
+// read and stored in batches of up to maxBatchSize, so the input can be
+// larger than memory.
+//
+// A bad line does not stop the import. If the datastore fails a whole batch,
+// ImportTasks stops and returns the summary of the tasks imported before it
+// together with the error.
+func ImportTasks(ctx context.Context, client *datastore.Client, r io.Reader) (*ImportSummary, error) {
+	summary := &ImportSummary{Errors: []ImportError{}}
+	fail := func(line int, msg string) {
+		summary.Failed++
+		if len(summary.Errors) < maxImportErrors {
+			summary.Errors = append(summary.Errors, ImportError{Line: line, Message: msg})
+		}
+	}
+
+	var keys []*datastore.Key
+	var tasks []*Task
+	var lines []int
+	flush := func() error {
+		if len(tasks) == 0 {
+			return nil
+		}
+		stored, err := client.PutMulti(ctx, keys, tasks)
+		if me, ok := err.(datastore.MultiError); ok {
+			// None of the batch was stored. Put the tasks that can be
+			// saved again without the ones that cannot.
+			n := 0
+			for i, err := range me {
+				if err != nil {
+					fail(lines[i], err.Error())
+					continue
+				}
+				keys[n], tasks[n], lines[n] = keys[i], tasks[i], lines[i]
+				n++
+			}
+			if n == 0 {
+				stored, err = nil, nil
+			} else {
+				stored, err = client.PutMulti(ctx, keys[:n], tasks[:n])
+			}
+		}
+		if err != nil {
+			return err
+		}
+		summary.Imported += len(stored)
+		publishEvent(ctx, eventAdded, stored...)
+		keys, tasks, lines = keys[:0], tasks[:0], lines[:0]
+		return nil
+	}
+
+	// The tasks are placed after the stored ones, in the order of the lines.
+	// The first position is looked up with the first valid line.
+	var position float64
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := readLine(br)
+		if err == io.EOF {
+			break
+		}
+		if err == errMsgTooLarge {
+			fail(n, fmt.Sprintf("line must not exceed %d bytes", maxMsgSize))
+			continue
+		}
+		if err != nil {
+			return summary, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		task, errs := decodeNewTask(string(line))
+		if errs != nil {
+			msgs := make([]string, len(errs))
+			for i, e := range errs {
+				msgs[i] = e.Message
+				if e.Field != "" {
+					msgs[i] = e.Field + " " + e.Message
+				}
+			}
+			fail(n, strings.Join(msgs, "; "))
+			continue
+		}
+		if err := validateTask(task); err != nil {
+			fail(n, err.Error())
+			continue
+		}
+		task.Created = time.Now()
+		task.UpdatedAt = task.Created
+		if position == 0 {
+			if position, err = nextPosition(ctx, client); err != nil {
+				return summary, err
+			}
+		}
+		task.Position = position
+		position++
+		scheduleRecurrence(task)
+
+		keys = append(keys, newTaskKey(ctx))
+		tasks = append(tasks, task)
+		lines = append(lines, n)
+		if len(tasks) == maxBatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// readLine returns the next line from br without its line ending, or io.EOF
+// after the last line. A line longer than maxMsgSize is skipped and reported
+// as errMsgTooLarge, so it is never held in memory.
+func readLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	read, tooLong := false, false
+	for {
+		chunk, err := br.ReadSlice('\n')
+		read = read || len(chunk) > 0
+		if !tooLong {
+			line = append(line, chunk...)
+			// Leave room for a line ending of up to two bytes.
+			if int64(len(line)) > maxMsgSize+2 {
+				line, tooLong = nil, true
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && read {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if tooLong || int64(len(line)) > maxMsgSize {
+			return nil, errMsgTooLarge
+		}
+		return line, nil
+	}
+}
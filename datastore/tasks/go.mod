@@ -1,5 +1,23 @@
 module github.com/GoogleCloudPlatform/golang-samples/datastore/tasks
 
-go 1.12
+go 1.26.0
 
-require cloud.google.com/go v0.37.4
+require (
+	cloud.google.com/go v0.37.4
+	go.opencensus.io v0.20.1
+	golang.org/x/oauth2 v0.0.0-20190226205417-e64efc72b421
+	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
+	golang.org/x/time v0.16.0
+	google.golang.org/api v0.3.1
+	google.golang.org/genproto v0.0.0-20190404172233-64821d5d2107
+	google.golang.org/grpc v1.19.0
+)
+
+require (
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.4 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	golang.org/x/text v0.3.1-0.20180807135948-17ff2d5776d2 // indirect
+)
@@ -0,0 +1,111 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// TaskEvent is an entry in the history of a task, stored as a TaskEvent
+// entity whose parent is the task's key. Each is written in the same
+// transaction as the change it records, so the history cannot disagree with
+// the task.
+type TaskEvent struct {
+	TaskID    int64     `datastore:"task_id" json:"task_id"`
+	Action    string    `datastore:"action" json:"action"` // One of the Action constants.
+	Timestamp time.Time `datastore:"timestamp" json:"timestamp"`
+	Detail    string    `datastore:"detail,noindex,omitempty" json:"detail,omitempty"` // For edits, the fields that changed.
+}
+
+// The actions recorded in a task's history.
+const (
+	ActionCreated  = "created"
+	ActionDone     = "done"
+	ActionReopened = "reopened"
+	ActionEdited   = "edited"
+)
+
+// recordEvent adds an event for a change at the given time to the history of
+// the task with the given key, as part of tx.
+func recordEvent(tx *datastore.Transaction, taskKey *datastore.Key, action string, at time.Time, changed ...string) error {
+	_, err := tx.Put(newEvent(taskKey, action, at, changed...))
+	return err
+}
+
+// newEvent returns the key and entity of an event for a change at the given
+// time in the history of the task with the given key, which must be complete.
+func newEvent(taskKey *datastore.Key, action string, at time.Time, changed ...string) (*datastore.Key, *TaskEvent) {
+	key := datastore.IncompleteKey("TaskEvent", taskKey)
+	key.Namespace = taskKey.Namespace
+	return key, &TaskEvent{
+		TaskID:    taskKey.ID,
+		Action:    action,
+		Timestamp: at,
+		Detail:    strings.Join(changed, ","),
+	}
+}
+
+// copyHistory copies the history of the task with key from to the task with
+// key to, as part of tx. The ancestor query runs in tx, so the copy has every
+// event committed before it.
+func copyHistory(ctx context.Context, client *datastore.Client, tx *datastore.Transaction, from, to *datastore.Key) error {
+	query := datastore.NewQuery("TaskEvent").Namespace(from.Namespace).Ancestor(from).Transaction(tx)
+	var events []*TaskEvent
+	if _, err := client.GetAll(ctx, query, &events); err != nil {
+		return err
+	}
+	keys := make([]*datastore.Key, len(events))
+	for i, event := range events {
+		event.TaskID = to.ID
+		keys[i] = datastore.IncompleteKey("TaskEvent", to)
+		keys[i].Namespace = to.Namespace
+	}
+	_, err := tx.PutMulti(keys, events)
+	return err
+}
+
+// GetTaskHistory returns the history of the task with the given ID, oldest
+// event first. Tasks are created with an ActionCreated event, and each time
+// one is marked done or not done, or edited, another event is added. Tasks
+// created by ImportTasks or a recurrence start with no history. A task moved
+// by MoveTask takes its history with it. The history outlives the task if it
+// is deleted; ErrTaskNotFound is only returned if there is neither a task nor
+// a history.
+func GetTaskHistory(ctx context.Context, client *datastore.Client, taskID int64) ([]*TaskEvent, error) {
+	key := taskKey(ctx, taskID)
+	// An ancestor query is strongly consistent, so the history includes every
+	// committed change. It is sorted here rather than by the query, which
+	// would need a composite index.
+	query := datastore.NewQuery("TaskEvent").Namespace(key.Namespace).Ancestor(key)
+	var events []*TaskEvent
+	if _, err := client.GetAll(ctx, query, &events); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		if _, err := GetTask(ctx, client, taskID); err != nil {
+			return nil, err
+		}
+		return []*TaskEvent{}, nil
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	return events, nil
+}
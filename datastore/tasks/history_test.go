@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+func TestTaskHistory(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("history-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	key, err := AddTask(ctx, client, "write report")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+	desc := "write the quarterly report"
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &desc}); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+	// A patch that changes nothing is not recorded.
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &desc}); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/tasks/%d/history", key.ID), nil)
+	req.Header.Set(tenantHeader, namespace(ctx))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET %s got status %d, want %d: %s", req.URL, rr.Code, http.StatusOK, rr.Body)
+	}
+	var events []*TaskEvent
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+		t.Fatalf("GET %s: could not decode %q: %v", req.URL, rr.Body, err)
+	}
+	var got []string
+	for _, e := range events {
+		if e.TaskID != key.ID {
+			t.Errorf("event %+v is for task %d, want %d", e, e.TaskID, key.ID)
+		}
+		got = append(got, e.Action+":"+e.Detail)
+	}
+	if want := []string{"created:", "edited:description", "done:"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("GET %s got events %q, want %q", req.URL, got, want)
+	}
+
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if last := events[len(events)-1]; !last.Timestamp.Equal(task.CompletedAt) {
+		t.Errorf("done event at %v, want the task's completion time %v", last.Timestamp, task.CompletedAt)
+	}
+
+	if _, err := GetTaskHistory(ctx, client, key.ID+1000); err != ErrTaskNotFound {
+		t.Errorf("GetTaskHistory of a missing task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestBulkTaskHistory(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("bulk-history-", time.Now().UnixNano()))
+
+	for _, add := range []struct {
+		name string
+		f    func(context.Context, *datastore.Client, []string) ([]*datastore.Key, error)
+	}{
+		{"AddTasks", AddTasks},
+		{"AddTasksAtomic", AddTasksAtomic},
+	} {
+		keys, err := add.f(ctx, client, []string{"pack", "travel"})
+		if err != nil {
+			t.Fatalf("%s: %v", add.name, err)
+		}
+		defer client.DeleteMulti(ctx, keys)
+		for _, key := range keys {
+			task, err := GetTask(ctx, client, key.ID)
+			if err != nil {
+				t.Fatalf("GetTask: %v", err)
+			}
+			events, err := GetTaskHistory(ctx, client, key.ID)
+			if err != nil {
+				t.Fatalf("GetTaskHistory: %v", err)
+			}
+			if len(events) != 1 || events[0].Action != ActionCreated || events[0].TaskID != key.ID || !events[0].Timestamp.Equal(task.Created) {
+				t.Errorf("history of task %d from %s = %+v, want one created event at %v", key.ID, add.name, events, task.Created)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logEntry is a structured log line in the format understood by Cloud
+// Logging. See https://cloud.google.com/logging/docs/structured-logging.
+type logEntry struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Error    string `json:"error,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Trace    string `json:"logging.googleapis.com/trace,omitempty"`
+	// RequestID correlates the entries logged while serving a request; see
+	// withRequestID.
+	RequestID string `json:"requestId,omitempty"`
+	// HTTPRequest is set on access log entries; see withAccessLog.
+	HTTPRequest *httpRequestLog `json:"httpRequest,omitempty"`
+}
+
+// httpRequestLog describes a request that was served, in the format of
+// Cloud Logging's HttpRequest.
+type httpRequestLog struct {
+	RequestMethod string `json:"requestMethod"`
+	RequestURL    string `json:"requestUrl"`
+	Status        int    `json:"status"`
+	ResponseSize  string `json:"responseSize"` // A decimal number of bytes.
+	Latency       string `json:"latency"`      // Seconds, such as "0.035s".
+}
+
+var (
+	logMu sync.Mutex
+	// logOutput is where log entries are written, one JSON object per line.
+	logOutput io.Writer = os.Stderr
+)
+
+// logInfo logs an INFO entry. r may be nil for messages that are not about a
+// particular request.
+func logInfo(r *http.Request, format string, args ...interface{}) {
+	writeLog(newLogEntry("INFO", r, fmt.Sprintf(format, args...)))
+}
+
+// logError logs an ERROR entry with err attached. r may be nil for messages
+// that are not about a particular request.
+func logError(r *http.Request, msg string, err error) {
+	e := newLogEntry("ERROR", r, msg)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	writeLog(e)
+}
+
+func newLogEntry(severity string, r *http.Request, msg string) *logEntry {
+	e := &logEntry{Severity: severity, Message: msg}
+	if r != nil {
+		e.Method = r.Method
+		e.Path = r.URL.Path
+		e.Trace = traceName(r)
+		e.RequestID = requestID(r.Context())
+	}
+	return e
+}
+
+// requestIDHeader is the request and response header carrying the ID under
+// which a request's log entries are written.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the length of the longest request ID accepted from a
+// client.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the request set by withRequestID, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID gives each request served by h an ID, which is added to its
+// context, so that every entry logged for it carries the ID, and echoed in
+// the response's X-Request-ID header. The ID is taken from the request's own
+// X-Request-ID header if it has a valid one, so that a client or proxy can
+// correlate its logs with the server's, and is otherwise a new random UUID.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newUUID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is a usable request ID: non-empty, at
+// most maxRequestIDLen bytes and printable ASCII, so that it is safe to log
+// and to echo in a header.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random (version 4) UUID, such as
+// "9b2f6c1e-4d3a-4f0b-8e7c-2a1d5b6c7e8f".
+func newUUID() string {
+	var b [16]byte
+	// crypto/rand's Read never fails.
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4.
+	b[8] = b[8]&0x3f | 0x80 // The RFC 4122 variant.
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// withAccessLog logs an INFO entry for each request served by h, with its
+// method, URL, status, response size and latency, if the server's accessLog
+// is set.
+func (s *server) withAccessLog(h http.Handler) http.Handler {
+	if !s.accessLog {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		latency := time.Since(start)
+
+		e := newLogEntry("INFO", r, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, sw.statusCode()))
+		e.HTTPRequest = &httpRequestLog{
+			RequestMethod: r.Method,
+			RequestURL:    r.URL.String(),
+			Status:        sw.statusCode(),
+			ResponseSize:  strconv.FormatInt(sw.size, 10),
+			Latency:       fmt.Sprintf("%.6fs", latency.Seconds()),
+		}
+		writeLog(e)
+	})
+}
+
+// traceName returns the Cloud Trace resource name for the trace in the
+// request's X-Cloud-Trace-Context header, or "" if there is none or the
+// project is unknown.
+func traceName(r *http.Request) string {
+	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	header := r.Header.Get("X-Cloud-Trace-Context")
+	if project == "" || header == "" {
+		return ""
+	}
+	// The header looks like TRACE_ID/SPAN_ID;o=TRACE_TRUE.
+	traceID := strings.SplitN(header, "/", 2)[0]
+	return fmt.Sprintf("projects/%s/traces/%s", project, traceID)
+}
+
+func writeLog(e *logEntry) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	json.NewEncoder(logOutput).Encode(e)
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLogError(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stderr }()
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "my-project")
+	defer os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+
+	r := httptest.NewRequest("POST", "/tasks", nil)
+	r.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b120001000/1;o=1")
+	logError(r, "failed to create task", errors.New("datastore: boom"))
+
+	var got logEntry
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	want := logEntry{
+		Severity: "ERROR",
+		Message:  "failed to create task",
+		Error:    "datastore: boom",
+		Method:   "POST",
+		Path:     "/tasks",
+		Trace:    "projects/my-project/traces/105445aa7843bc8bf206b120001000",
+	}
+	if got != want {
+		t.Errorf("logError wrote %+v, want %+v", got, want)
+	}
+}
+
+func TestLogInfo(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stderr }()
+
+	logInfo(nil, "listening on port %d", 8080)
+
+	var got logEntry
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if want := (logEntry{Severity: "INFO", Message: "listening on port 8080"}); got != want {
+		t.Errorf("logInfo wrote %+v, want %+v", got, want)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stderr }()
+
+	for _, accessLog := range []bool{false, true} {
+		buf.Reset()
+		s := &server{store: &MemTaskStore{}, accessLog: accessLog}
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/42?view=full", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("GET /tasks/42 got status %d, want %d", rr.Code, http.StatusNotFound)
+		}
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if !accessLog {
+			if buf.Len() != 0 {
+				t.Errorf("with the access log off, got log %q, want none", buf.String())
+			}
+			continue
+		}
+		if len(lines) != 1 {
+			t.Fatalf("got %d log lines %q, want one access log entry", len(lines), lines)
+		}
+		var got logEntry
+		if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", lines[0], err)
+		}
+		if got.HTTPRequest == nil {
+			t.Fatalf("access log entry %q has no httpRequest", lines[0])
+		}
+		want := httpRequestLog{
+			RequestMethod: "GET",
+			RequestURL:    "/tasks/42?view=full",
+			Status:        http.StatusNotFound,
+			ResponseSize:  strconv.Itoa(rr.Body.Len()),
+			Latency:       got.HTTPRequest.Latency,
+		}
+		if *got.HTTPRequest != want {
+			t.Errorf("access log got httpRequest %+v, want %+v", *got.HTTPRequest, want)
+		}
+		if !strings.HasSuffix(want.Latency, "s") || got.Severity != "INFO" || got.Path != "/tasks/42" {
+			t.Errorf("access log got entry %q", lines[0])
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stderr }()
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	h := (&server{store: &MemTaskStore{}, accessLog: true}).routes()
+	for _, tt := range []struct {
+		header string // The request's X-Request-ID.
+		keep   bool   // Whether the response should echo the header.
+	}{
+		{"", false},
+		{"abc-123", true},
+		{strings.Repeat("x", maxRequestIDLen), true},
+		{strings.Repeat("x", maxRequestIDLen+1), false},
+		{"bad\x01id", false},
+	} {
+		buf.Reset()
+		req := httptest.NewRequest("GET", "/tasks", nil)
+		if tt.header != "" {
+			req.Header.Set(requestIDHeader, tt.header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		got := rr.Header().Get(requestIDHeader)
+		if tt.keep && got != tt.header {
+			t.Errorf("with %s %q, got %q, want it preserved", requestIDHeader, tt.header, got)
+		}
+		if !tt.keep && !uuid.MatchString(got) {
+			t.Errorf("with %s %q, got %q, want a new UUID", requestIDHeader, tt.header, got)
+		}
+		var e logEntry
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil || e.RequestID != got {
+			t.Errorf("with %s %q, got log %q, want requestId %q", requestIDHeader, tt.header, buf.String(), got)
+		}
+	}
+
+	if a, b := newUUID(), newUUID(); a == b {
+		t.Errorf("newUUID() returned %q twice", a)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics records the outcome of the server's requests and of the datastore
+// operations made to serve them.
+type Metrics interface {
+	// ObserveOp records that the named operation took elapsed and failed
+	// with err, or succeeded if err is nil.
+	ObserveOp(op string, err error, elapsed time.Duration)
+
+	// ObserveRequest records that a request with the given method was
+	// answered with status after elapsed.
+	ObserveRequest(method string, status int, elapsed time.Duration)
+}
+
+// NopMetrics is a Metrics that discards everything it is given.
+type NopMetrics struct{}
+
+// ObserveOp implements Metrics.
+func (NopMetrics) ObserveOp(string, error, time.Duration) {}
+
+// ObserveRequest implements Metrics.
+func (NopMetrics) ObserveRequest(string, int, time.Duration) {}
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// operation duration histogram.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a Metrics that keeps a count of each operation's
+// successes and failures and a histogram of its durations, and the same for
+// requests by method and status. It serves them in the Prometheus text
+// exposition format.
+type PrometheusMetrics struct {
+	mu       sync.Mutex
+	ops      map[string]*opStats
+	requests map[string]*requestStats // By method.
+}
+
+// opStats are the metrics recorded for one operation.
+type opStats struct {
+	ok, failed int
+	buckets    []int // The number of durations in each of durationBuckets.
+	sum        float64
+}
+
+// requestStats are the metrics recorded for the requests with one method.
+type requestStats struct {
+	statuses map[int]int // The number of responses with each status.
+	count    int
+	buckets  []int // The number of durations in each of durationBuckets.
+	sum      float64
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		ops:      make(map[string]*opStats),
+		requests: make(map[string]*requestStats),
+	}
+}
+
+// ObserveOp implements Metrics.
+func (m *PrometheusMetrics) ObserveOp(op string, err error, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.ops[op]
+	if stats == nil {
+		stats = &opStats{buckets: make([]int, len(durationBuckets))}
+		m.ops[op] = stats
+	}
+
+	if err != nil {
+		stats.failed++
+	} else {
+		stats.ok++
+	}
+	stats.sum += observeDuration(stats.buckets, elapsed)
+}
+
+// requestMethods are the methods that requests are counted under. Any other
+// method is counted as "OTHER", so that clients cannot create any number of
+// metrics.
+var requestMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// ObserveRequest implements Metrics.
+func (m *PrometheusMetrics) ObserveRequest(method string, status int, elapsed time.Duration) {
+	if !requestMethods[method] {
+		method = "OTHER"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.requests[method]
+	if stats == nil {
+		stats = &requestStats{statuses: make(map[int]int), buckets: make([]int, len(durationBuckets))}
+		m.requests[method] = stats
+	}
+
+	stats.statuses[status]++
+	stats.count++
+	stats.sum += observeDuration(stats.buckets, elapsed)
+}
+
+// observeDuration adds elapsed to the histogram buckets, which count the
+// durations in each of durationBuckets, and returns it in seconds.
+func observeDuration(buckets []int, elapsed time.Duration) float64 {
+	seconds := elapsed.Seconds()
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			buckets[i]++
+		}
+	}
+	return seconds
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]string, 0, len(m.ops))
+	for op := range m.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP datastore_operations_total Datastore operations by result.")
+	fmt.Fprintln(w, "# TYPE datastore_operations_total counter")
+	for _, op := range ops {
+		stats := m.ops[op]
+		fmt.Fprintf(w, "datastore_operations_total{op=%q,result=\"ok\"} %d\n", op, stats.ok)
+		fmt.Fprintf(w, "datastore_operations_total{op=%q,result=\"error\"} %d\n", op, stats.failed)
+	}
+
+	fmt.Fprintln(w, "# HELP datastore_operation_duration_seconds Datastore operation latency, including retries.")
+	fmt.Fprintln(w, "# TYPE datastore_operation_duration_seconds histogram")
+	for _, op := range ops {
+		stats := m.ops[op]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "datastore_operation_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, le, stats.buckets[i])
+		}
+		total := stats.ok + stats.failed
+		fmt.Fprintf(w, "datastore_operation_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, total)
+		fmt.Fprintf(w, "datastore_operation_duration_seconds_sum{op=%q} %g\n", op, stats.sum)
+		fmt.Fprintf(w, "datastore_operation_duration_seconds_count{op=%q} %d\n", op, total)
+	}
+
+	methods := make([]string, 0, len(m.requests))
+	for method := range m.requests {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintln(w, "# HELP http_requests_total HTTP requests by method and status.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, method := range methods {
+		stats := m.requests[method]
+		statuses := make([]int, 0, len(stats.statuses))
+		for status := range stats.statuses {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "http_requests_total{method=%q,status=\"%d\"} %d\n", method, status, stats.statuses[status])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request latency.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, method := range methods {
+		stats := m.requests[method]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, le, stats.buckets[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, stats.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{method=%q} %g\n", method, stats.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{method=%q} %d\n", method, stats.count)
+	}
+}
+
+// withMetrics records the method, status and duration of each request served
+// by h with the server's metrics.
+func (s *server) withMetrics(h http.Handler) http.Handler {
+	if s.metrics == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		s.metrics.ObserveRequest(r.Method, sw.statusCode(), time.Since(start))
+	})
+}
+
+// statusWriter is an http.ResponseWriter that remembers the status and size
+// of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int   // Zero until the header is written.
+	size   int64 // The bytes of the body written so far.
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, which handleStream needs, if the underlying
+// ResponseWriter does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// statusCode returns the status of the response. A handler that writes
+// nothing at all sends 200 OK.
+func (w *statusWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
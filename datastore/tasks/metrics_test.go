@@ -0,0 +1,136 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics()
+	m.ObserveOp("AddTask", nil, 20*time.Millisecond)
+	m.ObserveOp("AddTask", errors.New("boom"), 3*time.Second)
+	m.ObserveOp("ListTasks", nil, time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, want := range []string{
+		`datastore_operations_total{op="AddTask",result="ok"} 1`,
+		`datastore_operations_total{op="AddTask",result="error"} 1`,
+		`datastore_operations_total{op="ListTasks",result="ok"} 1`,
+		`datastore_operation_duration_seconds_bucket{op="AddTask",le="0.025"} 1`,
+		`datastore_operation_duration_seconds_bucket{op="AddTask",le="5"} 2`,
+		`datastore_operation_duration_seconds_bucket{op="AddTask",le="+Inf"} 2`,
+		`datastore_operation_duration_seconds_sum{op="AddTask"} 3.02`,
+		`datastore_operation_duration_seconds_count{op="ListTasks"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	m := NewPrometheusMetrics()
+	s := &server{client: client, timeout: 100 * time.Millisecond, metrics: m}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/openapi.json", nil), // Never calls WriteHeader.
+		httptest.NewRequest("GET", "/tasks/abc", nil),
+		httptest.NewRequest("GET", "/tasks/0", nil),
+		httptest.NewRequest("PUT", "/count", nil),
+		httptest.NewRequest("BREW", "/tasks", nil),
+	} {
+		s.routes().ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",status="200"} 1`,
+		`http_requests_total{method="GET",status="400"} 2`,
+		`http_requests_total{method="PUT",status="405"} 1`,
+		`http_requests_total{method="OTHER",status="405"} 1`,
+		`http_request_duration_seconds_bucket{method="GET",le="+Inf"} 3`,
+		`http_request_duration_seconds_count{method="PUT"} 1`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		{func(w http.ResponseWriter) {}, http.StatusOK},
+		{func(w http.ResponseWriter) { w.Write([]byte("ok")) }, http.StatusOK},
+		{func(w http.ResponseWriter) { w.WriteHeader(http.StatusCreated) }, http.StatusCreated},
+		{func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusNotFound)
+			w.WriteHeader(http.StatusOK) // Ignored, as by net/http.
+		}, http.StatusNotFound},
+	}
+	for i, test := range tests {
+		sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		test.write(sw)
+		if got := sw.statusCode(); got != test.want {
+			t.Errorf("test %d: statusCode() = %d, want %d", i, got, test.want)
+		}
+	}
+}
+
+func TestMetricsRecordFailure(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	m := NewPrometheusMetrics()
+	s := &server{client: client, timeout: 100 * time.Millisecond, metrics: m}
+
+	s.routes().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/tasks", nil))
+	if stats := m.ops["ListTasks"]; stats == nil || stats.failed != 1 || stats.ok != 0 {
+		t.Errorf("after a failed list got ListTasks stats %+v, want 1 failure", stats)
+	}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `result="error"} 1`) {
+		t.Errorf("GET /metrics got status %d and body:\n%s", rr.Code, rr.Body)
+	}
+}
+
+func TestMetricsAddTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	m := NewPrometheusMetrics()
+	s := &server{client: client, metrics: m}
+
+	id := postTask(t, s, httptest.NewRequest("POST", "/", strings.NewReader("count me")))
+	defer DeleteTask(context.Background(), client, id)
+	if stats := m.ops["AddTask"]; stats == nil || stats.ok != 1 || stats.failed != 0 {
+		t.Errorf("after adding a task got AddTask stats %+v, want 1 success", stats)
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPIDoc is an OpenAPI 3 document describing the server's API. Only the
+// parts of the specification used here are included. See
+// https://spec.openapis.org/oas/v3.0.3.
+type openAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"` // By path, then by lowercase method.
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"` // By status code, or "default".
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"` // One of "query", "header" or "path".
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Content map[string]openAPIMedia `json:"content"` // By media type.
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"` // By media type.
+}
+
+type openAPIMedia struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*jsonSchema `json:"schemas"`
+}
+
+// jsonSchema is the subset of the OpenAPI schema object needed to describe
+// the server's JSON.
+type jsonSchema struct {
+	Ref        string                 `json:"$ref,omitempty"`
+	Type       string                 `json:"type,omitempty"`
+	Format     string                 `json:"format,omitempty"`
+	Nullable   bool                   `json:"nullable,omitempty"`
+	Items      *jsonSchema            `json:"items,omitempty"`
+	Properties map[string]*jsonSchema `json:"properties,omitempty"`
+	// AdditionalProperties is the schema of the values of a JSON object
+	// with arbitrary keys.
+	AdditionalProperties *jsonSchema `json:"additionalProperties,omitempty"`
+}
+
+// schemaNames names the types described under the document's components.
+// Their schemas are generated from the types, so they cannot fall out of
+// step with the JSON the server reads and writes.
+var schemaNames = map[reflect.Type]string{
+	reflect.TypeOf(Task{}):             "Task",
+	reflect.TypeOf(taskPage{}):         "TaskPage",
+	reflect.TypeOf(newTaskRequest{}):   "NewTask",
+	reflect.TypeOf(patchTaskRequest{}): "TaskPatch",
+	reflect.TypeOf(bulkResult{}):       "BulkResult",
+	reflect.TypeOf(taskCounts{}):       "TaskCounts",
+	reflect.TypeOf(errorResponse{}):    "Error",
+	reflect.TypeOf(TaskEvent{}):        "TaskEvent",
+}
+
+// schemaOf returns the schema for values of type t, referring to the
+// components for the types in schemaNames.
+func schemaOf(t reflect.Type) *jsonSchema {
+	if name, ok := schemaNames[t]; ok {
+		return &jsonSchema{Ref: "#/components/schemas/" + name}
+	}
+	return inlineSchema(t)
+}
+
+// inlineSchema returns the schema for values of type t as encoding/json
+// marshals them.
+func inlineSchema(t reflect.Type) *jsonSchema {
+	if t == reflect.TypeOf(time.Time{}) {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem())
+		if s.Ref == "" {
+			s.Nullable = true
+		}
+		return s
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int32:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Int64:
+		return &jsonSchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice:
+		return &jsonSchema{Type: "array", Items: schemaOf(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: schemaOf(t.Elem())}
+	case reflect.Struct:
+		s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // Unexported.
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			s.Properties[name] = schemaOf(f.Type)
+		}
+		return s
+	}
+	return &jsonSchema{}
+}
+
+// jsonContent returns the content of a JSON body holding a value like v.
+func jsonContent(v interface{}) map[string]openAPIMedia {
+	return map[string]openAPIMedia{"application/json": {Schema: schemaOf(reflect.TypeOf(v))}}
+}
+
+// textContent returns the content of a body of the given media type.
+func textContent(mediaType string) map[string]openAPIMedia {
+	return map[string]openAPIMedia{mediaType: {Schema: &jsonSchema{Type: "string"}}}
+}
+
+func queryParam(name, typ, desc string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: desc, Schema: &jsonSchema{Type: typ}}
+}
+
+// openAPIDocument returns the document describing the server's endpoints.
+// Each operation takes the tenant and user headers and may fail with an
+// Error.
+func (s *server) openAPIDocument() *openAPIDoc {
+	idParam := openAPIParameter{Name: "id", In: "path", Required: true, Schema: &jsonSchema{Type: "integer", Format: "int64"}}
+	adminSecretParam := openAPIParameter{Name: adminSecretHeader, In: "header", Required: true, Description: "the server's ADMIN_SECRET", Schema: &jsonSchema{Type: "string"}}
+	taskPaths := map[string]map[string]*openAPIOperation{
+		"/tasks": {
+			"get": {
+				Summary: "List tasks, or get the tasks with the given IDs",
+				Parameters: []openAPIParameter{
+					queryParam("id", "integer", "get the single task with this ID"),
+					queryParam("ids", "string", "get the tasks with these comma-separated IDs"),
+					queryParam("includeDeleted", "boolean", "include the tasks in the recycle bin; not allowed with a filter"),
+					queryParam("done", "boolean", "list only done or open tasks"),
+					queryParam("overdue", "boolean", "list open tasks past their due date"),
+					queryParam("due", "string", "set to today to list the tasks due today"),
+					queryParam("tz", "string", "the IANA time zone of due=today, such as America/New_York; defaults to UTC"),
+					queryParam("tag", "string", "list the tasks with this tag"),
+					queryParam("tags", "string", "list the tasks with all of these comma-separated tags"),
+					queryParam("search", "string", "list the tasks whose descriptions contain each of these words"),
+					queryParam("owner", "string", "list the tasks assigned to this owner"),
+					queryParam("maxEstimate", "integer", "list the open tasks estimated to take at most this many minutes"),
+					queryParam("from", "string", "list the tasks created at or after this RFC 3339 time"),
+					queryParam("to", "string", "list the tasks created before this RFC 3339 time"),
+					queryParam("sort", "string", "the property to order the tasks by"),
+					queryParam("dir", "string", "the direction to sort in, asc or desc"),
+					queryParam("cursor", "string", "the page to start at, from a previous nextCursor; not allowed with a filter"),
+					queryParam("limit", "integer", "the most tasks to list, from 1 to 1000; not allowed with a filter"),
+					queryParam("preview", "boolean", "shorten long descriptions"),
+					queryParam("envelope", "boolean", "set to false for a bare array of tasks"),
+				},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The tasks", Content: jsonContent(taskPage{})},
+				},
+			},
+			"post": {
+				Summary: "Create a task, or several from an array of descriptions",
+				Parameters: []openAPIParameter{
+					{Name: idempotencyHeader, In: "header", Description: "makes retrying the request safe", Schema: &jsonSchema{Type: "string"}},
+					queryParam("priority", "integer", "the priority of a task given as plain text"),
+				},
+				RequestBody: &openAPIRequestBody{Content: map[string]openAPIMedia{
+					"application/json": jsonContent(newTaskRequest{})["application/json"],
+					"text/plain":       textContent("text/plain")["text/plain"],
+				}},
+				Responses: map[string]openAPIResponse{
+					"201": {Description: "The new task", Content: jsonContent(Task{})},
+					"200": {Description: "The task created earlier with the same idempotency key", Content: jsonContent(Task{})},
+				},
+			},
+			"delete": {
+				Summary:    "Permanently delete every done task",
+				Parameters: []openAPIParameter{queryParam("done", "boolean", "must be true"), queryParam("dryRun", "boolean", "only report the tasks that would be deleted")},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The deleted tasks", Content: jsonContent(bulkResult{})},
+				},
+			},
+		},
+		"/tasks/{id}": {
+			"get": {
+				Summary:    "Get a task",
+				Parameters: []openAPIParameter{idParam, {Name: "If-None-Match", In: "header", Schema: &jsonSchema{Type: "string"}}},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The task, with its ETag", Content: jsonContent(Task{})},
+					"304": {Description: "The task has not changed"},
+				},
+			},
+			"put": {
+				Summary:     "Replace a task's description",
+				Parameters:  []openAPIParameter{idParam},
+				RequestBody: &openAPIRequestBody{Content: textContent("text/plain")},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The updated task", Content: jsonContent(Task{})},
+				},
+			},
+			"patch": {
+				Summary:     "Update some of a task's fields",
+				Parameters:  []openAPIParameter{idParam, {Name: "If-Match", In: "header", Schema: &jsonSchema{Type: "string"}}},
+				RequestBody: &openAPIRequestBody{Content: jsonContent(patchTaskRequest{})},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The updated task", Content: jsonContent(Task{})},
+				},
+			},
+			"delete": {
+				Summary:    "Move a task to the recycle bin, or delete it permanently",
+				Parameters: []openAPIParameter{idParam, queryParam("permanent", "boolean", "delete the task permanently")},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The task was deleted", Content: textContent("text/plain")},
+				},
+			},
+		},
+		"/tasks/{id}/duplicate": {
+			"post": {
+				Summary:    "Add a copy of a task's description, tags, priority and due date",
+				Parameters: []openAPIParameter{idParam},
+				Responses: map[string]openAPIResponse{
+					"201": {Description: "The new task", Content: jsonContent(Task{})},
+				},
+			},
+		},
+		"/tasks/done": {
+			"post": {
+				Summary:     "Mark the tasks with the given IDs done",
+				RequestBody: &openAPIRequestBody{Content: jsonContent([]int64{})},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "What was done with each ID", Content: jsonContent([]DoneResult{})},
+				},
+			},
+		},
+		"/tasks/{id}/history": {
+			"get": {
+				Summary:    "Get a task's history, oldest event first",
+				Parameters: []openAPIParameter{idParam},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The task's events", Content: jsonContent([]*TaskEvent{})},
+				},
+			},
+		},
+		"/tasks/{id}/restore": {
+			"post": {
+				Summary:    "Take a task out of the recycle bin",
+				Parameters: []openAPIParameter{idParam},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The task was restored", Content: textContent("text/plain")},
+				},
+			},
+		},
+		"/tasks/{id}/snooze": {
+			"post": {
+				Summary:     "Hide a task from the default listing until a time, or for a duration",
+				Parameters:  []openAPIParameter{idParam},
+				RequestBody: &openAPIRequestBody{Content: jsonContent(snoozeRequest{})},
+				Responses: map[string]openAPIResponse{
+					"200": {Description: "The snoozed task", Content: jsonContent(Task{})},
+				},
+			},
+		},
+	}
+
+	paths := map[string]map[string]*openAPIOperation{
+		"/admin/dedupe": {"post": {
+			Summary:    "Permanently delete the open tasks that duplicate an older one's description",
+			Parameters: []openAPIParameter{adminSecretParam},
+			Responses:  map[string]openAPIResponse{"200": {Description: "The deleted tasks", Content: jsonContent(bulkResult{})}},
+		}},
+		"/admin/reset": {"post": {
+			Summary:    "Permanently delete all the tasks, to reset a test environment",
+			Parameters: []openAPIParameter{adminSecretParam},
+			Responses:  map[string]openAPIResponse{"200": {Description: "The deleted tasks", Content: jsonContent(bulkResult{})}},
+		}},
+		"/changes": {"get": {
+			Summary:    "List the tasks changed and deleted since a time, for syncing",
+			Parameters: []openAPIParameter{queryParam("since", "string", "an RFC 3339 time, such as the next_since of the last response")},
+			Responses:  map[string]openAPIResponse{"200": {Description: "The changes", Content: jsonContent(taskChanges{})}},
+		}},
+		"/completed": {"get": {
+			Summary:    "List the most recently completed tasks, most recent first",
+			Parameters: []openAPIParameter{queryParam("limit", "integer", "the most tasks to list, from 1 to 1000; 10 by default")},
+			Responses:  map[string]openAPIResponse{"200": {Description: "The tasks", Content: jsonContent([]*Task{})}},
+		}},
+		"/count": {"get": {
+			Summary:   "Count the tasks",
+			Responses: map[string]openAPIResponse{"200": {Description: "The counts", Content: jsonContent(taskCounts{})}},
+		}},
+		"/cron/recurrences": {"post": {
+			Summary:   "Spawn the recurring tasks that are due",
+			Responses: map[string]openAPIResponse{"200": {Description: "The IDs of the new tasks", Content: jsonContent([]int64{})}},
+		}},
+		"/done": {"post": {
+			Summary:    "Mark every open task done",
+			Parameters: []openAPIParameter{queryParam("dryRun", "boolean", "only report the tasks that would be marked done")},
+			Responses:  map[string]openAPIResponse{"200": {Description: "The updated tasks", Content: jsonContent(bulkResult{})}},
+		}},
+		"/export.csv": {"get": {
+			Summary:   "Export the tasks as CSV",
+			Responses: map[string]openAPIResponse{"200": {Description: "The tasks", Content: textContent("text/csv")}},
+		}},
+		"/feed": {"get": {
+			Summary: "List the tasks in order of update, for following every change",
+			Parameters: []openAPIParameter{
+				queryParam("cursor", "string", "the nextCursor of the last response"),
+				queryParam("limit", "integer", "the most tasks to list, from 1 to 1000; 50 by default"),
+			},
+			Responses: map[string]openAPIResponse{"200": {Description: "A page of the feed", Content: jsonContent(feedPage{})}},
+		}},
+		"/healthz": {"get": {
+			Summary:   "Check that the datastore can be reached",
+			Responses: map[string]openAPIResponse{"200": {Description: "The server is healthy", Content: textContent("text/plain")}},
+		}},
+		"/ids": {"get": {
+			Summary:   "List the IDs of all the tasks",
+			Responses: map[string]openAPIResponse{"200": {Description: "The IDs", Content: jsonContent([]int64{})}},
+		}},
+		"/import": {"post": {
+			Summary:     "Create tasks from newline-delimited JSON, one NewTask per line",
+			RequestBody: &openAPIRequestBody{Content: textContent("application/x-ndjson")},
+			Responses:   map[string]openAPIResponse{"200": {Description: "The number of tasks imported and the lines that failed", Content: jsonContent(ImportSummary{})}},
+		}},
+		"/openapi.json": {"get": {
+			Summary:   "Describe the API",
+			Responses: map[string]openAPIResponse{"200": {Description: "This document", Content: map[string]openAPIMedia{"application/json": {Schema: &jsonSchema{Type: "object"}}}}},
+		}},
+		"/reports/tags": {"get": {
+			Summary:   "Count the open and done tasks with each tag",
+			Responses: map[string]openAPIResponse{"200": {Description: "The counts for each tag", Content: jsonContent(map[string]TagStatus{})}},
+		}},
+		"/stream": {"get": {
+			Summary:   "Stream an event each time a task is added, completed or deleted",
+			Responses: map[string]openAPIResponse{"200": {Description: "Server-sent events", Content: textContent("text/event-stream")}},
+		}},
+		"/tags": {"get": {
+			Summary:   "Count the tasks with each tag",
+			Responses: map[string]openAPIResponse{"200": {Description: "The number of tasks with each tag", Content: jsonContent(map[string]int{})}},
+		}},
+	}
+	if _, ok := s.metrics.(http.Handler); ok {
+		paths["/metrics"] = map[string]*openAPIOperation{"get": {
+			Summary:   "Report metrics in the Prometheus format",
+			Responses: map[string]openAPIResponse{"200": {Description: "The metrics", Content: textContent("text/plain")}},
+		}}
+	}
+
+	// Task lists serve the same operations on the tasks in the list.
+	nameParam := openAPIParameter{Name: "name", In: "path", Required: true, Schema: &jsonSchema{Type: "string"}}
+	for path, ops := range taskPaths {
+		paths[path] = ops
+		listOps := make(map[string]*openAPIOperation)
+		for method, op := range ops {
+			listOp := *op
+			listOp.Summary += " in a task list"
+			listOp.Parameters = append([]openAPIParameter{nameParam}, op.Parameters...)
+			listOps[method] = &listOp
+		}
+		paths["/lists/{name}"+path] = listOps
+	}
+
+	tenantParam := openAPIParameter{Name: tenantHeader, In: "header", Description: "the tenant whose tasks to act on", Schema: &jsonSchema{Type: "string"}}
+	userParam := openAPIParameter{Name: userHeader, In: "header", Description: "the user making the request, recorded on the tasks it marks done", Schema: &jsonSchema{Type: "string"}}
+	for _, ops := range paths {
+		for _, op := range ops {
+			op.Parameters = append(op.Parameters, tenantParam, userParam)
+			op.Responses["default"] = openAPIResponse{Description: "An error", Content: jsonContent(errorResponse{})}
+		}
+	}
+
+	schemas := make(map[string]*jsonSchema)
+	for t, name := range schemaNames {
+		schemas[name] = inlineSchema(t)
+	}
+	return &openAPIDoc{
+		OpenAPI:    "3.0.3",
+		Info:       openAPIInfo{Title: "Datastore task list", Version: "1"},
+		Paths:      paths,
+		Components: openAPIComponents{Schemas: schemas},
+	}
+}
+
+// handleOpenAPI writes the OpenAPI document describing the server's API.
+func (s *server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(s.openAPIDocument())
+}
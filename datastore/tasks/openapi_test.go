@@ -0,0 +1,106 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client, metrics: NewPrometheusMetrics()}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json got status %d, want %d", rr.Code, http.StatusOK)
+	}
+	var doc openAPIDoc
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("GET /openapi.json: could not decode %q: %v", rr.Body, err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("GET /openapi.json got version %q, want 3.x", doc.OpenAPI)
+	}
+
+	// Every route registered by routes is described, other than "/", which
+	// serves the same requests as /tasks.
+	var got []string
+	for path := range doc.Paths {
+		got = append(got, path)
+	}
+	sort.Strings(got)
+	want := []string{
+		"/admin/dedupe", "/admin/reset", "/changes", "/completed", "/count", "/cron/recurrences", "/done", "/export.csv", "/feed", "/healthz", "/ids", "/import",
+		"/lists/{name}/tasks", "/lists/{name}/tasks/done", "/lists/{name}/tasks/{id}",
+		"/lists/{name}/tasks/{id}/duplicate", "/lists/{name}/tasks/{id}/history", "/lists/{name}/tasks/{id}/restore", "/lists/{name}/tasks/{id}/snooze",
+		"/metrics", "/openapi.json", "/reports/tags", "/stream", "/tags",
+		"/tasks", "/tasks/done", "/tasks/{id}", "/tasks/{id}/duplicate", "/tasks/{id}/history", "/tasks/{id}/restore", "/tasks/{id}/snooze",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("GET /openapi.json got paths %q, want %q", got, want)
+	}
+
+	// Every described operation is served. The requests' contexts are
+	// canceled so that those reaching the datastore fail quickly.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fill := strings.NewReplacer("{id}", "1", "{name}", "groceries")
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			req := httptest.NewRequest(strings.ToUpper(method), fill.Replace(path), nil).WithContext(ctx)
+			rr := httptest.NewRecorder()
+			s.routes().ServeHTTP(rr, req)
+			if rr.Code == http.StatusMethodNotAllowed || rr.Code == http.StatusNotFound {
+				t.Errorf("%s %s is described but got status %d", req.Method, path, rr.Code)
+			}
+		}
+	}
+
+	// The Task schema has each of the fields in a task's JSON.
+	data, err := json.Marshal(Task{})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	schema := doc.Components.Schemas["Task"]
+	if schema == nil {
+		t.Fatalf("GET /openapi.json has no Task schema")
+	}
+	if len(schema.Properties) != len(fields) {
+		t.Errorf("Task schema has %d properties, want %d", len(schema.Properties), len(fields))
+	}
+	for name := range fields {
+		if schema.Properties[name] == nil {
+			t.Errorf("Task schema is missing %q", name)
+		}
+	}
+	if got := schema.Properties["created"]; got == nil || got.Type != "string" || got.Format != "date-time" {
+		t.Errorf("Task schema describes created as %+v, want a date-time string", got)
+	}
+	if got := doc.Components.Schemas["TaskPage"].Properties["tasks"].Items; got == nil || got.Ref != "#/components/schemas/Task" {
+		t.Errorf("TaskPage schema describes tasks as an array of %+v, want Tasks", got)
+	}
+}
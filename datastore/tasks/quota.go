@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// taskQuota caps the number of open tasks each tenant may have, for cost
+// control. Tasks that are done or in the recycle bin do not count.
+type taskQuota struct {
+	limit   int            // The cap for tenants not in tenants; 0 for none.
+	tenants map[string]int // The caps of particular tenants; 0 for none.
+}
+
+// taskQuotaFromEnv returns the quota configured by MAX_OPEN_TASKS, the cap
+// for every tenant, and MAX_OPEN_TASKS_BY_TENANT, a comma-separated list of
+// tenant=cap pairs, such as "acme=1000,demo=20", overriding it for
+// particular tenants. A cap of 0 means no cap. It returns nil if no tenant
+// has a cap.
+func taskQuotaFromEnv() (*taskQuota, error) {
+	q := &taskQuota{tenants: make(map[string]int)}
+	if v := os.Getenv("MAX_OPEN_TASKS"); v != "" {
+		var err error
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 0 {
+			return nil, fmt.Errorf("invalid MAX_OPEN_TASKS %q (must be a non-negative integer)", v)
+		}
+	}
+	capped := q.limit > 0
+	for _, pair := range strings.Split(os.Getenv("MAX_OPEN_TASKS_BY_TENANT"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid MAX_OPEN_TASKS_BY_TENANT entry %q (must be tenant=cap)", pair)
+		}
+		tenant, v := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 || !validNamespace.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid MAX_OPEN_TASKS_BY_TENANT entry %q (must be tenant=cap)", pair)
+		}
+		q.tenants[tenant] = limit
+		capped = capped || limit > 0
+	}
+	if !capped {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// limitFor returns the cap on the tenant's open tasks, or 0 if it has none.
+func (q *taskQuota) limitFor(tenant string) int {
+	if limit, ok := q.tenants[tenant]; ok {
+		return limit
+	}
+	return q.limit
+}
+
+// checkQuota reports whether the request's tenant may add n more open tasks
+// under the server's quota. If not, it reports the error to the client with
+// 409 Conflict. Tasks are counted across all of the tenant's task lists.
+// Concurrent requests are not serialized, so they can together exceed the
+// cap slightly.
+func (s *server) checkQuota(w http.ResponseWriter, r *http.Request, n int) bool {
+	if s.quota == nil {
+		return true
+	}
+	tenant := r.Header.Get(tenantHeader)
+	limit := s.quota.limitFor(tenant)
+	if limit == 0 {
+		return true
+	}
+	open, err := CountOpenTasks(WithList(s.context(r), ""), s.client)
+	if err != nil {
+		serverError(w, r, "failed to count open tasks", err)
+		return false
+	}
+	if open+n > limit {
+		writeError(w, http.StatusConflict, codeQuotaExceeded, fmt.Sprintf("at most %d open tasks are allowed, and %d are open; complete or delete some first", limit, open))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskQuotaFromEnv(t *testing.T) {
+	defer os.Unsetenv("MAX_OPEN_TASKS")
+	defer os.Unsetenv("MAX_OPEN_TASKS_BY_TENANT")
+
+	for _, tt := range []struct {
+		limit, byTenant string
+		wantNil         bool
+		wantErr         bool
+		want            map[string]int // The cap for each tenant.
+	}{
+		{wantNil: true},
+		{limit: "0", byTenant: "acme=0", wantNil: true},
+		{limit: "5", want: map[string]int{"": 5, "acme": 5}},
+		{byTenant: "acme=1000, demo=20", want: map[string]int{"": 0, "acme": 1000, "demo": 20}},
+		{limit: "5", byTenant: "acme=0", want: map[string]int{"": 5, "acme": 0}},
+		{limit: "-1", wantErr: true},
+		{limit: "many", wantErr: true},
+		{byTenant: "acme", wantErr: true},
+		{byTenant: "acme=lots", wantErr: true},
+		{byTenant: "not a tenant!=5", wantErr: true},
+	} {
+		os.Setenv("MAX_OPEN_TASKS", tt.limit)
+		os.Setenv("MAX_OPEN_TASKS_BY_TENANT", tt.byTenant)
+		q, err := taskQuotaFromEnv()
+		label := fmt.Sprintf("MAX_OPEN_TASKS=%q MAX_OPEN_TASKS_BY_TENANT=%q", tt.limit, tt.byTenant)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", label, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (q == nil) != tt.wantNil {
+			t.Errorf("%s: got quota %+v, want nil: %v", label, q, tt.wantNil)
+			continue
+		}
+		for tenant, want := range tt.want {
+			if got := q.limitFor(tenant); got != want {
+				t.Errorf("%s: limitFor(%q) = %d, want %d", label, tenant, got, want)
+			}
+		}
+	}
+}
+
+func TestTaskQuota(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	tenant := fmt.Sprint("quota-", time.Now().UnixNano())
+	ctx := WithNamespace(context.Background(), tenant)
+	s := &server{client: client, quota: &taskQuota{limit: 2}}
+	h := s.routes()
+
+	create := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/tasks", strings.NewReader(body))
+		req.Header.Set(tenantHeader, tenant)
+		if strings.HasPrefix(body, "[") {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var ids []int64
+	for _, desc := range []string{"first", "second"} {
+		rr := create(desc)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("POST /tasks %q got status %d, want %d: %s", desc, rr.Code, http.StatusCreated, rr.Body)
+		}
+		var task Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil {
+			t.Fatalf("POST /tasks: decoding response: %v", err)
+		}
+		ids = append(ids, task.Id)
+		defer DeleteTask(ctx, client, task.Id)
+	}
+
+	for _, body := range []string{"third", `["third", "fourth"]`} {
+		rr := create(body)
+		var resp errorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != http.StatusConflict || resp.Error.Code != codeQuotaExceeded {
+			t.Errorf("POST /tasks %s at the cap got status %d and body %s, want %d and code %q", body, rr.Code, rr.Body, http.StatusConflict, codeQuotaExceeded)
+		}
+	}
+
+	// A done task no longer counts towards the cap.
+	if err := MarkDone(ctx, client, ids[0]); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	rr := create("third")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks after completing a task got status %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	var task Task
+	json.Unmarshal(rr.Body.Bytes(), &task)
+	defer DeleteTask(ctx, client, task.Id)
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Default rate limits for each client.
+const (
+	defaultRateLimit = 10 // Requests per second.
+	defaultRateBurst = 20
+)
+
+// maxRateBuckets bounds the number of clients a rateLimiter tracks.
+const maxRateBuckets = 10000
+
+// rateLimiter is a token bucket rate limiter for each of many clients, safe
+// for concurrent use. Each client's bucket holds up to burst tokens and
+// refills at rate tokens per second; each request takes one token.
+type rateLimiter struct {
+	rate  float64
+	burst int
+	now   func() time.Time // Replaced in tests.
+
+	mu      sync.Mutex
+	buckets map[string]*rate.Limiter
+}
+
+// newRateLimiter returns a limiter allowing each client limit requests per
+// second, and bursts of up to burst requests.
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    limit,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*rate.Limiter),
+	}
+}
+
+// rateLimiterFromEnv returns a limiter configured by RATE_LIMIT, the requests
+// per second allowed for each client, and RATE_LIMIT_BURST. It returns nil if
+// RATE_LIMIT is 0.
+func rateLimiterFromEnv() (*rateLimiter, error) {
+	limit, burst := float64(defaultRateLimit), defaultRateBurst
+	if v := os.Getenv("RATE_LIMIT"); v != "" {
+		var err error
+		if limit, err = strconv.ParseFloat(v, 64); err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT %q (must be a number of requests per second)", v)
+		}
+	}
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		var err error
+		if burst, err = strconv.Atoi(v); err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_BURST %q (must be a positive integer)", v)
+		}
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return newRateLimiter(limit, burst), nil
+}
+
+// allow takes a token from the client's bucket and reports whether there was
+// one. If not, it also returns how long until there will be.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.evict(now)
+		}
+		b = rate.NewLimiter(rate.Limit(l.rate), l.burst)
+		l.buckets[client] = b
+	}
+
+	r := b.ReserveN(now, 1)
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+// evict removes the buckets that have refilled, which are no different from
+// new ones, or if there are none, every bucket. l.mu must be held.
+func (l *rateLimiter) evict(now time.Time) {
+	for client, b := range l.buckets {
+		if b.TokensAt(now) >= float64(l.burst) {
+			delete(l.buckets, client)
+		}
+	}
+	if len(l.buckets) >= maxRateBuckets {
+		l.buckets = make(map[string]*rate.Limiter)
+	}
+}
+
+// rateLimitKey identifies the client making a request: its tenant, if it
+// sets the tenant header, and otherwise its IP address.
+func rateLimitKey(r *http.Request) string {
+	if tenant := r.Header.Get(tenantHeader); tenant != "" {
+		return "tenant:" + tenant
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// limitRate rejects requests that change tasks, other than GET and HEAD
+// requests, with 429 Too Many Requests once their client exceeds the
+// server's rate limit. The Retry-After header says how many seconds to wait.
+func (s *server) limitRate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := s.limiter.allow(rateLimitKey(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, codeRateLimited, "too many requests; retry later")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
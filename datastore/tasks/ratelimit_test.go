@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within the burst was not allowed", i+1)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatalf("request beyond the burst was allowed")
+	}
+	if want := 500 * time.Millisecond; wait != want {
+		t.Errorf("request beyond the burst got wait %v, want %v", wait, want)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Errorf("another client's first request was not allowed")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Errorf("request after refilling one token was not allowed")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Errorf("second request after refilling one token was allowed")
+	}
+
+	// A bucket never holds more than the burst.
+	now = now.Add(time.Hour)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.allow("a"); ok {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("after an hour idle got %d requests allowed, want 3", allowed)
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	s := &server{limiter: newRateLimiter(1, 2)}
+	h := s.routes()
+
+	limited := 0
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("POST", "/tasks/not-an-id", nil)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusTooManyRequests {
+			continue
+		}
+		limited++
+		if got := rr.Header().Get("Retry-After"); got != "1" {
+			t.Errorf("429 response got Retry-After %q, want %q", got, "1")
+		}
+	}
+	if limited != 3 {
+		t.Errorf("5 POSTs with a burst of 2 got %d responses of 429, want 3", limited)
+	}
+
+	// Reads and other clients are not limited.
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/tasks/not-an-id", nil))
+	if rr.Code == http.StatusTooManyRequests {
+		t.Errorf("GET by a limited client got status %d", rr.Code)
+	}
+	req := httptest.NewRequest("POST", "/tasks/not-an-id", nil)
+	req.Header.Set(tenantHeader, "other")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code == http.StatusTooManyRequests {
+		t.Errorf("POST by another tenant got status %d", rr.Code)
+	}
+}
+
+func TestRateLimiterFromEnv(t *testing.T) {
+	defer os.Unsetenv("RATE_LIMIT")
+	defer os.Unsetenv("RATE_LIMIT_BURST")
+
+	l, err := rateLimiterFromEnv()
+	if err != nil || l == nil || l.rate != defaultRateLimit || l.burst != defaultRateBurst {
+		t.Errorf("rateLimiterFromEnv() = %+v, %v, want the defaults", l, err)
+	}
+
+	os.Setenv("RATE_LIMIT", "0.5")
+	os.Setenv("RATE_LIMIT_BURST", "4")
+	if l, err := rateLimiterFromEnv(); err != nil || l == nil || l.rate != 0.5 || l.burst != 4 {
+		t.Errorf("rateLimiterFromEnv() = %+v, %v, want rate 0.5 and burst 4", l, err)
+	}
+
+	os.Setenv("RATE_LIMIT", "0")
+	if l, err := rateLimiterFromEnv(); err != nil || l != nil {
+		t.Errorf("rateLimiterFromEnv() with RATE_LIMIT=0 = %+v, %v, want nil", l, err)
+	}
+
+	os.Setenv("RATE_LIMIT_BURST", "none")
+	if _, err := rateLimiterFromEnv(); err == nil {
+		t.Errorf("rateLimiterFromEnv() with an invalid burst got no error")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// A task with a Recurrence is a template: rather than being done itself, it
+// spawns a new task each time its next occurrence comes due. The supported
+// recurrences are "daily", "weekly" and "monthly".
+
+// ErrInvalidRecurrence is returned when a task's Recurrence is not one of the
+// supported recurrences.
+var ErrInvalidRecurrence = errors.New(`task recurrence must be "daily", "weekly" or "monthly"`)
+
+// recurrenceIntervals maps each supported recurrence to the years, months
+// and days between occurrences, as passed to time.Time.AddDate.
+var recurrenceIntervals = map[string][3]int{
+	"daily":   {0, 0, 1},
+	"weekly":  {0, 0, 7},
+	"monthly": {0, 1, 0},
+}
+
+// nextOccurrence returns the first occurrence of the recurrence after t.
+func nextOccurrence(recurrence string, t time.Time) (time.Time, error) {
+	d, ok := recurrenceIntervals[recurrence]
+	if !ok {
+		return time.Time{}, ErrInvalidRecurrence
+	}
+	return t.AddDate(d[0], d[1], d[2]), nil
+}
+
+// scheduleRecurrence sets the first occurrence of a new recurring task: its
+// due date if it has one, and otherwise its creation time.
+func scheduleRecurrence(task *Task) {
+	if task.Recurrence == "" || !task.NextDue.IsZero() {
+		return
+	}
+	task.NextDue = task.Due
+	if task.NextDue.IsZero() {
+		task.NextDue = task.Created
+	}
+}
+
+// SpawnDueRecurrences creates a task for each recurring task whose next
+// occurrence is due at now, with the occurrence as its due date, and returns
+// the keys of the new tasks. Each recurring task's next occurrence is then
+// advanced past now in the same transaction, so calling SpawnDueRecurrences
+// again in the same window, or concurrently, does not spawn the occurrence
+// twice. If several occurrences were missed only the earliest is spawned.
+// Recurring tasks in the recycle bin spawn nothing until they are restored.
+func SpawnDueRecurrences(ctx context.Context, client *datastore.Client, now time.Time) ([]*datastore.Key, error) {
+	// Only recurring tasks have a next_due property.
+	query := taskQuery(ctx).Filter("next_due <=", now).KeysOnly()
+	templates, err := client.GetAll(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var spawned []*datastore.Key
+	for _, key := range templates {
+		var pending *datastore.PendingKey
+		commit, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			pending = nil
+			var template Task
+			if err := tx.Get(key, &template); err != nil {
+				return err
+			}
+			// The query may be stale, so check the occurrence is still due.
+			if template.Recurrence == "" || template.Deleted || template.NextDue.After(now) {
+				return nil
+			}
+
+			task := &Task{
+				Created:         now,
+				UpdatedAt:       now,
+				Priority:        template.Priority,
+				Due:             template.NextDue,
+				Tags:            template.Tags,
+				Owner:           template.Owner,
+				Position:        template.Position,
+				Color:           template.Color,
+				EstimateMinutes: template.EstimateMinutes,
+			}
+			setDesc(task, template.Desc)
+			newKey := datastore.IncompleteKey(key.Kind, key.Parent)
+			newKey.Namespace = key.Namespace
+			var err error
+			if pending, err = tx.Put(newKey, task); err != nil {
+				return err
+			}
+
+			for !template.NextDue.After(now) {
+				if template.NextDue, err = nextOccurrence(template.Recurrence, template.NextDue); err != nil {
+					return err
+				}
+			}
+			template.Version++
+			template.UpdatedAt = now
+			_, err = tx.Put(key, &template)
+			return err
+		})
+		if err == datastore.ErrNoSuchEntity {
+			// The recurring task was deleted since the query ran.
+			continue
+		}
+		if err != nil {
+			return spawned, err
+		}
+		if pending != nil {
+			key := commit.Key(pending)
+			spawned = append(spawned, key)
+			publishEvent(ctx, eventAdded, key)
+		}
+	}
+	return spawned, nil
+}
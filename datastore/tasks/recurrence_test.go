@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNextOccurrence(t *testing.T) {
+	start := time.Date(2019, 1, 28, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		recurrence string
+		want       time.Time
+	}{
+		{"daily", time.Date(2019, 1, 29, 9, 0, 0, 0, time.UTC)},
+		{"weekly", time.Date(2019, 2, 4, 9, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2019, 2, 28, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := nextOccurrence(test.recurrence, start)
+		if err != nil {
+			t.Errorf("nextOccurrence(%q): %v", test.recurrence, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("nextOccurrence(%q, %v) = %v, want %v", test.recurrence, start, got, test.want)
+		}
+	}
+
+	if _, err := nextOccurrence("hourly", start); err != ErrInvalidRecurrence {
+		t.Errorf("nextOccurrence(hourly) got err %v, want %v", err, ErrInvalidRecurrence)
+	}
+	if _, err := CreateTask(context.Background(), nil, &Task{Desc: "x", Recurrence: "hourly"}); err != ErrInvalidRecurrence {
+		t.Errorf("CreateTask with recurrence hourly got err %v, want %v", err, ErrInvalidRecurrence)
+	}
+}
+
+func TestSpawnDueRecurrences(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("recurring-", time.Now().UnixNano()))
+
+	// A daily task that was first due three days ago.
+	firstDue := time.Now().Add(-72 * time.Hour).Truncate(time.Second)
+	template := &Task{Desc: "water plants", Recurrence: "daily", Due: firstDue, Owner: "alex"}
+	key, err := CreateTask(ctx, client, template)
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+	// A recurring task in the recycle bin must not spawn.
+	deleted, err := CreateTask(ctx, client, &Task{Desc: "feed the cat", Recurrence: "daily", Due: firstDue})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, deleted.ID)
+	if err := SoftDeleteTask(ctx, client, deleted.ID); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	now := time.Now()
+	spawned, err := SpawnDueRecurrences(ctx, client, now)
+	if err != nil {
+		t.Fatalf("SpawnDueRecurrences: %v", err)
+	}
+	for _, k := range spawned {
+		defer DeleteTask(ctx, client, k.ID)
+	}
+	if len(spawned) != 1 {
+		t.Fatalf("SpawnDueRecurrences spawned %d tasks, want 1", len(spawned))
+	}
+	task, err := GetTask(ctx, client, spawned[0].ID)
+	if err != nil {
+		t.Fatalf("GetTask(spawned): %v", err)
+	}
+	if task.Desc != template.Desc || !task.Due.Equal(firstDue) || task.Recurrence != "" || task.Owner != template.Owner {
+		t.Errorf("spawned task %+v, want description %q, due %v, owner %q and no recurrence", task, template.Desc, firstDue, template.Owner)
+	}
+
+	updated, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask(template): %v", err)
+	}
+	if !updated.NextDue.After(now) || updated.NextDue.After(now.Add(24*time.Hour)) {
+		t.Errorf("template NextDue = %v, want within a day after %v", updated.NextDue, now)
+	}
+
+	again, err := SpawnDueRecurrences(ctx, client, now)
+	if err != nil {
+		t.Fatalf("second SpawnDueRecurrences: %v", err)
+	}
+	if len(again) != 0 {
+		t.Errorf("second SpawnDueRecurrences in the same window spawned %d tasks", len(again))
+	}
+}
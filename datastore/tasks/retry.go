@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryPolicy controls how datastore operations are retried after transient
+// errors. The zero value makes a single attempt.
+type retryPolicy struct {
+	Attempts int           // The most attempts to make, including the first.
+	Initial  time.Duration // The delay before the first retry.
+	Max      time.Duration // The longest delay between attempts.
+}
+
+// defaultRetryPolicy is the retry policy used by the server.
+var defaultRetryPolicy = retryPolicy{
+	Attempts: 4,
+	Initial:  100 * time.Millisecond,
+	Max:      2 * time.Second,
+}
+
+// retryPolicyFromEnv returns defaultRetryPolicy with any of its fields
+// overridden by the DATASTORE_RETRY_ATTEMPTS, DATASTORE_RETRY_INITIAL and
+// DATASTORE_RETRY_MAX environment variables. The delays are durations such
+// as "250ms".
+func retryPolicyFromEnv() (retryPolicy, error) {
+	p := defaultRetryPolicy
+	if v := os.Getenv("DATASTORE_RETRY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid DATASTORE_RETRY_ATTEMPTS: %v", err)
+		}
+		p.Attempts = n
+	}
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{
+		{"DATASTORE_RETRY_INITIAL", &p.Initial},
+		{"DATASTORE_RETRY_MAX", &p.Max},
+	} {
+		if v := os.Getenv(d.env); v != "" {
+			dur, err := time.ParseDuration(v)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s: %v", d.env, err)
+			}
+			*d.dst = dur
+		}
+	}
+	return p, nil
+}
+
+// do calls f until it succeeds, returns an error that is not transient, or
+// has been called p.Attempts times, doubling the delay between calls each
+// time up to p.Max. It stops early if ctx is done, returning the last error
+// from f.
+func (p retryPolicy) do(ctx context.Context, f func() error) error {
+	delay := p.Initial
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= p.Attempts || !isTransient(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > p.Max {
+			delay = p.Max
+		}
+	}
+}
+
+// isTransient reports whether err is a datastore error that may not happen
+// again if the operation is retried.
+func isTransient(err error) bool {
+	if err == datastore.ErrConcurrentTransaction {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeOp is a datastore operation that fails with each of errs in turn and
+// then succeeds, counting how many times it is called.
+type fakeOp struct {
+	errs  []error
+	calls int
+}
+
+func (f *fakeOp) call() error {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return f.errs[f.calls-1]
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	deadline := status.Error(codes.DeadlineExceeded, "deadline exceeded")
+	aborted := status.Error(codes.Aborted, "aborted")
+	notFound := status.Error(codes.NotFound, "not found")
+	invalid := status.Error(codes.InvalidArgument, "invalid argument")
+
+	p := retryPolicy{Attempts: 3, Initial: time.Millisecond, Max: 2 * time.Millisecond}
+	tests := []struct {
+		label     string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{label: "success", errs: nil, wantErr: nil, wantCalls: 1},
+		{label: "transient then success", errs: []error{unavailable, aborted}, wantErr: nil, wantCalls: 3},
+		{label: "contention", errs: []error{datastore.ErrConcurrentTransaction}, wantErr: nil, wantCalls: 2},
+		{label: "too many failures", errs: []error{unavailable, deadline, aborted, unavailable}, wantErr: aborted, wantCalls: 3},
+		{label: "not found", errs: []error{notFound}, wantErr: notFound, wantCalls: 1},
+		{label: "invalid argument", errs: []error{invalid}, wantErr: invalid, wantCalls: 1},
+		{label: "no such entity", errs: []error{ErrTaskNotFound}, wantErr: ErrTaskNotFound, wantCalls: 1},
+	}
+	for _, test := range tests {
+		op := &fakeOp{errs: test.errs}
+		if err := p.do(context.Background(), op.call); err != test.wantErr {
+			t.Errorf("%s: got err %v, want %v", test.label, err, test.wantErr)
+		}
+		if op.calls != test.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", test.label, op.calls, test.wantCalls)
+		}
+	}
+}
+
+func TestRetryZeroPolicy(t *testing.T) {
+	op := &fakeOp{errs: []error{status.Error(codes.Unavailable, "unavailable")}}
+	var p retryPolicy
+	if err := p.do(context.Background(), op.call); err == nil {
+		t.Errorf("zero retryPolicy retried a failure")
+	}
+	if op.calls != 1 {
+		t.Errorf("zero retryPolicy made %d calls, want 1", op.calls)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	op := &fakeOp{errs: []error{status.Error(codes.Unavailable, "unavailable")}}
+	p := retryPolicy{Attempts: 5, Initial: time.Hour, Max: time.Hour}
+	if err := p.do(ctx, op.call); err == nil {
+		t.Errorf("retry with canceled context returned nil error")
+	}
+	if op.calls != 1 {
+		t.Errorf("retry with canceled context made %d calls, want 1", op.calls)
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	os.Setenv("DATASTORE_RETRY_ATTEMPTS", "7")
+	os.Setenv("DATASTORE_RETRY_MAX", "5s")
+	defer os.Unsetenv("DATASTORE_RETRY_ATTEMPTS")
+	defer os.Unsetenv("DATASTORE_RETRY_MAX")
+
+	p, err := retryPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("retryPolicyFromEnv: %v", err)
+	}
+	want := retryPolicy{Attempts: 7, Initial: defaultRetryPolicy.Initial, Max: 5 * time.Second}
+	if p != want {
+		t.Errorf("retryPolicyFromEnv() = %+v, want %+v", p, want)
+	}
+
+	os.Setenv("DATASTORE_RETRY_MAX", "soon")
+	if _, err := retryPolicyFromEnv(); err == nil {
+		t.Errorf("retryPolicyFromEnv with invalid DATASTORE_RETRY_MAX returned nil error")
+	}
+}
@@ -0,0 +1,1966 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+// server serves the task list over HTTP.
+type server struct {
+	client *datastore.Client
+	// store holds the tasks for the endpoints that create, get, list,
+	// complete and delete single tasks. If it is nil, a DatastoreTaskStore
+	// using client is used.
+	store TaskStore
+	// timeout bounds how long each request may spend on datastore
+	// operations. If it is zero, defaultRequestTimeout is used.
+	timeout time.Duration
+	// retry is used for the operations that create, complete and list tasks.
+	retry retryPolicy
+	// metrics records the outcome of the same operations. If it is nil,
+	// nothing is recorded. If it is also an http.Handler, it is served on
+	// /metrics.
+	metrics Metrics
+	// cache, if not nil, caches the default task listing. Every request
+	// that may change tasks empties it.
+	cache *taskCache
+	// webhook, if not nil, is notified of each task marked done by MarkDone
+	// or a PATCH. Tasks marked done in bulk by POST /done are not notified.
+	webhook *webhook
+	// limiter, if not nil, limits the rate at which each client may change
+	// tasks.
+	limiter *rateLimiter
+	// quota, if not nil, caps the open tasks of each tenant.
+	quota *taskQuota
+	// corsOrigins are the origins from which browsers may call the API.
+	corsOrigins corsOrigins
+	// kind is the datastore kind of the tasks. If it is empty, Task is used.
+	kind string
+	// eventual, if set, makes queries within task lists eventually
+	// consistent; see WithEventualConsistency.
+	eventual bool
+	// adminSecret is the secret that requests to the admin endpoints must
+	// send in adminSecretHeader. If it is empty, the admin endpoints refuse
+	// every request.
+	adminSecret string
+	// accessLog, if set, logs each request served; see withAccessLog.
+	accessLog bool
+}
+
+// tasks returns the server's TaskStore.
+func (s *server) tasks() TaskStore {
+	if s.store != nil {
+		return s.store
+	}
+	return &DatastoreTaskStore{Client: s.client}
+}
+
+// notifyDone notifies the server's webhook, if any, that the task with the
+// given ID has been marked done. Errors are logged and otherwise ignored.
+func (s *server) notifyDone(ctx context.Context, r *http.Request, id int64) {
+	if s.webhook == nil {
+		return
+	}
+	task, err := s.tasks().Get(ctx, id)
+	if err != nil {
+		logError(r, fmt.Sprintf("Could not read task %d to notify webhook", id), err)
+		return
+	}
+	s.webhook.taskDone(task)
+}
+
+// do runs the datastore operation f with the server's retry policy, and
+// records its outcome under the given operation name.
+func (s *server) do(ctx context.Context, op string, f func() error) error {
+	start := time.Now()
+	err := s.retry.do(ctx, f)
+	if s.metrics != nil {
+		s.metrics.ObserveOp(op, err, time.Since(start))
+	}
+	return err
+}
+
+// tenantHeader is the request header naming the tenant whose tasks a request
+// acts on. Each tenant's tasks are kept in their own datastore namespace.
+const tenantHeader = "X-Tenant-ID"
+
+// userHeader is the request header naming the user making a request, who is
+// recorded as the CompletedBy of the tasks it marks done. Like a task's owner,
+// it is taken on trust from the client.
+const userHeader = "X-User"
+
+// validNamespace matches the names datastore accepts for namespaces.
+var validNamespace = regexp.MustCompile(`^[0-9A-Za-z._-]{0,100}$`)
+
+// defaultRequestTimeout is the server's timeout when none is configured.
+const defaultRequestTimeout = 10 * time.Second
+
+// context returns the context for the datastore operations made while
+// serving r, using the server's kind, the namespace of the request's tenant
+// and the task list chosen by handleList, if any. It is derived from the
+// request's context, so the operations are canceled if the client goes away
+// or the request times out.
+func (s *server) context(r *http.Request) context.Context {
+	ctx := WithNamespace(r.Context(), r.Header.Get(tenantHeader))
+	if user := strings.TrimSpace(r.Header.Get(userHeader)); user != "" {
+		ctx = WithUser(ctx, user)
+	}
+	if s.kind != "" {
+		ctx = WithKind(ctx, s.kind)
+	}
+	if s.eventual {
+		ctx = WithEventualConsistency(ctx)
+	}
+	return ctx
+}
+
+// routes returns the handler for all of the server's endpoints.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/dedupe", s.requireAdmin(s.handleDedupe))
+	mux.HandleFunc("/admin/reset", s.requireAdmin(s.handleReset))
+	mux.HandleFunc("/changes", s.handleChanges)
+	mux.HandleFunc("/completed", s.handleCompleted)
+	mux.HandleFunc("/count", s.handleCount)
+	mux.HandleFunc("/cron/recurrences", s.handleRecurrences)
+	mux.HandleFunc("/done", s.handleAllDone)
+	mux.HandleFunc("/export.csv", s.handleExport)
+	mux.HandleFunc("/feed", s.handleFeed)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/ids", s.handleIDs)
+	mux.HandleFunc("/import", s.handleImport)
+	mux.HandleFunc("/lists/", s.handleList)
+	mux.HandleFunc("/openapi.json", s.handleOpenAPI)
+	mux.HandleFunc("/reports/tags", s.handleTagReport)
+	mux.HandleFunc("/stream", s.handleStream)
+	mux.HandleFunc("/tags", s.handleTags)
+	mux.HandleFunc("/tasks", s.handleTasks)
+	mux.HandleFunc("/tasks/", s.handleTask)
+	mux.HandleFunc("/", s.handleTasks)
+	if h, ok := s.metrics.(http.Handler); ok {
+		mux.Handle("/metrics", h)
+	}
+	return withRequestID(withTracing(s.withAccessLog(s.withMetrics(s.withTimeout(s.withCORS(checkTenant(checkUser(s.limitRate(s.invalidateCache(mux))))))))))
+}
+
+// invalidateCache empties the server's cache after serving each request, other
+// than a GET or HEAD, that may have changed tasks.
+func (s *server) invalidateCache(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		if s.cache != nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.cache.invalidate()
+		}
+	})
+}
+
+// withTimeout cancels the context of each request served by h once the
+// server's timeout has passed. Requests to /stream, which last as long as
+// the client wants, are not canceled.
+func (s *server) withTimeout(h http.Handler) http.Handler {
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkTenant rejects requests whose tenant header is not a valid datastore
+// namespace before they reach h.
+func checkTenant(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant := r.Header.Get(tenantHeader); !validNamespace.MatchString(tenant) {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("invalid %s %q", tenantHeader, tenant))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkUser rejects requests whose user header is too long to be stored
+// before they reach h.
+func checkUser(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get(userHeader); len(user) > maxIndexedLen {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("%s must not exceed %d bytes", userHeader, maxIndexedLen))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// taskCounts is the JSON response for /count.
+type taskCounts struct {
+	Total int `json:"total"`
+	Done  int `json:"done"`
+	Open  int `json:"open"`
+}
+
+// handleCount writes the number of tasks, done and open, other than those in
+// the recycle bin, as JSON.
+func (s *server) handleCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ctx := s.context(r)
+	var done, open int
+	err := s.do(ctx, "CountTasksByStatus", func() error {
+		var err error
+		done, open, err = CountTasksByStatus(ctx, s.client)
+		return err
+	})
+	if err != nil {
+		serverError(w, r, "failed to count tasks", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(taskCounts{Total: done + open, Done: done, Open: open})
+}
+
+// bulkResult is the JSON response for an operation on many tasks.
+type bulkResult struct {
+	DryRun bool    `json:"dryRun"` // If set, no tasks were changed.
+	Count  int     `json:"count"`
+	IDs    []int64 `json:"ids"` // The tasks that were, or would be, affected.
+}
+
+// handleAllDone marks every open task done in response to a POST, and
+// writes the tasks updated as a bulkResult. With dryRun=true it writes the
+// tasks that would be updated without changing them.
+func (s *server) handleAllDone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	ids, err := markAllDone(s.context(r), s.client, dryRun)
+	if err != nil {
+		serverError(w, r, fmt.Sprintf("failed to mark all tasks done after %d", len(ids)), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(bulkResult{DryRun: dryRun, Count: len(ids), IDs: ids})
+}
+
+// purgeDone permanently deletes every done task, and writes the tasks deleted
+// as a bulkResult. With dryRun=true it writes the tasks that would be deleted
+// without deleting them.
+func (s *server) purgeDone(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	ids, err := purgeDoneTasks(s.context(r), s.client, dryRun)
+	if err != nil {
+		serverError(w, r, fmt.Sprintf("failed to purge done tasks after %d", len(ids)), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(bulkResult{DryRun: dryRun, Count: len(ids), IDs: ids})
+}
+
+// adminSecretHeader is the request header carrying the secret that the admin
+// endpoints require.
+const adminSecretHeader = "X-Admin-Secret"
+
+// requireAdmin refuses requests to h with 403 Forbidden unless they send the
+// server's admin secret.
+func (s *server) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(adminSecretHeader)
+		if s.adminSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.adminSecret)) != 1 {
+			writeError(w, http.StatusForbidden, codePermissionDenied, fmt.Sprintf("%s is missing or wrong", adminSecretHeader))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleReset permanently deletes every task of the request's tenant in
+// response to a POST, and writes the tasks deleted as a bulkResult. It is
+// meant for resetting test environments.
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ids, err := deleteAllTasks(s.context(r), s.client)
+	if err != nil {
+		serverError(w, r, fmt.Sprintf("failed to delete all tasks after %d", len(ids)), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(bulkResult{Count: len(ids), IDs: ids})
+}
+
+// handleDedupe permanently deletes the open tasks of the request's tenant
+// that duplicate an older one, as DedupeTasks does, in response to a POST,
+// and writes the tasks deleted as a bulkResult.
+func (s *server) handleDedupe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ids, err := dedupeTasks(s.context(r), s.client)
+	if err != nil {
+		serverError(w, r, fmt.Sprintf("failed to delete duplicate tasks after %d", len(ids)), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(bulkResult{Count: len(ids), IDs: ids})
+}
+
+// handleRecurrences spawns the recurring tasks that are due, in response to
+// a POST such as one sent by Cloud Scheduler, and writes the IDs of the new
+// tasks as a JSON array. Each tenant's recurring tasks need their own
+// scheduled request with the tenant header set.
+func (s *server) handleRecurrences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	keys, err := SpawnDueRecurrences(s.context(r), s.client, time.Now())
+	if err != nil {
+		serverError(w, r, "failed to spawn recurring tasks", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(keyIDs(keys))
+}
+
+// handleImport creates tasks from a POST body of newline-delimited JSON, one
+// newTaskRequest per line, and writes an ImportSummary. Lines that cannot be
+// imported are listed in the summary rather than failing the request.
+func (s *server) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	summary, err := ImportTasks(s.context(r), s.client, r.Body)
+	if err != nil {
+		serverError(w, r, fmt.Sprintf("failed to import tasks after %d", summary.Imported), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(summary)
+}
+
+// handleIDs writes the IDs of the tasks, other than those in the recycle bin,
+// as a JSON array, for clients that only need to know which tasks exist.
+func (s *server) handleIDs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	ids, err := ListTaskIDs(s.context(r), s.client)
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(ids)
+}
+
+// taskChanges is the JSON response for /changes.
+type taskChanges struct {
+	Tasks   []*Task `json:"tasks"`   // The tasks created or changed.
+	Deleted []int64 `json:"deleted"` // The IDs of the tasks deleted.
+	// NextSince is the since to give in the next request, the server's time
+	// before it looked for changes.
+	NextSince time.Time `json:"next_since"`
+}
+
+// handleChanges writes the changes to the tasks after the RFC 3339 time in
+// the since parameter, as listed by ListChangesSince, as JSON taskChanges.
+func (s *server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("since must be an RFC 3339 time: %s", err))
+		return
+	}
+
+	now := time.Now()
+	tasks, deleted, err := ListChangesSince(s.context(r), s.client, since)
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+	if deleted == nil {
+		deleted = []int64{}
+	}
+	jsonEncoder(w, r).Encode(taskChanges{Tasks: tasks, Deleted: deleted, NextSince: now})
+}
+
+// feedPage is the JSON response for /feed.
+type feedPage struct {
+	Tasks []*Task `json:"tasks"`
+	// NextCursor is the cursor to give in the next request. It is kept at
+	// the end of the feed, so that later changes can be fetched with it.
+	NextCursor string `json:"nextCursor"`
+}
+
+// handleFeed writes a page of the feed of changed tasks, from FeedTasks, as a
+// JSON feedPage. The cursor parameter continues from an earlier page, and
+// limit sets the most tasks in the page, from 1 to maxPageSize.
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultPageSize
+	if limitStr := q.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("limit must be an integer from 1 to %d, got %q", maxPageSize, limitStr))
+			return
+		}
+	}
+
+	tasks, next, err := FeedTasks(s.context(r), s.client, q.Get("cursor"), limit)
+	if err == ErrInvalidCursor {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(feedPage{Tasks: tasks, NextCursor: next})
+}
+
+// defaultCompletedLimit is the number of tasks handleCompleted lists when no
+// limit is given.
+const defaultCompletedLimit = 10
+
+// handleCompleted writes the most recently completed tasks as a JSON array,
+// most recent first, as listed by ListRecentlyCompleted. The limit parameter
+// sets how many, from 1 to maxPageSize.
+func (s *server) handleCompleted(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	limit := defaultCompletedLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("limit must be an integer from 1 to %d, got %q", maxPageSize, limitStr))
+			return
+		}
+	}
+
+	tasks, err := ListRecentlyCompleted(s.context(r), s.client, limit)
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+	jsonEncoder(w, r).Encode(tasks)
+}
+
+// handleTags writes the number of tasks with each tag as a JSON object, such
+// as {"home": 2, "work": 5}.
+func (s *server) handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	counts, err := TagCounts(s.context(r), s.client)
+	if err != nil {
+		serverError(w, r, "failed to count tags", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(counts)
+}
+
+// handleTagReport writes the number of open and done tasks with each tag as
+// a JSON object, such as {"home": {"open": 2, "done": 1}}.
+func (s *server) handleTagReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	breakdown, err := TagStatusBreakdown(s.context(r), s.client)
+	if err != nil {
+		serverError(w, r, "failed to count tags", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(breakdown)
+}
+
+// handleExport writes all the tasks as a CSV file for download.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="tasks.csv"`)
+	if err := ExportTasksCSV(s.context(r), s.client, w); err != nil {
+		// Part of the file may already have been sent, so the status can no
+		// longer be changed; the client gets a truncated file.
+		logError(r, "failed to export tasks", err)
+	}
+}
+
+// healthCheckTimeout bounds how long a health check waits for the datastore.
+const healthCheckTimeout = 2 * time.Second
+
+// handleHealth reports whether the server can reach the datastore, for use as
+// a load balancer readiness check.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+	if err := Ping(ctx, s.client); err != nil {
+		logError(r, "health check failed", err)
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "datastore unavailable")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleList serves the tasks in a task list, addressed as
+// /lists/{name}/tasks and /lists/{name}/tasks/{id}, in the same way as the
+// /tasks and /tasks/{id} endpoints serve tasks outside of any list.
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/lists/")
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+		return
+	}
+	list, rest := rest[:i], rest[i:]
+	if rest != "/tasks" && !strings.HasPrefix(rest, "/tasks/") {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+		return
+	}
+
+	// Serve the rest of the path as if it were a top-level request, with the
+	// list recorded in the request's context.
+	r = r.WithContext(WithList(r.Context(), list))
+	u := *r.URL
+	u.Path = rest
+	r.URL = &u
+	if rest == "/tasks" {
+		s.handleTasks(w, r)
+	} else {
+		s.handleTask(w, r)
+	}
+}
+
+// taskPath returns the URL path of the task with the given ID in the
+// context's task list.
+func taskPath(ctx context.Context, id int64) string {
+	if list := listName(ctx); list != "" {
+		return fmt.Sprintf("/lists/%s/tasks/%d", url.PathEscape(list), id)
+	}
+	return fmt.Sprintf("/tasks/%d", id)
+}
+
+// handleTasks serves the task collection:
+//
+//	GET     lists tasks (see listTasks), or returns a single task when the
+//	        id parameter is set, or several when the ids parameter is set
+//	        (see getTasks)
+//	POST    creates a task from the request body (see createTask)
+//	DELETE  marks the task whose ID is in the request body as done; use
+//	        DELETE /tasks/{id} to remove a task permanently, or
+//	        DELETE /tasks?done=true to remove all done tasks permanently
+//	        (see purgeDone)
+func (s *server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if idStr := r.URL.Query().Get("id"); idStr != "" {
+			s.getTask(w, r, idStr)
+			return
+		}
+		if ids := r.URL.Query().Get("ids"); ids != "" {
+			s.getTasks(w, r, ids)
+			return
+		}
+
+		s.listTasks(w, r)
+	case http.MethodPost:
+		s.createTask(w, r)
+	case http.MethodDelete:
+		if done := r.URL.Query().Get("done"); done != "" {
+			if done != "true" {
+				writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("done must be true to purge done tasks, got %q", done))
+				return
+			}
+			s.purgeDone(w, r)
+			return
+		}
+
+		// Delete
+		idStr, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		id, err := parseTaskID(idStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			return
+		}
+
+		ctx := s.context(r)
+		var changed bool
+		err = s.do(ctx, "MarkDone", func() error {
+			var err error
+			changed, err = s.tasks().MarkDone(ctx, id)
+			return err
+		})
+		if err == ErrTaskNotFound {
+			writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+			return
+		}
+		if err != nil {
+			serverError(w, r, "failed to mark task done", err)
+			return
+		}
+		if changed {
+			s.notifyDone(ctx, r, id)
+		}
+		fmt.Fprintf(w, "task %d marked done\n", id)
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+}
+
+// taskPage is the JSON response for a list of tasks, or a page of them.
+type taskPage struct {
+	Tasks      []*Task `json:"tasks"`
+	NextCursor string  `json:"nextCursor"` // Empty on the last page.
+	Total      int     `json:"total"`      // The number of tasks on all pages.
+}
+
+// newTaskRequest is the JSON body accepted when creating a task.
+type newTaskRequest struct {
+	Desc       string   `json:"description"`
+	Priority   int      `json:"priority"`
+	Due        string   `json:"due"` // An RFC 3339 time, or empty for no deadline.
+	Tags       []string `json:"tags"`
+	Recurrence string   `json:"recurrence"` // Empty, or daily, weekly or monthly.
+	// Owner is taken on trust from the client; it is not checked against
+	// any authenticated identity.
+	Owner           string `json:"owner"`
+	Color           string `json:"color"` // See normalizeColor.
+	EstimateMinutes int    `json:"estimate_minutes"`
+}
+
+// fieldError describes a problem with one field of a JSON request body. Field
+// is empty when the problem is with the body as a whole.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// decodeNewTask decodes a newTaskRequest from data and returns the task it
+// describes, or the problems found with its fields.
+func decodeNewTask(data string) (*Task, []fieldError) {
+	var req newTaskRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, []fieldError{{Field: e.Field, Message: fmt.Sprintf("got a JSON %s, want %s", e.Value, e.Type)}}
+		}
+		return nil, []fieldError{{Message: fmt.Sprintf("malformed JSON: %s", err)}}
+	}
+
+	task := &Task{
+		Desc:            strings.TrimSpace(req.Desc),
+		Priority:        req.Priority,
+		Tags:            req.Tags,
+		Recurrence:      req.Recurrence,
+		Owner:           strings.TrimSpace(req.Owner),
+		EstimateMinutes: req.EstimateMinutes,
+	}
+	var errs []fieldError
+	if task.Desc == "" {
+		errs = append(errs, fieldError{Field: "description", Message: "must not be empty"})
+	} else if len(task.Desc) > maxDescLen {
+		errs = append(errs, fieldError{Field: "description", Message: fmt.Sprintf("must not exceed %d bytes", maxDescLen)})
+	}
+	if task.Priority < PriorityNone || task.Priority > PriorityHigh {
+		errs = append(errs, fieldError{Field: "priority", Message: "must be between 0 (none) and 3 (high)"})
+	}
+	if _, ok := recurrenceIntervals[task.Recurrence]; task.Recurrence != "" && !ok {
+		errs = append(errs, fieldError{Field: "recurrence", Message: "must be daily, weekly or monthly"})
+	}
+	var err error
+	if task.Tags, err = normalizeTags(req.Tags); err != nil {
+		errs = append(errs, fieldError{Field: "tags", Message: tagsMessage(err)})
+	}
+	if task.Color, err = normalizeColor(req.Color); err != nil {
+		errs = append(errs, fieldError{Field: "color", Message: colorMessage})
+	}
+	if task.EstimateMinutes < 0 {
+		errs = append(errs, fieldError{Field: "estimate_minutes", Message: "must not be negative"})
+	}
+	if req.Due != "" {
+		due, err := time.Parse(time.RFC3339, req.Due)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "due", Message: fmt.Sprintf("must be an RFC 3339 time: %s", err)})
+		}
+		task.Due = due
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return task, nil
+}
+
+// tagsMessage returns the message of a fieldError for tags that
+// normalizeTags rejected with err.
+func tagsMessage(err error) string {
+	if err == ErrTooManyTaskTags {
+		return fmt.Sprintf("must not number more than %d", maxTaskTags)
+	}
+	return fmt.Sprintf("must each not exceed %d bytes", maxTagLen)
+}
+
+// colorMessage is the message of a fieldError for a color that
+// normalizeColor rejected.
+var colorMessage = fmt.Sprintf("must be one of %s, or a hex color such as #1e90ff", strings.Join(taskColors, ", "))
+
+// badFields reports the problems with a JSON request body to the client with
+// a 400 status, listing them in the error's fields.
+func badFields(w http.ResponseWriter, errs []fieldError) {
+	writeErrorDetail(w, http.StatusBadRequest, errorDetail{
+		Code:    codeInvalidArgument,
+		Message: "invalid request body",
+		Fields:  errs,
+	})
+}
+
+// idempotencyHeader is the request header with which clients can make task
+// creation safe to retry. A POST with the same key as an earlier one returns
+// the task created by the earlier request instead of creating another.
+const idempotencyHeader = "Idempotency-Key"
+
+// createTask creates a task from the request body. A JSON body is decoded as
+// a newTaskRequest, such as
+//
+//	{"description": "...", "priority": 2, "due": "2024-01-01T00:00:00Z", "tags": ["work"], "owner": "sam", "color": "blue"}
+//
+// Problems with its fields are reported with a 400 status and a JSON list of
+// fieldErrors. A JSON array of descriptions creates several tasks at once
+// (see createTasks). Any other body, such as one sent as text/plain, is the
+// task's description, with its priority (0-3) given by the priority
+// parameter. Bodies of other types than JSON and plain text are refused
+// with 415 Unsupported Media Type (see bodyIsJSON).
+//
+// The response is 201 Created, with the new task's URL in the Location
+// header and the task as JSON in the body, or 200 OK with the existing task
+// if the request's Idempotency-Key was already used. Clients that accept
+// text/plain get a one-line message instead.
+func (s *server) createTask(w http.ResponseWriter, r *http.Request) {
+	isJSON, ok := bodyIsJSON(w, r)
+	if !ok {
+		return
+	}
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if isJSON && strings.HasPrefix(strings.TrimSpace(data), "[") {
+		s.createTasks(w, r, data)
+		return
+	}
+
+	task := &Task{Desc: data}
+	if isJSON {
+		var errs []fieldError
+		if task, errs = decodeNewTask(data); errs != nil {
+			badFields(w, errs)
+			return
+		}
+	} else if p := r.URL.Query().Get("priority"); p != "" {
+		var err error
+		if task.Priority, err = strconv.Atoi(p); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse priority (must be an int): %s", err))
+			return
+		}
+	}
+
+	if !s.checkQuota(w, r, 1) {
+		return
+	}
+
+	// Without an idempotency key, a client that retries the request can add
+	// a duplicate task if an earlier attempt was stored but its response was
+	// lost. The server's own retries cannot: the first attempt sets the
+	// task's ID, so a retry finds the task stored by an earlier attempt.
+	ctx := s.context(r)
+	idempotencyKey := r.Header.Get(idempotencyHeader)
+	created := true
+	err := s.do(ctx, "AddTask", func() error {
+		if idempotencyKey != "" {
+			var err error
+			_, created, err = CreateTaskOnce(ctx, s.client, idempotencyKey, task)
+			return err
+		}
+		return s.tasks().Add(ctx, task)
+	})
+	if err == ErrEmptyDescription || err == ErrDescriptionTooLong || err == ErrInvalidPriority || err == ErrInvalidRecurrence || err == ErrTagTooLong || err == ErrTooManyTaskTags || err == ErrInvalidColor || err == ErrInvalidEstimate {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to create task", err)
+		return
+	}
+
+	w.Header().Set("Location", taskPath(ctx, task.Id))
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		// The response given before tasks were returned as JSON.
+		w.WriteHeader(status)
+		if created {
+			fmt.Fprintf(w, "created new task with ID %d\n", task.Id)
+		} else {
+			fmt.Fprintf(w, "task %d already exists\n", task.Id)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	jsonEncoder(w, r).Encode(task)
+}
+
+// createTasks creates a task for each description in a JSON array, such as
+// ["buy milk", "walk the dog"], and writes the new tasks' IDs, in the same
+// order, as a JSON array.
+func (s *server) createTasks(w http.ResponseWriter, r *http.Request, data string) {
+	var descs []string
+	if err := json.Unmarshal([]byte(data), &descs); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse JSON body: %s", err))
+		return
+	}
+	if !s.checkQuota(w, r, len(descs)) {
+		return
+	}
+
+	keys, err := AddTasks(s.context(r), s.client, descs)
+	if err == ErrEmptyDescription || err == ErrDescriptionTooLong {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to create tasks", err)
+		return
+	}
+
+	ids := keyIDs(keys)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	jsonEncoder(w, r).Encode(ids)
+}
+
+// listTasks writes the tasks selected by the request's query parameters as a
+// JSON taskPage, or as a bare JSON array with envelope=false. By default all
+// tasks except those in the recycle bin are listed in order of creation.
+// Otherwise:
+//
+//	includeDeleted=true
+//	               lists all tasks, including those in the recycle bin; it
+//	               cannot be combined with the filters below
+//	cursor, limit  return one page of up to limit tasks, at most
+//	               maxPageSize, in a taskPage; they cannot be combined with
+//	               includeDeleted or the filters below
+//	done           lists only done (true) or open (false) tasks
+//	overdue=true   lists open tasks past their due date
+//	due=today      lists the tasks due today in the time zone given by tz,
+//	               such as America/New_York, which defaults to UTC
+//	tag            lists the tasks with the given tag
+//	tags           lists the tasks with all of the comma-separated tags, of
+//	               which there may be at most maxTagFilters
+//	search         lists the open and done tasks whose descriptions contain
+//	               each of the words given, as whole words (see SearchTasks)
+//	owner          lists the tasks assigned to the given owner
+//	maxEstimate    lists the open tasks estimated to take at most the given
+//	               number of minutes, quickest first
+//	from, to       list the tasks created in the range [from, to), given as
+//	               RFC 3339 times; from defaults to the Unix epoch and to
+//	               to now
+//	sort, dir      list all tasks sorted by created, description, position
+//	               or priority, in asc or desc order (see parseSort)
+//
+// The filters, done to dir, leave out the tasks in the recycle bin. With
+// preview=true, in any combination, each description is shortened to at
+// most previewLength characters.
+//
+// Clients that accept text/csv get all the tasks as CSV, as from
+// /export.csv. Clients that accept text/markdown get the tasks that would be
+// listed as a Markdown checklist written by WriteChecklist.
+func (s *server) listTasks(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/csv") {
+		s.handleExport(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("cursor") != "" || q.Get("limit") != "" {
+		// Only the default listing is paged, so refuse to quietly ignore a
+		// filter.
+		f := listFilter(q)
+		if f == "" && q.Get("includeDeleted") == "true" {
+			f = "includeDeleted"
+		}
+		if f != "" {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("limit and cursor cannot be combined with %s", f))
+			return
+		}
+		s.listTasksPage(w, r)
+		return
+	}
+
+	// Choose the query to run from the parameters.
+	ctx := s.context(r)
+	list := func() ([]*Task, error) { return s.tasks().List(ctx) }
+	if s.cache != nil {
+		key := namespace(ctx) + "/" + listName(ctx)
+		list = func() ([]*Task, error) {
+			return s.cache.get(key, func() ([]*Task, error) { return s.tasks().List(ctx) })
+		}
+	}
+	if q.Get("includeDeleted") == "true" {
+		if f := listFilter(q); f != "" {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("includeDeleted cannot be combined with %s", f))
+			return
+		}
+		list = func() ([]*Task, error) { return ListAllTasks(ctx, s.client) }
+	} else if doneStr := q.Get("done"); doneStr != "" {
+		done, err := strconv.ParseBool(doneStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse done (must be a bool): %s", err))
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksByStatus(ctx, s.client, done) }
+	} else if tag := strings.ToLower(strings.TrimSpace(q.Get("tag"))); tag != "" {
+		// Tags are stored in lower case by normalizeTags.
+		list = func() ([]*Task, error) { return ListTasksByTag(ctx, s.client, tag) }
+	} else if tagsStr := q.Get("tags"); tagsStr != "" {
+		tags := splitTags(tagsStr)
+		if len(tags) == 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("tags %q names no tags", tagsStr))
+			return
+		}
+		if len(tags) > maxTagFilters {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("got %d tags, but %s", len(tags), ErrTooManyTags))
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksByAllTags(ctx, s.client, tags) }
+	} else if search, ok := q["search"]; ok {
+		if n := len(keywords(search[0])); n == 0 || n > maxTagFilters {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("search must contain from 1 to %d words, got %q", maxTagFilters, search[0]))
+			return
+		}
+		list = func() ([]*Task, error) { return SearchTasks(ctx, s.client, search[0]) }
+	} else if owner := q.Get("owner"); owner != "" {
+		list = func() ([]*Task, error) { return ListTasksByOwner(ctx, s.client, owner) }
+	} else if maxStr := q.Get("maxEstimate"); maxStr != "" {
+		maxMinutes, err := strconv.Atoi(maxStr)
+		if err != nil || maxMinutes < 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("maxEstimate must be a non-negative number of minutes, got %q", maxStr))
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksUnderEstimate(ctx, s.client, maxMinutes) }
+	} else if q.Get("from") != "" || q.Get("to") != "" {
+		from, to, ok := parseRange(w, q.Get("from"), q.Get("to"))
+		if !ok {
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksBetween(ctx, s.client, from, to) }
+	} else if q.Get("overdue") == "true" {
+		list = func() ([]*Task, error) { return ListOverdueTasks(ctx, s.client, time.Now()) }
+	} else if due := q.Get("due"); due != "" {
+		if due != "today" {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("unknown due %q (must be today)", due))
+			return
+		}
+		loc, err := time.LoadLocation(q.Get("tz"))
+		if err != nil || q.Get("tz") == "Local" {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("unknown time zone %q", q.Get("tz")))
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksDueToday(ctx, s.client, loc, time.Now()) }
+	} else if q.Get("sort") != "" || q.Get("dir") != "" {
+		property, desc, ok := parseSort(w, q.Get("sort"), q.Get("dir"))
+		if !ok {
+			return
+		}
+		list = func() ([]*Task, error) { return ListTasksOrdered(ctx, s.client, property, desc) }
+	}
+
+	var tasks []*Task
+	err := s.do(ctx, "ListTasks", func() error {
+		var err error
+		tasks, err = list()
+		return err
+	})
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	if q.Get("preview") == "true" {
+		tasks = previewTasks(tasks)
+	}
+	if strings.HasPrefix(r.Header.Get("Accept"), "text/markdown") {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		WriteChecklist(w, tasks)
+		return
+	}
+	if q.Get("envelope") == "false" {
+		jsonEncoder(w, r).Encode(tasks)
+		return
+	}
+	if tasks == nil {
+		tasks = []*Task{}
+	}
+	// Every matching task is listed, so there is only one page.
+	jsonEncoder(w, r).Encode(taskPage{Tasks: tasks, Total: len(tasks)})
+}
+
+// splitTags splits a comma-separated list of tags, in lower case as they are
+// stored, leaving out empty and repeated tags.
+func splitTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// previewLength is the most characters of a description shown by previews.
+const previewLength = 80
+
+// previewTasks returns copies of tasks with their descriptions truncated to
+// previewLength characters. The tasks themselves, which may be shared with
+// the cache, are not modified.
+func previewTasks(tasks []*Task) []*Task {
+	previews := make([]*Task, len(tasks))
+	for i, task := range tasks {
+		p := *task
+		p.Desc = truncate(p.Desc, previewLength)
+		previews[i] = &p
+	}
+	return previews
+}
+
+// truncate shortens s to at most n characters, the last of which is an
+// ellipsis if any were removed. It counts and cuts runes, not bytes, so it
+// never splits a UTF-8 encoded character.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	kept := 0
+	for i := range s {
+		if kept == n-1 {
+			return s[:i] + "…"
+		}
+		kept++
+	}
+	return s
+}
+
+// sortFields maps each sort parameter value accepted by listTasks to whether
+// it sorts in descending order by default. Each value other than description
+// is also the name of the datastore property to sort by; descriptions are
+// sorted by their indexed prefix (see sortProperty).
+var sortFields = map[string]bool{
+	"created":     false,
+	"description": false,
+	"position":    false,
+	"priority":    true, // Most important first.
+}
+
+// sortMessage lists the sortFields for the error for an unknown sort field.
+var sortMessage = func() string {
+	var fields []string
+	for field := range sortFields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	last := len(fields) - 1
+	return fmt.Sprintf("must be %s or %s", strings.Join(fields[:last], ", "), fields[last])
+}()
+
+// sortProperty returns the datastore property to sort by for one of
+// sortFields.
+func sortProperty(field string) string {
+	if field == "description" {
+		return "desc_prefix"
+	}
+	return field
+}
+
+// parseSort validates the sort and dir parameters, returning the property to
+// sort by and whether to sort in descending order. The default is to sort by
+// created; dir defaults to the field's natural order. If either parameter is
+// invalid it reports the error to the client and returns false.
+func parseSort(w http.ResponseWriter, sort, dir string) (string, bool, bool) {
+	if sort == "" {
+		sort = "created"
+	}
+	desc, ok := sortFields[sort]
+	if !ok {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("unknown sort field %q (%s)", sort, sortMessage))
+		return "", false, false
+	}
+
+	switch dir {
+	case "":
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	default:
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("unknown sort direction %q (must be asc or desc)", dir))
+		return "", false, false
+	}
+	return sortProperty(sort), desc, true
+}
+
+// parseRange parses the from and to parameters as RFC 3339 times, using the
+// Unix epoch and now for parameters that are empty. If either is invalid, or
+// from is after to, it reports the error to the client and returns false.
+func parseRange(w http.ResponseWriter, fromStr, toStr string) (time.Time, time.Time, bool) {
+	from, to := time.Unix(0, 0), time.Now()
+	var err error
+	if fromStr != "" {
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse from (must be an RFC 3339 time): %s", err))
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	if toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse to (must be an RFC 3339 time): %s", err))
+			return time.Time{}, time.Time{}, false
+		}
+	}
+	if from.After(to) {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("from (%s) must not be after to (%s)", from.Format(time.RFC3339), to.Format(time.RFC3339)))
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// listFilters are the query parameters that choose one of the filtered or
+// sorted listings in listTasks.
+var listFilters = []string{"done", "overdue", "due", "tag", "tags", "search", "owner", "maxEstimate", "from", "to", "sort", "dir"}
+
+// listFilter returns the first of listFilters that is set in q, or "" if
+// none is.
+func listFilter(q url.Values) string {
+	for _, name := range listFilters {
+		if _, ok := q[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// listTasksPage writes one page of tasks, the cursor for the next page, and
+// the number of tasks on all pages as a JSON taskPage.
+func (s *server) listTasksPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultPageSize
+	if limitStr := q.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("limit must be an integer from 1 to %d, got %q", maxPageSize, limitStr))
+			return
+		}
+	}
+
+	ctx := s.context(r)
+	tasks, next, err := ListTasksPage(ctx, s.client, q.Get("cursor"), limit)
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	total, err := CountListedTasks(ctx, s.client)
+	if err != nil {
+		serverError(w, r, "failed to count tasks", err)
+		return
+	}
+	if q.Get("preview") == "true" {
+		tasks = previewTasks(tasks)
+	}
+	jsonEncoder(w, r).Encode(taskPage{Tasks: tasks, NextCursor: next, Total: total})
+}
+
+// handleTask serves a single task addressed as /tasks/{id}:
+//
+//	GET    returns the task as JSON, with its version as the ETag, or
+//	       304 Not Modified if the ETag matches If-None-Match
+//	PUT    replaces the task's description with the body, given either as
+//	       plain text or as JSON like {"description": "..."}
+//	PATCH  updates only the description, done status, due date, tags,
+//	       position, color or estimate_minutes given in a JSON body like
+//	       {"done": false}, and returns the task
+//	DELETE moves the task to the recycle bin, or deletes it permanently if
+//	       the permanent parameter is true
+//
+// POST /tasks/done marks the tasks with the IDs in a JSON array done,
+// POST /tasks/{id}/restore takes the task out of the recycle bin,
+// POST /tasks/{id}/duplicate adds a copy of the task,
+// POST /tasks/{id}/snooze hides it until a time or for a duration, and
+// GET /tasks/{id}/history returns the task's history.
+func (s *server) handleTask(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	if idStr == "" {
+		s.handleTasks(w, r)
+		return
+	}
+	if idStr == "done" {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		s.markDoneMulti(w, r)
+		return
+	}
+	if strings.HasSuffix(idStr, "/restore") {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		s.restoreTask(w, r, strings.TrimSuffix(idStr, "/restore"))
+		return
+	}
+	if strings.HasSuffix(idStr, "/duplicate") {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		s.duplicateTask(w, r, strings.TrimSuffix(idStr, "/duplicate"))
+		return
+	}
+	if strings.HasSuffix(idStr, "/snooze") {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		s.snoozeTask(w, r, strings.TrimSuffix(idStr, "/snooze"))
+		return
+	}
+	if strings.HasSuffix(idStr, "/history") {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		s.getTaskHistory(w, r, strings.TrimSuffix(idStr, "/history"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.getTask(w, r, idStr)
+	case http.MethodPut:
+		s.putTask(w, r, idStr)
+	case http.MethodPatch:
+		s.patchTask(w, r, idStr)
+	case http.MethodDelete:
+		s.deleteTask(w, r, idStr)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// getTask writes the task with the given ID as JSON.
+func (s *server) getTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	task, err := s.tasks().Get(s.context(r), id)
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	tag := etag(task.Version)
+	w.Header().Set("ETag", tag)
+	if etagMatches(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	jsonEncoder(w, r).Encode(task)
+}
+
+// parseTaskID parses a task ID given in a request. Datastore only assigns
+// positive IDs, and a key with the ID 0 would be incomplete, so any other
+// value is rejected.
+func parseTaskID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid task ID %q (must be a positive integer)", s)
+	}
+	return id, nil
+}
+
+// etag returns the ETag header value for a task with the given version.
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// parseIfMatch parses an If-Match header holding one ETag from etag, and
+// returns the version it names. It returns nil if the header is empty or
+// "*", which match any version.
+func parseIfMatch(header string) (*int, error) {
+	if header == "" || header == "*" {
+		return nil, nil
+	}
+	if len(header) >= 2 && header[0] == '"' && header[len(header)-1] == '"' {
+		if version, err := strconv.Atoi(header[1 : len(header)-1]); err == nil {
+			return &version, nil
+		}
+	}
+	return nil, fmt.Errorf(`invalid If-Match %s (must be an ETag such as "3")`, header)
+}
+
+// etagMatches reports whether an If-None-Match header, holding "*" or a
+// comma-separated list of ETags, matches tag. As If-None-Match uses the weak
+// comparison, a W/ prefix is ignored.
+func etagMatches(header, tag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// markDoneMulti marks the tasks with the IDs in the request's JSON array done,
+// and writes a DoneResult for each ID as a JSON array. At most maxGetTasks IDs
+// may be given.
+func (s *server) markDoneMulti(w http.ResponseWriter, r *http.Request) {
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var ids []int64
+	if err := json.Unmarshal([]byte(data), &ids); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse JSON body: %s", err))
+		return
+	}
+	if len(ids) == 0 || len(ids) > maxGetTasks {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("between 1 and %d IDs must be given", maxGetTasks))
+		return
+	}
+	for _, id := range ids {
+		if id <= 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("invalid task ID %d (must be a positive integer)", id))
+			return
+		}
+	}
+
+	results, err := MarkDoneMulti(s.context(r), s.client, ids)
+	if err != nil {
+		serverError(w, r, "failed to mark tasks done", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonEncoder(w, r).Encode(results)
+}
+
+// maxGetTasks is the most tasks that can be fetched at once by getTasks, which
+// is the most keys datastore looks up in a single call.
+const maxGetTasks = 1000
+
+// getTasks writes the tasks with the comma-separated IDs in idsStr as a JSON
+// array, with null in place of any task that does not exist.
+func (s *server) getTasks(w http.ResponseWriter, r *http.Request, idsStr string) {
+	fields := strings.Split(idsStr, ",")
+	if len(fields) > maxGetTasks {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("at most %d IDs can be fetched at once", maxGetTasks))
+		return
+	}
+	ids := make([]int64, len(fields))
+	for i, field := range fields {
+		var err error
+		if ids[i], err = parseTaskID(strings.TrimSpace(field)); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			return
+		}
+	}
+
+	tasks, err := GetTasks(s.context(r), s.client, ids)
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(tasks)
+}
+
+// putTask replaces the description of the task with the given ID and writes
+// the updated task as JSON.
+func (s *server) putTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	isJSON, ok := bodyIsJSON(w, r)
+	if !ok {
+		return
+	}
+	desc, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	if isJSON {
+		var body struct {
+			Desc string `json:"description"`
+		}
+		if err := json.Unmarshal([]byte(desc), &body); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse JSON body: %s", err))
+			return
+		}
+		desc = body.Desc
+	}
+
+	err = UpdateTaskDescription(s.context(r), s.client, id, desc)
+	if err == ErrEmptyDescription || err == ErrDescriptionTooLong {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to update task", err)
+		return
+	}
+
+	s.getTask(w, r, idStr)
+}
+
+// patchTaskRequest is the JSON body of a PATCH request. Fields that are left
+// out, or null, are not changed.
+type patchTaskRequest struct {
+	Desc            *string   `json:"description"`
+	Done            *bool     `json:"done"`
+	Due             *string   `json:"due"` // An RFC 3339 time, or empty to remove the deadline.
+	Tags            *[]string `json:"tags"`
+	Position        *float64  `json:"position"`
+	Color           *string   `json:"color"`            // Empty to remove the color.
+	EstimateMinutes *int      `json:"estimate_minutes"` // 0 to remove the estimate.
+}
+
+// decodeTaskPatch decodes a patchTaskRequest from data and returns the patch
+// it describes, or the problems found with its fields.
+func decodeTaskPatch(data string) (TaskPatch, []fieldError) {
+	var req patchTaskRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok {
+			return TaskPatch{}, []fieldError{{Field: e.Field, Message: fmt.Sprintf("got a JSON %s, want %s", e.Value, e.Type)}}
+		}
+		return TaskPatch{}, []fieldError{{Message: fmt.Sprintf("malformed JSON: %s", err)}}
+	}
+
+	patch := TaskPatch{Desc: req.Desc, Done: req.Done, Position: req.Position, EstimateMinutes: req.EstimateMinutes}
+	var errs []fieldError
+	if req.Desc != nil {
+		if desc := strings.TrimSpace(*req.Desc); desc == "" {
+			errs = append(errs, fieldError{Field: "description", Message: "must not be empty"})
+		} else if len(desc) > maxDescLen {
+			errs = append(errs, fieldError{Field: "description", Message: fmt.Sprintf("must not exceed %d bytes", maxDescLen)})
+		}
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "tags", Message: tagsMessage(err)})
+		}
+		patch.Tags = &tags
+	}
+	if req.Color != nil {
+		color, err := normalizeColor(*req.Color)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "color", Message: colorMessage})
+		}
+		patch.Color = &color
+	}
+	if req.EstimateMinutes != nil && *req.EstimateMinutes < 0 {
+		errs = append(errs, fieldError{Field: "estimate_minutes", Message: "must not be negative"})
+	}
+	if req.Due != nil {
+		var due time.Time
+		if *req.Due != "" {
+			var err error
+			if due, err = time.Parse(time.RFC3339, *req.Due); err != nil {
+				errs = append(errs, fieldError{Field: "due", Message: fmt.Sprintf("must be an RFC 3339 time: %s", err)})
+			}
+		}
+		patch.Due = &due
+	}
+	if errs != nil {
+		return TaskPatch{}, errs
+	}
+	return patch, nil
+}
+
+// patchTask applies a partial update, such as {"due": "2019-06-01T00:00:00Z"},
+// to the task with the given ID and writes the updated task as JSON. If the
+// request has an If-Match header with the task's ETag from an earlier
+// response, the task is only updated if it has not been changed since.
+func (s *server) patchTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	patch, errs := decodeTaskPatch(data)
+	if errs != nil {
+		badFields(w, errs)
+		return
+	}
+	if patch.Version, err = parseIfMatch(r.Header.Get("If-Match")); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	ctx := s.context(r)
+	var (
+		task      *Task
+		completed bool
+	)
+	err = s.do(ctx, "UpdateTask", func() error {
+		var err error
+		task, completed, err = updateTask(ctx, s.client, id, patch)
+		return err
+	})
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err == ErrVersionConflict {
+		writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("task %d has been changed since version %d", id, *patch.Version))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to update task", err)
+		return
+	}
+	// Only notify if this request marked the task done, not if it already was.
+	if completed {
+		s.webhook.taskDone(task)
+	}
+	w.Header().Set("ETag", etag(task.Version))
+	jsonEncoder(w, r).Encode(task)
+}
+
+// deleteTask soft-deletes the task with the given ID, or permanently deletes
+// it if the permanent parameter is true.
+func (s *server) deleteTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	ctx := s.context(r)
+	if r.URL.Query().Get("permanent") == "true" {
+		err = s.do(ctx, "DeleteTask", func() error {
+			return deleteTask(ctx, s.client, id)
+		})
+		if err == ErrTaskNotFound {
+			writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+			return
+		}
+		if err != nil {
+			serverError(w, r, "failed to delete task", err)
+			return
+		}
+		fmt.Fprintf(w, "task %d deleted\n", id)
+		return
+	}
+
+	err = s.do(ctx, "SoftDeleteTask", func() error {
+		return s.tasks().Delete(ctx, id)
+	})
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to delete task", err)
+		return
+	}
+	fmt.Fprintf(w, "task %d moved to the recycle bin\n", id)
+}
+
+// getTaskHistory writes the history of the task with the given ID as a JSON
+// array of TaskEvents, oldest first.
+func (s *server) getTaskHistory(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	events, err := GetTaskHistory(s.context(r), s.client, id)
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to read task history", err)
+		return
+	}
+	jsonEncoder(w, r).Encode(events)
+}
+
+// restoreTask takes the task with the given ID out of the recycle bin.
+func (s *server) restoreTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	err = RestoreTask(s.context(r), s.client, id)
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to restore task", err)
+		return
+	}
+	fmt.Fprintf(w, "task %d restored\n", id)
+}
+
+// snoozeRequest is the JSON body of a request to snooze a task, which sets
+// one of its fields.
+type snoozeRequest struct {
+	Until string `json:"until"` // An RFC 3339 time; one in the past wakes the task.
+	For   string `json:"for"`   // A duration from now, such as "2h" or "PT2H".
+}
+
+// snoozeTask hides the task with the given ID from the default listing until
+// the time given by the snoozeRequest in the request body, and writes the
+// updated task as JSON. A relative duration is parsed by parseSnoozeDuration
+// and limited as by SnoozeTaskFor.
+func (s *server) snoozeTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var req snoozeRequest
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("failed to parse JSON body: %s", err))
+		return
+	}
+	if (req.Until == "") == (req.For == "") {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, "exactly one of until and for must be set")
+		return
+	}
+
+	ctx := s.context(r)
+	if req.For != "" {
+		var d time.Duration
+		if d, err = parseSnoozeDuration(req.For); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+			return
+		}
+		_, err = SnoozeTaskFor(ctx, s.client, id, d)
+	} else {
+		var until time.Time
+		if until, err = time.Parse(time.RFC3339, req.Until); err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidArgument, fmt.Sprintf("until must be an RFC 3339 time: %s", err))
+			return
+		}
+		err = SnoozeTask(ctx, s.client, id, until)
+	}
+	if err == ErrInvalidSnooze {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to snooze task", err)
+		return
+	}
+
+	s.getTask(w, r, idStr)
+}
+
+// isoDuration matches the ISO 8601 durations accepted by parseSnoozeDuration,
+// in weeks, days, hours, minutes and seconds. Years and months are left out,
+// since their length varies.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseSnoozeDuration parses a Go duration, such as "2h30m", or an ISO 8601
+// duration, such as "PT2H30M" or "P1W".
+func parseSnoozeDuration(s string) (time.Duration, error) {
+	iso := strings.ToUpper(s)
+	m := isoDuration.FindStringSubmatch(iso)
+	// The pattern also matches "P" and durations ending in "T", which have no
+	// components after it.
+	if m == nil || iso == "P" || strings.HasSuffix(iso, "T") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("for must be a duration such as 2h or PT2H, got %q", s)
+		}
+		return d, nil
+	}
+	var seconds float64
+	for i, unit := range []float64{7 * 24 * 3600, 24 * 3600, 3600, 60, 1} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("for must be a duration such as 2h or PT2H, got %q", s)
+		}
+		seconds += n * unit
+	}
+	if seconds > maxSnoozeDays*24*3600 {
+		// Longer than SnoozeTaskFor allows, and perhaps than a Duration holds.
+		return 0, ErrInvalidSnooze
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// duplicateTask adds a copy of the task with the given ID, as DuplicateTask
+// does, and writes the new task as JSON.
+func (s *server) duplicateTask(w http.ResponseWriter, r *http.Request, idStr string) {
+	id, err := parseTaskID(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidArgument, err.Error())
+		return
+	}
+
+	ctx := s.context(r)
+	source, err := s.tasks().Get(ctx, id)
+	if err == ErrTaskNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("task %d not found", id))
+		return
+	}
+	if err != nil {
+		serverError(w, r, "failed to read from datastore", err)
+		return
+	}
+	if !s.checkQuota(w, r, 1) {
+		return
+	}
+	// As in createTask, a retry finds the copy stored by an earlier attempt.
+	task := duplicateOf(source)
+	if err := s.do(ctx, "DuplicateTask", func() error { return s.tasks().Add(ctx, task) }); err != nil {
+		serverError(w, r, "failed to duplicate task", err)
+		return
+	}
+
+	w.Header().Set("Location", taskPath(ctx, task.Id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	jsonEncoder(w, r).Encode(task)
+}
+
+// bodyIsJSON reports whether the request body is JSON, as opposed to plain
+// text, going by its Content-Type. A body without a Content-Type is taken to
+// be plain text, as clients sent before the type was checked. If the body has
+// any other type, it reports the error to the client with 415 Unsupported
+// Media Type and ok is false.
+func bodyIsJSON(w http.ResponseWriter, r *http.Request) (isJSON, ok bool) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return false, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	switch {
+	case err != nil:
+	case mediaType == "application/json":
+		return true, true
+	case mediaType == "text/plain":
+		return false, true
+	}
+	writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type %q (must be application/json or text/plain)", contentType))
+	return false, false
+}
+
+// readBody reads the request body with readMsg. If that fails, it reports
+// the error to the client and returns false.
+func readBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	msg, err := readMsg(r.Body)
+	if err == errMsgTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("request body must not exceed %d bytes", maxMsgSize))
+		return "", false
+	}
+	if err != nil {
+		serverError(w, r, "failed to read message", err)
+		return "", false
+	}
+	return msg, true
+}
+
+// jsonEncoder returns an encoder for writing a JSON response to w. The
+// response is compact unless the request has pretty=true, which indents it
+// for reading, as when trying out the API with curl.
+func jsonEncoder(w http.ResponseWriter, r *http.Request) *json.Encoder {
+	enc := json.NewEncoder(w)
+	if r.URL.Query().Get("pretty") == "true" {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+// Error codes used in error responses.
+const (
+	codeInvalidArgument      = "invalid_argument"
+	codeNotFound             = "not_found"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeConflict             = "conflict"
+	codePermissionDenied     = "permission_denied"
+	codeTooLarge             = "too_large"
+	codeQuotaExceeded        = "quota_exceeded"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeRateLimited          = "rate_limited"
+	codeUnavailable          = "unavailable"
+	codeInternal             = "internal"
+)
+
+// errorResponse is the JSON body of every error response, such as
+//
+//	{"error": {"code": "not_found", "message": "task 5 not found"}}
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+// errorDetail describes an error. Fields lists the problems with individual
+// fields of a JSON request body, if any.
+type errorDetail struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// writeError reports an error to the client as an errorResponse with the
+// given status.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeErrorDetail(w, status, errorDetail{Code: code, Message: msg})
+}
+
+func writeErrorDetail(w http.ResponseWriter, status int, detail errorDetail) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: detail})
+}
+
+// methodNotAllowed reports that the endpoint does not support the request's
+// method.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method))
+}
+
+// serverError logs err and reports msg to the client with a 500 status. The
+// error itself is only logged, since datastore errors can reveal details of
+// the service that clients should not see. If err is because datastore is
+// overloaded, see isOverloaded, the client is instead told to retry with a
+// 503 status.
+func serverError(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if isOverloaded(err) {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, codeUnavailable, "too many requests in progress; retry later")
+		return
+	}
+	logError(r, msg, err)
+	writeError(w, http.StatusInternalServerError, codeInternal, msg)
+}
@@ -0,0 +1,1564 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/datastore"
+)
+
+// postTask serves a request to create a task and returns the new task's ID.
+func postTask(t *testing.T, s *server, req *http.Request) int64 {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST got status %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	var task Task
+	if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil {
+		t.Fatalf("could not decode task from %q: %v", rr.Body, err)
+	}
+	return task.Id
+}
+
+func TestCreate(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("201 me")))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST got status %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	var task Task
+	if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil {
+		t.Fatalf("could not decode task from %q: %v", rr.Body, err)
+	}
+	defer DeleteTask(ctx, client, task.Id)
+
+	if task.Id == 0 || task.Desc != "201 me" {
+		t.Errorf("POST returned task %+v, want an ID and description %q", task, "201 me")
+	}
+	if got, want := rr.Header().Get("Location"), fmt.Sprintf("/tasks/%d", task.Id); got != want {
+		t.Errorf("POST got Location %q, want %q", got, want)
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader("plain text"))
+	req.Header.Set("Accept", "text/plain")
+	rr = httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	var id int64
+	if _, err := fmt.Sscanf(rr.Body.String(), "created new task with ID %d", &id); err != nil {
+		t.Fatalf("could not parse ID from %q: %v", rr.Body, err)
+	}
+	defer DeleteTask(ctx, client, id)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("POST with Accept: text/plain got status %d, want %d", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestCreateLongDescription(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	desc := strings.Repeat("d", 300)
+	req := httptest.NewRequest("POST", "/", strings.NewReader(desc))
+	id := postTask(t, s, req)
+	defer DeleteTask(ctx, client, id)
+
+	task, err := GetTask(ctx, client, id)
+	if err != nil {
+		t.Fatalf("GetTask(%d): %v", id, err)
+	}
+	if task.Desc != desc {
+		t.Errorf("stored description has %d bytes, want %d", len(task.Desc), len(desc))
+	}
+}
+
+func TestCreateTooLarge(t *testing.T) {
+	s := &server{}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("d", int(maxMsgSize)+1)))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST got status %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestHardDelete(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	key, err := AddTask(ctx, client, "delete me")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/tasks/%d?permanent=true", key.ID), nil)
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("DELETE got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+
+	tasks, err := ListAllTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListAllTasks: %v", err)
+	}
+	for _, task := range tasks {
+		if task.Id == key.ID {
+			t.Errorf("ListAllTasks still contains deleted task %d", key.ID)
+		}
+	}
+
+	// Deleting it again finds no task.
+	rr = httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("DELETE", fmt.Sprintf("/tasks/%d?permanent=true", key.ID), nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("second DELETE got status %d, want %d: %s", rr.Code, http.StatusNotFound, rr.Body)
+	}
+
+	// Marking the deleted task done with the legacy DELETE finds no task.
+	req = httptest.NewRequest("DELETE", "/tasks", strings.NewReader(fmt.Sprint(key.ID)))
+	rr = httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("DELETE /tasks of a deleted task got status %d, want %d: %s", rr.Code, http.StatusNotFound, rr.Body)
+	}
+}
+
+func TestMarkDoneCompletedBy(t *testing.T) {
+	s := &server{store: &MemTaskStore{}}
+	for _, user := range []string{"", " alice "} {
+		task := &Task{Desc: "sign off"}
+		if err := s.store.Add(context.Background(), task); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		req := httptest.NewRequest("DELETE", "/tasks", strings.NewReader(fmt.Sprint(task.Id)))
+		if user != "" {
+			req.Header.Set(userHeader, user)
+		}
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("DELETE /tasks with %s %q got status %d, want %d: %s", userHeader, user, rr.Code, http.StatusOK, rr.Body)
+		}
+		done, err := s.store.Get(context.Background(), task.Id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if want := strings.TrimSpace(user); done.CompletedBy != want {
+			t.Errorf("DELETE /tasks with %s %q got CompletedBy %q, want %q", userHeader, user, done.CompletedBy, want)
+		}
+	}
+
+	req := httptest.NewRequest("DELETE", "/tasks", strings.NewReader("1"))
+	req.Header.Set(userHeader, strings.Repeat("x", maxIndexedLen+1))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("DELETE /tasks with a long %s got status %d, want %d", userHeader, rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMarkDoneNotifiesOnce(t *testing.T) {
+	var notified int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&notified, 1)
+	}))
+	defer target.Close()
+
+	s := &server{store: &MemTaskStore{}, webhook: newWebhook(target.URL)}
+	task := &Task{Desc: "ship it"}
+	if err := s.store.Add(context.Background(), task); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest("DELETE", "/tasks", strings.NewReader(fmt.Sprint(task.Id))))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("legacy DELETE %d got status %d, want %d: %s", i+1, rr.Code, http.StatusOK, rr.Body)
+		}
+	}
+	s.webhook.Close()
+	if got := atomic.LoadInt32(&notified); got != 1 {
+		t.Errorf("marking a task done twice sent %d webhook notifications, want 1", got)
+	}
+}
+
+func TestMarkDoneErrors(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+
+	for _, tt := range []struct {
+		name   string
+		s      *server
+		status int
+	}{
+		{"a missing task", &server{store: &MemTaskStore{}}, http.StatusNotFound},
+		{"a datastore error", &server{client: client, timeout: 100 * time.Millisecond}, http.StatusInternalServerError},
+	} {
+		req := httptest.NewRequest("DELETE", "/tasks", strings.NewReader("99"))
+		rr := httptest.NewRecorder()
+		tt.s.routes().ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("legacy DELETE of %s got status %d, want %d", tt.name, rr.Code, tt.status)
+		}
+		if strings.Contains(rr.Body.String(), "marked done") {
+			t.Errorf("legacy DELETE of %s reported success: %s", tt.name, rr.Body)
+		}
+	}
+}
+
+func TestDuplicateTaskHandler(t *testing.T) {
+	store := &MemTaskStore{}
+	s := &server{store: store}
+	ctx := context.Background()
+	due := time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC)
+	source := &Task{Desc: "file taxes", Tags: []string{"home"}, Priority: PriorityHigh, Due: due, Owner: "ann"}
+	if err := store.Add(ctx, source); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := store.MarkDone(ctx, source.Id); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", fmt.Sprintf("/tasks/%d/duplicate", source.Id), nil))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks/%d/duplicate got status %d, want %d: %s", source.Id, rr.Code, http.StatusCreated, rr.Body)
+	}
+	var dup Task
+	if err := json.NewDecoder(rr.Body).Decode(&dup); err != nil {
+		t.Fatalf("decoding the duplicate: %v", err)
+	}
+	if dup.Id == source.Id || dup.Desc != source.Desc || fmt.Sprint(dup.Tags) != fmt.Sprint(source.Tags) || dup.Priority != source.Priority || !dup.Due.Equal(due) {
+		t.Errorf("duplicate of %+v is %+v", source, dup)
+	}
+	if dup.Done || !dup.CompletedAt.IsZero() || dup.Owner != "" || dup.Created.Before(source.Created) {
+		t.Errorf("duplicate is not a fresh task: %+v", dup)
+	}
+	if got, want := rr.Header().Get("Location"), fmt.Sprint("/tasks/", dup.Id); got != want {
+		t.Errorf("POST /tasks/%d/duplicate got Location %q, want %q", source.Id, got, want)
+	}
+
+	rr = httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/tasks/99/duplicate", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("POST /tasks/99/duplicate got status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateJSON(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	body := `{"description": "file taxes", "priority": 3, "due": "2024-04-15T00:00:00Z"}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	id := postTask(t, s, req)
+	defer DeleteTask(ctx, client, id)
+
+	task, err := GetTask(ctx, client, id)
+	if err != nil {
+		t.Fatalf("GetTask(%d): %v", id, err)
+	}
+	wantDue := time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC)
+	if task.Desc != "file taxes" || task.Priority != PriorityHigh || !task.Due.Equal(wantDue) {
+		t.Errorf("got task %+v, want description %q, priority %d, due %v", task, "file taxes", PriorityHigh, wantDue)
+	}
+}
+
+func TestHealthUnavailable(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /healthz with unreachable datastore got status %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	s := &server{client: client}
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("GET /healthz got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		sort, dir string
+		property  string
+		desc      bool
+		ok        bool
+	}{
+		{sort: "", dir: "", property: "created", ok: true},
+		{sort: "created", dir: "desc", property: "created", desc: true, ok: true},
+		{sort: "description", dir: "", property: "desc_prefix", ok: true},
+		{sort: "description", dir: "desc", property: "desc_prefix", desc: true, ok: true},
+		{sort: "priority", dir: "", property: "priority", desc: true, ok: true},
+		{sort: "priority", dir: "asc", property: "priority", ok: true},
+		{sort: "", dir: "desc", property: "created", desc: true, ok: true},
+		{sort: "done", dir: "", ok: false},
+		{sort: "created", dir: "sideways", ok: false},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		property, desc, ok := parseSort(rr, test.sort, test.dir)
+		if ok != test.ok {
+			t.Errorf("parseSort(%q, %q) ok = %v, want %v", test.sort, test.dir, ok, test.ok)
+			continue
+		}
+		if !ok {
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("parseSort(%q, %q) wrote status %d, want %d", test.sort, test.dir, rr.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		if property != test.property || desc != test.desc {
+			t.Errorf("parseSort(%q, %q) = %q, %v, want %q, %v", test.sort, test.dir, property, desc, test.property, test.desc)
+		}
+	}
+
+	// The error for an unknown field names every field that can be sorted by.
+	rr := httptest.NewRecorder()
+	parseSort(rr, "done", "")
+	for field := range sortFields {
+		if !strings.Contains(rr.Body.String(), field) {
+			t.Errorf("parseSort of an unknown field got error %s, want it to mention %s", rr.Body, field)
+		}
+	}
+}
+
+func TestCreateEmpty(t *testing.T) {
+	// Requests that reach the unreachable datastore fail with a 500 once the
+	// server's timeout expires, so a 400 shows nothing was written.
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client, timeout: 2 * time.Second}
+
+	for _, body := range []string{"", "  \n\t", `["ok", " "]`} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if strings.HasPrefix(body, "[") {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %q got status %d, want %d", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCreateTrimsDescription(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	before, err := CountTasks(ctx, client, nil)
+	if err != nil {
+		t.Fatalf("CountTasks: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/", strings.NewReader("")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("POST with empty body got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	if after, err := CountTasks(ctx, client, nil); err != nil || after != before {
+		t.Errorf("POST with empty body changed the task count from %d to %d (err %v)", before, after, err)
+	}
+
+	id := postTask(t, s, httptest.NewRequest("POST", "/", strings.NewReader("  padded \n")))
+	defer DeleteTask(ctx, client, id)
+	task, err := GetTask(ctx, client, id)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.Desc != "padded" {
+		t.Errorf("stored description %q, want %q", task.Desc, "padded")
+	}
+}
+
+func TestInvalidTenant(t *testing.T) {
+	s := &server{}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(tenantHeader, "not a namespace!")
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("GET with invalid tenant got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTaskPath(t *testing.T) {
+	ctx := context.Background()
+	if got, want := taskPath(ctx, 5), "/tasks/5"; got != want {
+		t.Errorf("taskPath without list = %q, want %q", got, want)
+	}
+	if got, want := taskPath(WithList(ctx, "to do"), 5), "/lists/to%20do/tasks/5"; got != want {
+		t.Errorf("taskPath with list = %q, want %q", got, want)
+	}
+}
+
+func TestListRoutes(t *testing.T) {
+	s := &server{}
+	for _, path := range []string{"/lists/", "/lists/groceries", "/lists/groceries/other"} {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s got status %d, want %d", path, rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestCreateIdempotent(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("idempotent-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	var ids []int64
+	for _, want := range []int{http.StatusCreated, http.StatusOK} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("only once"))
+		req.Header.Set(idempotencyHeader, "retried-request")
+		req.Header.Set(tenantHeader, namespace(ctx))
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Fatalf("POST got status %d, want %d: %s", rr.Code, want, rr.Body)
+		}
+		var task Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil {
+			t.Fatalf("could not decode task from %q: %v", rr.Body, err)
+		}
+		ids = append(ids, task.Id)
+	}
+	defer DeleteTask(ctx, client, ids[0])
+
+	if ids[0] != ids[1] {
+		t.Errorf("POSTs with the same %s returned tasks %d and %d, want the same task", idempotencyHeader, ids[0], ids[1])
+	}
+	if n, err := CountTasks(ctx, client, nil); err != nil || n != 1 {
+		t.Errorf("CountTasks = %d, %v, want 1 task", n, err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("export-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	desc := "buy milk, eggs\nand \"bread\""
+	key, err := AddTask(ctx, client, desc)
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/export.csv", nil),
+		httptest.NewRequest("GET", "/tasks", nil),
+	} {
+		req.Header.Set(tenantHeader, namespace(ctx))
+		req.Header.Set("Accept", "text/csv")
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s got status %d, want %d: %s", req.URL, rr.Code, http.StatusOK, rr.Body)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "text/csv" {
+			t.Errorf("GET %s got Content-Type %q, want text/csv", req.URL, got)
+		}
+
+		records, err := csv.NewReader(rr.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("GET %s returned invalid CSV: %v", req.URL, err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("GET %s returned %d records, want a header and one task", req.URL, len(records))
+		}
+		if got, want := strings.Join(records[0], ","), strings.Join(csvHeader, ","); got != want {
+			t.Errorf("GET %s got header %q, want %q", req.URL, got, want)
+		}
+		if id, d := records[1][0], records[1][1]; id != fmt.Sprint(key.ID) || d != desc {
+			t.Errorf("GET %s got task %q, %q, want %d, %q", req.URL, id, d, key.ID, desc)
+		}
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", int(maxMsgSize)+1)
+	limit := strings.Repeat("y", int(maxMsgSize))
+	br := bufio.NewReaderSize(strings.NewReader("one\r\n\n"+long+"\n"+limit+"\nlast"), 16)
+	for _, want := range []string{"one", "", "too large", limit, "last", "EOF"} {
+		line, err := readLine(br)
+		got := string(line)
+		if err == errMsgTooLarge {
+			got = "too large"
+		} else if err != nil {
+			got = err.Error()
+		}
+		if got != want {
+			t.Errorf("readLine got %.20q, want %.20q", got, want)
+		}
+	}
+}
+
+func TestMarkdownChecklist(t *testing.T) {
+	store := &MemTaskStore{}
+	ctx := context.Background()
+	var ids []int64
+	for _, desc := range []string{"buy milk", "fix *bold* [link](x) <b>", "line one\nline two"} {
+		task := &Task{Desc: desc}
+		if err := store.Add(ctx, task); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		ids = append(ids, task.Id)
+	}
+	if _, err := store.MarkDone(ctx, ids[1]); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	req.Header.Set("Accept", "text/markdown")
+	rr := httptest.NewRecorder()
+	(&server{store: store}).routes().ServeHTTP(rr, req)
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/markdown") {
+		t.Errorf("GET /tasks with Accept: text/markdown got Content-Type %q", got)
+	}
+	want := "- [ ] buy milk\n" +
+		`- [x] fix \*bold\* \[link\](x) \<b\>` + "\n" +
+		"- [ ] line one line two\n"
+	if rr.Body.String() != want {
+		t.Errorf("GET /tasks with Accept: text/markdown got\n%s\nwant\n%s", rr.Body, want)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+
+	for _, path := range []string{"/admin/dedupe", "/admin/reset"} {
+		post := func(s *server, secret string) int {
+			req := httptest.NewRequest("POST", path, nil)
+			if secret != "" {
+				req.Header.Set(adminSecretHeader, secret)
+			}
+			rr := httptest.NewRecorder()
+			s.routes().ServeHTTP(rr, req)
+			return rr.Code
+		}
+		s := &server{client: client, timeout: 100 * time.Millisecond, adminSecret: "s3cret"}
+		for _, secret := range []string{"", "wrong", "s3cret "} {
+			if got := post(s, secret); got != http.StatusForbidden {
+				t.Errorf("POST %s with secret %q got status %d, want %d", path, secret, got, http.StatusForbidden)
+			}
+		}
+		// With the secret, the request reaches the unreachable datastore.
+		if got := post(s, "s3cret"); got != http.StatusInternalServerError {
+			t.Errorf("POST %s with the secret got status %d, want %d", path, got, http.StatusInternalServerError)
+		}
+		// Without a secret configured, every request is refused.
+		s.adminSecret = ""
+		if got := post(s, "s3cret"); got != http.StatusForbidden {
+			t.Errorf("POST %s with no secret configured got status %d, want %d", path, got, http.StatusForbidden)
+		}
+	}
+}
+
+func TestParseSnoozeDuration(t *testing.T) {
+	for _, tt := range []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{s: "2h", want: 2 * time.Hour},
+		{s: "90m", want: 90 * time.Minute},
+		{s: "PT2H", want: 2 * time.Hour},
+		{s: "pt2h30m", want: 2*time.Hour + 30*time.Minute},
+		{s: "PT1.5S", want: 1500 * time.Millisecond},
+		{s: "P1W", want: 7 * 24 * time.Hour},
+		{s: "P1DT12H", want: 36 * time.Hour},
+		{s: "-1h", want: -time.Hour}, // Rejected by SnoozeTaskFor.
+		{s: "P", wantErr: true},
+		{s: "PT", wantErr: true},
+		{s: "P1DT", wantErr: true},
+		{s: "P1M", wantErr: true},
+		{s: "P1Y", wantErr: true},
+		{s: "tomorrow", wantErr: true},
+		{s: "P99999999999999999999D", wantErr: true},
+	} {
+		got, err := parseSnoozeDuration(tt.s)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSnoozeDuration(%q) = %v, %v, want %v, error: %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCreateTaskColor(t *testing.T) {
+	h := (&server{store: &MemTaskStore{}}).routes()
+	for _, tt := range []struct {
+		color  string
+		status int
+		want   string // The color of the created task.
+	}{
+		{"", http.StatusCreated, ""},
+		{"Purple", http.StatusCreated, "purple"},
+		{"#FF8800", http.StatusCreated, "#ff8800"},
+		{"chartreuse", http.StatusBadRequest, ""},
+		{"#ff880", http.StatusBadRequest, ""},
+	} {
+		body := fmt.Sprintf(`{"description": "paint", "color": %q}`, tt.color)
+		req := httptest.NewRequest("POST", "/tasks", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("POST with color %q got status %d, want %d: %s", tt.color, rr.Code, tt.status, rr.Body)
+			continue
+		}
+		if tt.status != http.StatusCreated {
+			continue
+		}
+		var task Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil || task.Color != tt.want {
+			t.Errorf("POST with color %q created %+v, %v, want color %q", tt.color, task, err, tt.want)
+		}
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	s := &server{store: &MemTaskStore{}}
+	if err := s.store.Add(context.Background(), &Task{Desc: "buy milk"}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	h := s.routes()
+	for _, path := range []string{"/tasks", "/tasks/1"} {
+		get := func(url string) string {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("GET %s got status %d, want %d: %s", url, rr.Code, http.StatusOK, rr.Body)
+			}
+			return rr.Body.String()
+		}
+		compact := strings.TrimSuffix(get(path), "\n")
+		if strings.Contains(compact, "\n") {
+			t.Errorf("GET %s got indented body %q, want it compact", path, compact)
+		}
+		pretty := get(path + "?pretty=true")
+		if !strings.Contains(pretty, "\n  \"") {
+			t.Errorf("GET %s?pretty=true got body %q, want it indented", path, pretty)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(pretty)); err != nil || buf.String() != compact {
+			t.Errorf("GET %s?pretty=true got body %q, want %q indented", path, pretty, compact)
+		}
+	}
+}
+
+func TestCreateContentTypes(t *testing.T) {
+	h := (&server{store: &MemTaskStore{}}).routes()
+	const body = `{"description": "buy milk"}`
+	for _, tt := range []struct {
+		contentType string
+		status      int
+		desc        string // The description of the created task.
+	}{
+		{"application/json", http.StatusCreated, "buy milk"},
+		{"application/json; charset=utf-8", http.StatusCreated, "buy milk"},
+		{"text/plain", http.StatusCreated, body},
+		{"text/plain; charset=utf-8", http.StatusCreated, body},
+		{"", http.StatusCreated, body},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType, ""},
+		{"application/xml", http.StatusUnsupportedMediaType, ""},
+		{"not a media type", http.StatusUnsupportedMediaType, ""},
+	} {
+		req := httptest.NewRequest("POST", "/tasks", strings.NewReader(body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("POST with Content-Type %q got status %d, want %d: %s", tt.contentType, rr.Code, tt.status, rr.Body)
+			continue
+		}
+		if tt.status != http.StatusCreated {
+			var resp errorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Error.Code != codeUnsupportedMediaType {
+				t.Errorf("POST with Content-Type %q got body %s, want code %q", tt.contentType, rr.Body, codeUnsupportedMediaType)
+			}
+			continue
+		}
+		var task Task
+		if err := json.Unmarshal(rr.Body.Bytes(), &task); err != nil || task.Desc != tt.desc {
+			t.Errorf("POST with Content-Type %q created %+v, %v, want description %q", tt.contentType, task, err, tt.desc)
+		}
+	}
+
+	req := httptest.NewRequest("PUT", "/tasks/1", strings.NewReader("<description/>"))
+	req.Header.Set("Content-Type", "application/xml")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("PUT with Content-Type application/xml got status %d, want %d", rr.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestNormalizedTags(t *testing.T) {
+	store := &MemTaskStore{}
+	h := (&server{store: store}).routes()
+
+	req := httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"description": "file taxes", "tags": ["Work", " work ", "", "HOME", "home", "  "]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks got status %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	var created Task
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding the task: %v", err)
+	}
+	stored, err := store.Get(context.Background(), created.Id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got, want := fmt.Sprintf("%q", stored.Tags), `["work" "home"]`; got != want {
+		t.Errorf("stored tags %s, want %s", got, want)
+	}
+
+	req = httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"description": "x", "tags": ["`+strings.Repeat("x", maxTagLen+1)+`"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("POST /tasks with a long tag got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestImportInvalidLines(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client}
+
+	// No line is valid, so the datastore is never called.
+	body := strings.Join([]string{
+		`{"description": ""}`,
+		``,
+		`not JSON`,
+		`{"description": "urgent", "priority": 9}`,
+		strings.Repeat("x", int(maxMsgSize)+1),
+	}, "\n")
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/import", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /import got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var summary ImportSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("POST /import: could not decode %q: %v", rr.Body, err)
+	}
+	if summary.Imported != 0 || summary.Failed != 4 {
+		t.Errorf("POST /import got %d imported and %d failed, want 0 and 4", summary.Imported, summary.Failed)
+	}
+	var lines []int
+	for _, e := range summary.Errors {
+		lines = append(lines, e.Line)
+		if e.Message == "" {
+			t.Errorf("POST /import got no message for line %d", e.Line)
+		}
+	}
+	if fmt.Sprint(lines) != "[1 3 4 5]" {
+		t.Errorf("POST /import got errors on lines %v, want [1 3 4 5]", lines)
+	}
+}
+
+func TestImport(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("import-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	body := strings.Join([]string{
+		`{"description": "buy milk", "tags": ["home"]}`,
+		`{"description": "file report", "priority": 3, "due": "2030-01-02T15:04:05Z"}`,
+		`{"description": "bad due", "due": "tomorrow"}`,
+		`{"description": 42}`,
+		`{"description": "call Sam", "owner": "sam"}`,
+	}, "\n")
+	req := httptest.NewRequest("POST", "/import", strings.NewReader(body))
+	req.Header.Set(tenantHeader, namespace(ctx))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /import got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var summary ImportSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("POST /import: could not decode %q: %v", rr.Body, err)
+	}
+	if summary.Imported != 3 || summary.Failed != 2 || len(summary.Errors) != 2 {
+		t.Errorf("POST /import got %+v, want 3 imported and 2 failed", summary)
+	}
+
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	var keys []*datastore.Key
+	var got []string
+	for _, task := range tasks {
+		keys = append(keys, taskKey(ctx, task.Id))
+		got = append(got, task.Desc)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	sort.Strings(got)
+	if want := []string{"buy milk", "call Sam", "file report"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("after import ListTasks got %q, want %q", got, want)
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/tasks", nil).WithContext(ctx)
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	s.routes().ServeHTTP(rr, req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GET with canceled context took %v, want it to return promptly", elapsed)
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("GET with canceled context got status %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client, timeout: 100 * time.Millisecond}
+
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/tasks", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GET with 100ms timeout took %v", elapsed)
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("GET with unreachable datastore got status %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestListEnvelope(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("envelope-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	keys, err := AddTasks(ctx, client, []string{"one", "two", "three"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(tenantHeader, namespace(ctx))
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s got status %d, want %d: %s", path, rr.Code, http.StatusOK, rr.Body)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: could not decode %q: %v", path, rr.Body, err)
+		}
+	}
+
+	// Decoding into a map checks the exact keys of the envelope.
+	var fields map[string]json.RawMessage
+	get("/tasks", &fields)
+	if len(fields) != 3 || fields["tasks"] == nil || fields["nextCursor"] == nil || fields["total"] == nil {
+		t.Errorf("GET /tasks got keys %v, want tasks, nextCursor and total", fields)
+	}
+	var page taskPage
+	get("/tasks", &page)
+	if len(page.Tasks) != 3 || page.NextCursor != "" || page.Total != 3 {
+		t.Errorf("GET /tasks got %d tasks, cursor %q and total %d, want 3, none and 3", len(page.Tasks), page.NextCursor, page.Total)
+	}
+
+	page = taskPage{}
+	get("/tasks?limit=2", &page)
+	if len(page.Tasks) != 2 || page.NextCursor == "" || page.Total != 3 {
+		t.Fatalf("first page got %d tasks, cursor %q and total %d, want 2, a cursor and 3", len(page.Tasks), page.NextCursor, page.Total)
+	}
+	cursor := page.NextCursor
+	page = taskPage{}
+	get("/tasks?limit=2&cursor="+cursor, &page)
+	if len(page.Tasks) != 1 || page.NextCursor != "" || page.Total != 3 {
+		t.Errorf("last page got %d tasks, cursor %q and total %d, want 1, none and 3", len(page.Tasks), page.NextCursor, page.Total)
+	}
+
+	var bare []*Task
+	get("/tasks?envelope=false", &bare)
+	if len(bare) != 3 {
+		t.Errorf("GET /tasks?envelope=false got %d tasks, want 3", len(bare))
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("recycle-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	key, err := AddTask(ctx, client, "recycle me")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	listed := func(path string) bool {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(tenantHeader, namespace(ctx))
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		var page taskPage
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatalf("GET %s: could not decode tasks from %q: %v", path, rr.Body, err)
+		}
+		for _, task := range page.Tasks {
+			if task.Id == key.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, step := range []struct {
+		method, path          string
+		listed, listedWithAll bool
+	}{
+		{"DELETE", fmt.Sprintf("/tasks/%d", key.ID), false, true},
+		{"POST", fmt.Sprintf("/tasks/%d/restore", key.ID), true, true},
+	} {
+		req := httptest.NewRequest(step.method, step.path, nil)
+		req.Header.Set(tenantHeader, namespace(ctx))
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s %s got status %d, want %d: %s", step.method, step.path, rr.Code, http.StatusOK, rr.Body)
+		}
+		if got := listed("/tasks"); got != step.listed {
+			t.Errorf("after %s %s, listed = %v, want %v", step.method, step.path, got, step.listed)
+		}
+		if got := listed("/tasks?includeDeleted=true"); got != step.listedWithAll {
+			t.Errorf("after %s %s, listed with includeDeleted = %v, want %v", step.method, step.path, got, step.listedWithAll)
+		}
+	}
+
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.Deleted || !task.DeletedAt.IsZero() {
+		t.Errorf("restored task got Deleted = %v, DeletedAt = %v, want false and zero", task.Deleted, task.DeletedAt)
+	}
+}
+
+func TestDecodeNewTask(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string // The fields with errors, or nil if the body is valid.
+	}{
+		{body: `{"description": "buy milk"}`},
+		{body: `{"description": " pad ", "priority": 3, "due": "2024-04-15T00:00:00Z", "tags": ["home"]}`},
+		{body: `{"description": ""}`, fields: []string{"description"}},
+		{body: `{"description": "x", "priority": 4}`, fields: []string{"priority"}},
+		{body: `{"description": "x", "priority": "high"}`, fields: []string{"priority"}},
+		{body: `{"description": "x", "due": "tomorrow"}`, fields: []string{"due"}},
+		{body: `{"description": "x", "tags": "home"}`, fields: []string{"tags"}},
+		{body: `{"description": "x", "tags": ["` + strings.Repeat("x", maxTagLen+1) + `"]}`, fields: []string{"tags"}},
+		{body: `{"description": "x", "color": "#1E90FF"}`},
+		{body: `{"description": "x", "color": "teal"}`, fields: []string{"color"}},
+		{body: `{"description": "x", "estimate_minutes": 15}`},
+		{body: `{"description": "x", "estimate_minutes": -15}`, fields: []string{"estimate_minutes"}},
+		{body: `{"description": "x", "estimate_minutes": 1.5}`, fields: []string{"estimate_minutes"}},
+		{body: `{"priority": -1, "due": "soon"}`, fields: []string{"description", "priority", "due"}},
+		{body: `{"description": `, fields: []string{""}},
+	}
+	for _, test := range tests {
+		task, errs := decodeNewTask(test.body)
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") || (len(fields) > 0) != (len(test.fields) > 0) {
+			t.Errorf("decodeNewTask(%s) got errors %+v, want errors for fields %q", test.body, errs, test.fields)
+			continue
+		}
+		if errs == nil && task == nil {
+			t.Errorf("decodeNewTask(%s) returned no task and no errors", test.body)
+		}
+	}
+
+	task, _ := decodeNewTask(`{"description": " pad ", "priority": 3, "due": "2024-04-15T00:00:00Z", "tags": ["home"]}`)
+	wantDue := time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC)
+	if task.Desc != "pad" || task.Priority != PriorityHigh || !task.Due.Equal(wantDue) || len(task.Tags) != 1 {
+		t.Errorf("decodeNewTask got %+v, want description %q, priority %d, due %v and one tag", task, "pad", PriorityHigh, wantDue)
+	}
+}
+
+func TestDecodeTaskPatch(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string // The fields with errors, or nil if the body is valid.
+	}{
+		{body: `{}`},
+		{body: `{"done": true}`},
+		{body: `{"description": "buy milk", "due": "2024-04-15T00:00:00Z"}`},
+		{body: `{"due": ""}`},
+		{body: `{"description": null}`},
+		{body: `{"description": " "}`, fields: []string{"description"}},
+		{body: `{"due": "tomorrow"}`, fields: []string{"due"}},
+		{body: `{"done": "yes"}`, fields: []string{"done"}},
+		{body: `{"tags": []}`},
+		{body: `{"color": ""}`},
+		{body: `{"color": "Green"}`},
+		{body: `{"color": "#12345"}`, fields: []string{"color"}},
+		{body: `{"estimate_minutes": 0}`},
+		{body: `{"estimate_minutes": -1}`, fields: []string{"estimate_minutes"}},
+		{body: `{"tags": ["a","b","c","d","e","f","g","h","i","j","k","l","m","n","o","p","q","r","s","t","u"]}`, fields: []string{"tags"}},
+		{body: `{"done": `, fields: []string{""}},
+	}
+	for _, test := range tests {
+		_, errs := decodeTaskPatch(test.body)
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(test.fields, ",") || (len(fields) > 0) != (len(test.fields) > 0) {
+			t.Errorf("decodeTaskPatch(%s) got errors %+v, want errors for fields %q", test.body, errs, test.fields)
+		}
+	}
+
+	patch, _ := decodeTaskPatch(`{"done": false}`)
+	if patch.Done == nil || *patch.Done || patch.Desc != nil || patch.Due != nil {
+		t.Errorf("decodeTaskPatch({\"done\": false}) got %+v, want only done set to false", patch)
+	}
+	patch, _ = decodeTaskPatch(`{"due": ""}`)
+	if patch.Due == nil || !patch.Due.IsZero() {
+		t.Errorf("decodeTaskPatch({\"due\": \"\"}) got due %v, want the zero time", patch.Due)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 5, ""},
+		{"short", 5, "short"},
+		{"longer", 5, "long…"},
+		{"héllo wörld", 8, "héllo w…"},
+		{"😀😀😀😀😀😀", 6, "😀😀😀😀😀😀"},
+		{"😀😀😀😀😀😀", 4, "😀😀😀…"},
+		{"ok 😀 done", 5, "ok 😀…"},
+	}
+	for _, test := range tests {
+		got := truncate(test.s, test.n)
+		if got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.s, test.n, got, test.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, which is not valid UTF-8", test.s, test.n, got)
+		}
+	}
+}
+
+func TestPreviewTasks(t *testing.T) {
+	desc := strings.Repeat("🚀", previewLength+1)
+	tasks := []*Task{{Desc: desc, Priority: PriorityHigh}, {Desc: "short"}}
+
+	previews := previewTasks(tasks)
+	if got := utf8.RuneCountInString(previews[0].Desc); got != previewLength {
+		t.Errorf("preview of a long description has %d characters, want %d", got, previewLength)
+	}
+	if want := strings.Repeat("🚀", previewLength-1) + "…"; previews[0].Desc != want {
+		t.Errorf("preview got %q, want %q", previews[0].Desc, want)
+	}
+	if previews[0].Priority != PriorityHigh || previews[1].Desc != "short" {
+		t.Errorf("previewTasks got %+v and %+v, want the other fields unchanged", previews[0], previews[1])
+	}
+	if tasks[0].Desc != desc {
+		t.Errorf("previewTasks modified the original task's description to %q", tasks[0].Desc)
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header  string
+		version int // -1 for any version.
+		ok      bool
+	}{
+		{"", -1, true},
+		{"*", -1, true},
+		{`"0"`, 0, true},
+		{`"12"`, 12, true},
+		{"12", 0, false},
+		{`W/"12"`, 0, false},
+		{`"twelve"`, 0, false},
+		{`"`, 0, false},
+	}
+	for _, test := range tests {
+		version, err := parseIfMatch(test.header)
+		if (err == nil) != test.ok {
+			t.Errorf("parseIfMatch(%q) got err %v, want ok %v", test.header, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		got := -1
+		if version != nil {
+			got = *version
+		}
+		if got != test.version {
+			t.Errorf("parseIfMatch(%q) = %d, want %d", test.header, got, test.version)
+		}
+	}
+}
+
+func TestPatchIfMatch(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	key, err := AddTask(ctx, client, "shared")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+	path := fmt.Sprintf("/tasks/%d", key.ID)
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	tag := rr.Header().Get("ETag")
+	if tag == "" {
+		t.Fatalf("GET %s got no ETag", path)
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusConflict} {
+		req := httptest.NewRequest("PATCH", path, strings.NewReader(`{"done": true}`))
+		req.Header.Set("If-Match", tag)
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("PATCH #%d with If-Match %s got status %d, want %d: %s", i+1, tag, rr.Code, want, rr.Body)
+		}
+	}
+}
+
+func TestParseTaskID(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"42", 42, true},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"abc", 0, false},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"", 0, false},
+		{"9223372036854775808", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseTaskID(test.s)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseTaskID(%q) = %d, %v, want %d and ok %v", test.s, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"*", true},
+		{`"3"`, true},
+		{`W/"3"`, true},
+		{`"2", "3"`, true},
+		{`"2"`, false},
+		{"3", false},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.header, `"3"`); got != test.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", test.header, `"3"`, got, test.want)
+		}
+	}
+}
+
+func TestGetIfNoneMatch(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+	s := &server{client: client}
+
+	key, err := AddTask(ctx, client, "polled")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+	path := fmt.Sprintf("/tasks/%d", key.ID)
+
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+	tag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || tag == "" {
+		t.Fatalf("GET %s got status %d and ETag %q, want %d and an ETag", path, rr.Code, tag, http.StatusOK)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("If-None-Match", tag)
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := get(); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("GET %s with If-None-Match %s got status %d and body %q, want %d and no body", path, tag, rr.Code, rr.Body, http.StatusNotModified)
+	}
+
+	// Changing the task changes its ETag.
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	if rr := get(); rr.Code != http.StatusOK {
+		t.Errorf("GET %s of a changed task with If-None-Match %s got status %d, want %d", path, tag, rr.Code, http.StatusOK)
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"home", []string{"home"}},
+		{"home,work", []string{"home", "work"}},
+		{" home , work,,home ", []string{"home", "work"}},
+		{",", nil},
+	}
+	for _, test := range tests {
+		if got := splitTags(test.s); strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("splitTags(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestCreateInvalidJSON(t *testing.T) {
+	s := &server{}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"description": "x", "priority": "high"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("POST with invalid priority got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("could not decode error from %q: %v", rr.Body, err)
+	}
+	if fields := resp.Error.Fields; len(fields) != 1 || fields[0].Field != "priority" {
+		t.Errorf("POST with invalid priority got field errors %+v, want one for priority", fields)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{from: "", to: "", ok: true},
+		{from: "2019-01-01T00:00:00Z", to: "", ok: true},
+		{from: "", to: "2019-01-01T00:00:00Z", ok: true},
+		{from: "2019-01-01T00:00:00Z", to: "2019-01-01T00:00:00Z", ok: true},
+		{from: "2019-01-02T00:00:00Z", to: "2019-01-01T00:00:00Z", ok: false},
+		{from: "last week", to: "", ok: false},
+		{from: "", to: "2019-01-01", ok: false},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		from, to, ok := parseRange(rr, test.from, test.to)
+		if ok != test.ok {
+			t.Errorf("parseRange(%q, %q) ok = %v, want %v", test.from, test.to, ok, test.ok)
+			continue
+		}
+		if !ok && rr.Code != http.StatusBadRequest {
+			t.Errorf("parseRange(%q, %q) wrote status %d, want %d", test.from, test.to, rr.Code, http.StatusBadRequest)
+		}
+		if ok && test.from == "" && !from.Equal(time.Unix(0, 0)) {
+			t.Errorf("parseRange(%q, %q) from = %v, want the Unix epoch", test.from, test.to, from)
+		}
+		if ok && test.to == "" && time.Since(to) > time.Minute {
+			t.Errorf("parseRange(%q, %q) to = %v, want now", test.from, test.to, to)
+		}
+	}
+}
+
+func TestGetTasksInvalidIDs(t *testing.T) {
+	s := &server{}
+	tooMany := strings.Repeat("1,", maxGetTasks) + "1"
+	for _, ids := range []string{"1,two,3", "1,,3", tooMany} {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, httptest.NewRequest("GET", "/tasks?ids="+ids, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("GET /tasks?ids=%.20s got status %d, want %d", ids, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMarkAllDoneDryRun(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("dryrun-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	keys, err := AddTasks(ctx, client, []string{"one", "two"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	before, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/done?dryRun=true", nil)
+	req.Header.Set(tenantHeader, namespace(ctx))
+	rr := httptest.NewRecorder()
+	s.routes().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /done?dryRun=true got status %d, want %d: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var result bulkResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("could not decode result from %q: %v", rr.Body, err)
+	}
+	if !result.DryRun || result.Count != len(keys) || len(result.IDs) != len(keys) {
+		t.Errorf("dry run got %+v, want a dry run affecting %d tasks", result, len(keys))
+	}
+
+	after, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("dry run changed the number of tasks from %d to %d", len(before), len(after))
+	}
+	for i := range after {
+		if after[i].Done || !after[i].UpdatedAt.Equal(before[i].UpdatedAt) {
+			t.Errorf("dry run changed task %d: got %+v, was %+v", after[i].Id, after[i], before[i])
+		}
+	}
+}
+
+func TestPurgeDone(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("purge-", time.Now().UnixNano()))
+	s := &server{client: client}
+
+	keys, err := AddTasks(ctx, client, []string{"done", "open"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	if err := MarkDone(ctx, client, keys[0].ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		req := httptest.NewRequest("DELETE", fmt.Sprintf("/tasks?done=true&dryRun=%t", dryRun), nil)
+		req.Header.Set(tenantHeader, namespace(ctx))
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s got status %d, want %d: %s", req.URL, rr.Code, http.StatusOK, rr.Body)
+		}
+		var result bulkResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatalf("could not decode result from %q: %v", rr.Body, err)
+		}
+		if result.DryRun != dryRun || result.Count != 1 || len(result.IDs) != 1 || result.IDs[0] != keys[0].ID {
+			t.Errorf("%s got %+v, want task %d", req.URL, result, keys[0].ID)
+		}
+	}
+
+	tasks, err := ListAllTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListAllTasks: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != keys[1].ID {
+		t.Errorf("after purge got tasks %+v, want only task %d", tasks, keys[1].ID)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client, timeout: 100 * time.Millisecond}
+
+	invalidTenant := httptest.NewRequest("GET", "/tasks", nil)
+	invalidTenant.Header.Set(tenantHeader, "not a namespace!")
+	tests := []struct {
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{httptest.NewRequest("GET", "/tasks", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/tasks/abc", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks/0", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("PATCH", "/tasks/-5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/0/restore", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/abc/duplicate", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/completed?limit=0", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/changes?since=yesterday", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/completed", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/tags", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/feed?cursor=abc!", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/feed?limit=0", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/feed", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("POST", "/feed", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("GET", "/reports/tags", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("POST", "/tags", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("GET", "/tasks/1/duplicate", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("GET", "/tasks/1/snooze", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"for": "2h", "until": "2024-01-01T00:00:00Z"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"for": "soon"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"for": "0s"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"for": "P400D"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"until": "tomorrow"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/snooze", strings.NewReader(`{"for": "PT2H"}`)), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("DELETE", "/tasks/1?permanent=true", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/tasks/abc/history", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks/done", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("POST", "/tasks/done", strings.NewReader(`{"ids": [1]}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/done", strings.NewReader(`[]`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/done", strings.NewReader(`[1, 0]`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/done", strings.NewReader(`[1, 2]`)), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/tasks?includeDeleted=true&done=false", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?done=false&limit=5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?tag=x&limit=5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?sort=priority&cursor=abc", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?includeDeleted=true&limit=5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks/1/history", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("GET", "/tasks?ids=1,0", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("DELETE", "/tasks", strings.NewReader("-5")), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("DELETE", "/tasks", strings.NewReader("1")), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("POST", "/tasks", strings.NewReader(strings.Repeat("x", maxDescLen+1))), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"description": "`+strings.Repeat("x", maxDescLen+1)+`"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("PATCH", "/tasks/1", strings.NewReader(`{"description": "`+strings.Repeat("x", maxDescLen+1)+`"}`)), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("PUT", "/count", nil), http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{httptest.NewRequest("GET", "/count", nil), http.StatusInternalServerError, codeInternal},
+		{httptest.NewRequest("GET", "/lists/groceries", nil), http.StatusNotFound, codeNotFound},
+		{httptest.NewRequest("DELETE", "/tasks?done=false", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?tags=a,b,c,d,e,f,g,h,i,j,k", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?tags=,", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?due=tomorrow", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?due=today&tz=Mars/Olympus_Mons", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?search=+!", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?limit=five", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?maxEstimate=-5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?maxEstimate=soon", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?maxEstimate=30&limit=5", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?limit=-1", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?limit=0", nil), http.StatusBadRequest, codeInvalidArgument},
+		{httptest.NewRequest("GET", "/tasks?limit=1001", nil), http.StatusBadRequest, codeInvalidArgument},
+		{invalidTenant, http.StatusBadRequest, codeInvalidArgument},
+	}
+	for _, test := range tests {
+		rr := httptest.NewRecorder()
+		s.routes().ServeHTTP(rr, test.req)
+		label := test.req.Method + " " + test.req.URL.String()
+		if rr.Code != test.status {
+			t.Errorf("%s got status %d, want %d", label, rr.Code, test.status)
+		}
+		if got := rr.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s got Content-Type %q, want application/json", label, got)
+		}
+		var resp errorResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: could not decode error from %q: %v", label, rr.Body, err)
+			continue
+		}
+		if resp.Error.Code != test.code || resp.Error.Message == "" {
+			t.Errorf("%s got error %+v, want code %q and a message", label, resp.Error, test.code)
+		}
+		// Internal errors must not reveal the datastore's error.
+		if test.status == http.StatusInternalServerError && strings.Contains(resp.Error.Message, "rpc error") {
+			t.Errorf("%s leaked the datastore error to the client: %q", label, resp.Error.Message)
+		}
+	}
+}
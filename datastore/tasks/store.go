@@ -0,0 +1,239 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// TaskStore stores the tasks of the server's core endpoints: creating,
+// reading, listing, completing and deleting tasks. Like the package's task
+// functions, each method acts on the tasks in the context's namespace and
+// task list. The server's other endpoints use its datastore client directly.
+type TaskStore interface {
+	// Add validates and stores a new task as CreateTask does, setting its
+	// Id. If task.Id is already set, as when Add is retried, the task is
+	// stored with that ID, unless a task with the ID exists; then task is
+	// replaced by the existing task and nothing is stored.
+	Add(ctx context.Context, task *Task) error
+	// Get returns the task with the given ID, or ErrTaskNotFound.
+	Get(ctx context.Context, id int64) (*Task, error)
+	// List returns the tasks listed by ListTasks.
+	List(ctx context.Context) ([]*Task, error)
+	// MarkDone marks the task with the given ID done, or returns
+	// ErrTaskNotFound, and reports whether it changed the task. A task that
+	// is already done is left unchanged.
+	MarkDone(ctx context.Context, id int64) (bool, error)
+	// Delete moves the task with the given ID to the recycle bin, or returns
+	// ErrTaskNotFound.
+	Delete(ctx context.Context, id int64) error
+}
+
+// DatastoreTaskStore is a TaskStore that keeps tasks in Cloud Datastore.
+type DatastoreTaskStore struct {
+	Client *datastore.Client
+	// Kind is the datastore kind of the tasks, as set by WithKind. If it is
+	// empty, the context's kind is used, which defaults to Task.
+	Kind string
+}
+
+// NewTaskStore returns a DatastoreTaskStore that keeps tasks as entities of
+// the given kind, or of kind Task if it is empty.
+func NewTaskStore(client *datastore.Client, kind string) (*DatastoreTaskStore, error) {
+	if err := checkKind(kind); err != nil {
+		return nil, err
+	}
+	return &DatastoreTaskStore{Client: client, Kind: kind}, nil
+}
+
+// context returns ctx with the store's kind, if it has one.
+func (s *DatastoreTaskStore) context(ctx context.Context) context.Context {
+	if s.Kind == "" {
+		return ctx
+	}
+	return WithKind(ctx, s.Kind)
+}
+
+// Add implements TaskStore.
+func (s *DatastoreTaskStore) Add(ctx context.Context, task *Task) error {
+	ctx = s.context(ctx)
+	if err := validateTask(task); err != nil {
+		return err
+	}
+	if task.Id == 0 {
+		key, err := allocateTaskKey(ctx, s.Client)
+		if err != nil {
+			return err
+		}
+		task.Id = key.ID
+	}
+	return createTaskAt(ctx, s.Client, taskKey(ctx, task.Id), task)
+}
+
+// Get implements TaskStore.
+func (s *DatastoreTaskStore) Get(ctx context.Context, id int64) (*Task, error) {
+	return GetTask(s.context(ctx), s.Client, id)
+}
+
+// List implements TaskStore.
+func (s *DatastoreTaskStore) List(ctx context.Context) ([]*Task, error) {
+	return ListTasks(s.context(ctx), s.Client)
+}
+
+// MarkDone implements TaskStore.
+func (s *DatastoreTaskStore) MarkDone(ctx context.Context, id int64) (bool, error) {
+	return markDone(s.context(ctx), s.Client, id)
+}
+
+// Delete implements TaskStore.
+func (s *DatastoreTaskStore) Delete(ctx context.Context, id int64) error {
+	return SoftDeleteTask(s.context(ctx), s.Client, id)
+}
+
+// MemTaskStore is a TaskStore that keeps tasks in memory, for tests. It keeps
+// no history and publishes no events. The zero value is an empty store.
+type MemTaskStore struct {
+	mu     sync.Mutex
+	tasks  map[memTaskKey]*Task
+	lastID int64
+}
+
+// memTaskKey identifies a task in a MemTaskStore.
+type memTaskKey struct {
+	kind, namespace, list string
+	id                    int64
+}
+
+func newMemTaskKey(ctx context.Context, id int64) memTaskKey {
+	return memTaskKey{kind: taskKind(ctx), namespace: namespace(ctx), list: listName(ctx), id: id}
+}
+
+// Add implements TaskStore.
+func (s *MemTaskStore) Add(ctx context.Context, task *Task) error {
+	if err := validateTask(task); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tasks == nil {
+		s.tasks = make(map[memTaskKey]*Task)
+	}
+	if task.Id == 0 {
+		s.lastID++
+		task.Id = s.lastID
+	}
+	key := newMemTaskKey(ctx, task.Id)
+	if existing, ok := s.tasks[key]; ok {
+		*task = *existing
+		return nil
+	}
+	if task.Position == 0 {
+		// As nextPosition does, place the task last.
+		task.Position = 1
+		for k, t := range s.tasks {
+			if k.kind == key.kind && k.namespace == key.namespace && k.list == key.list && t.Position >= task.Position {
+				task.Position = t.Position + 1
+			}
+		}
+	}
+	task.Created = time.Now()
+	task.UpdatedAt = task.Created
+	scheduleRecurrence(task)
+	stored := *task
+	s.tasks[key] = &stored
+	return nil
+}
+
+// Get implements TaskStore.
+func (s *MemTaskStore) Get(ctx context.Context, id int64) (*Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[newMemTaskKey(ctx, id)]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	t := *task
+	return &t, nil
+}
+
+// List implements TaskStore.
+func (s *MemTaskStore) List(ctx context.Context) ([]*Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []*Task
+	for key, task := range s.tasks {
+		if key.kind != taskKind(ctx) || key.namespace != namespace(ctx) || key.list != listName(ctx) || task.Deleted {
+			continue
+		}
+		t := *task
+		tasks = append(tasks, &t)
+	}
+	// The same order as ListTasks: starred tasks first, then by creation.
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].Starred != tasks[j].Starred {
+			return tasks[i].Starred
+		}
+		if !tasks[i].Created.Equal(tasks[j].Created) {
+			return tasks[i].Created.Before(tasks[j].Created)
+		}
+		return tasks[i].Id < tasks[j].Id
+	})
+	return hideSnoozed(tasks, time.Now()), nil
+}
+
+// MarkDone implements TaskStore.
+func (s *MemTaskStore) MarkDone(ctx context.Context, id int64) (bool, error) {
+	if task, err := s.Get(ctx, id); err != nil || task.Done {
+		return false, err
+	}
+	err := s.update(ctx, id, func(task *Task) {
+		task.Done = true
+		task.CompletedAt = task.UpdatedAt
+		task.CompletedBy = userName(ctx)
+	})
+	return err == nil, err
+}
+
+// Delete implements TaskStore.
+func (s *MemTaskStore) Delete(ctx context.Context, id int64) error {
+	return s.update(ctx, id, func(task *Task) {
+		task.Deleted = true
+		task.DeletedAt = task.UpdatedAt
+	})
+}
+
+// update applies f to the task with the given ID after setting its UpdatedAt
+// to now and incrementing its version.
+func (s *MemTaskStore) update(ctx context.Context, id int64, f func(*Task)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[newMemTaskKey(ctx, id)]
+	if !ok {
+		return ErrTaskNotFound
+	}
+	task.Version++
+	task.UpdatedAt = time.Now()
+	f(task)
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// TestMemTaskStoreHandlers drives the core endpoints with a MemTaskStore, so
+// it needs no datastore.
+func TestMemTaskStoreHandlers(t *testing.T) {
+	s := &server{store: &MemTaskStore{}}
+	h := s.routes()
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if strings.HasPrefix(body, "{") {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func() []*Task {
+		rr := serve("GET", "/tasks", "")
+		var page taskPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatalf("GET /tasks: decoding response: %v", err)
+		}
+		return page.Tasks
+	}
+
+	rr := serve("POST", "/tasks", `{"description": "write tests", "priority": 2}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks got status %d, want %d: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+	var created Task
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatalf("POST /tasks: decoding response: %v", err)
+	}
+	if created.Id == 0 || created.Desc != "write tests" || created.Priority != 2 {
+		t.Errorf("POST /tasks created %+v", created)
+	}
+	if got, want := rr.Header().Get("Location"), "/tasks/"+fmt.Sprint(created.Id); got != want {
+		t.Errorf("POST /tasks got Location %q, want %q", got, want)
+	}
+	if rr := serve("POST", "/tasks", "  "); rr.Code != http.StatusBadRequest {
+		t.Errorf("POST /tasks with an empty description got status %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	if tasks := list(); len(tasks) != 1 || tasks[0].Id != created.Id {
+		t.Errorf("GET /tasks listed %+v, want the created task", tasks)
+	}
+
+	rr = serve("GET", "/tasks/"+fmt.Sprint(created.Id), "")
+	var got Task
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil || got.Desc != created.Desc {
+		t.Errorf("GET /tasks/%d got %+v, %v, want %+v", created.Id, got, err, created)
+	}
+
+	rr = serve("DELETE", "/tasks", fmt.Sprint(created.Id))
+	if want := "task " + fmt.Sprint(created.Id) + " marked done\n"; rr.Body.String() != want {
+		t.Errorf("legacy DELETE got %q, want %q", rr.Body, want)
+	}
+	if tasks := list(); len(tasks) != 1 || !tasks[0].Done {
+		t.Errorf("after marking the task done, GET /tasks listed %+v", tasks)
+	}
+
+	if rr := serve("DELETE", "/tasks/"+fmt.Sprint(created.Id), ""); rr.Code != http.StatusOK {
+		t.Errorf("DELETE /tasks/%d got status %d, want %d", created.Id, rr.Code, http.StatusOK)
+	}
+	if tasks := list(); len(tasks) != 0 {
+		t.Errorf("after deleting the task, GET /tasks listed %+v, want none", tasks)
+	}
+
+	for _, req := range []struct{ method, url, body string }{
+		{"GET", "/tasks/99", ""},
+		{"DELETE", "/tasks", "99"},
+		{"DELETE", "/tasks/99", ""},
+	} {
+		if rr := serve(req.method, req.url, req.body); rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s %q got status %d, want %d", req.method, req.url, req.body, rr.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestMemTaskStoreAdd(t *testing.T) {
+	var s MemTaskStore
+	ctx := context.Background()
+
+	first := &Task{Desc: "first"}
+	if err := s.Add(ctx, first); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	// A retried Add finds the task stored by the first attempt.
+	retry := &Task{Id: first.Id, Desc: "retried"}
+	if err := s.Add(ctx, retry); err != nil {
+		t.Fatalf("Add again: %v", err)
+	}
+	if retry.Desc != first.Desc {
+		t.Errorf("retried Add got task %+v, want %+v", retry, first)
+	}
+
+	// Each namespace has its own tasks.
+	other := WithNamespace(ctx, "other")
+	if _, err := s.Get(other, first.Id); err != ErrTaskNotFound {
+		t.Errorf("Get in another namespace got err %v, want %v", err, ErrTaskNotFound)
+	}
+	if tasks, err := s.List(other); err != nil || len(tasks) != 0 {
+		t.Errorf("List in another namespace = %+v, %v, want no tasks", tasks, err)
+	}
+
+	// Marking a done task done again changes nothing.
+	if changed, err := s.MarkDone(ctx, first.Id); err != nil || !changed {
+		t.Fatalf("MarkDone = %v, %v, want true, nil", changed, err)
+	}
+	done, _ := s.Get(ctx, first.Id)
+	if changed, err := s.MarkDone(ctx, first.Id); err != nil || changed {
+		t.Fatalf("MarkDone again = %v, %v, want false, nil", changed, err)
+	}
+	if again, _ := s.Get(ctx, first.Id); again.Version != done.Version || !again.CompletedAt.Equal(done.CompletedAt) {
+		t.Errorf("MarkDone again changed the task from %+v to %+v", done, again)
+	}
+}
+
+func TestNewTaskStoreKind(t *testing.T) {
+	if _, err := NewTaskStore(nil, "__reserved__"); err == nil {
+		t.Errorf("NewTaskStore with a reserved kind got no error")
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("kind-", time.Now().UnixNano()))
+
+	store, err := NewTaskStore(client, "Reminder")
+	if err != nil {
+		t.Fatalf("NewTaskStore: %v", err)
+	}
+	task := &Task{Desc: "call the dentist"}
+	if err := store.Add(ctx, task); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	key := datastore.IDKey("Reminder", task.Id, nil)
+	key.Namespace = namespace(ctx)
+	defer client.Delete(ctx, key)
+
+	var stored Task
+	if err := client.Get(ctx, key, &stored); err != nil || stored.Desc != task.Desc {
+		t.Errorf("Get of the Reminder entity = %+v, %v, want %q", stored, err, task.Desc)
+	}
+	if _, err := GetTask(ctx, client, task.Id); err != ErrTaskNotFound {
+		t.Errorf("GetTask of the reminder as a Task got err %v, want %v", err, ErrTaskNotFound)
+	}
+	if tasks, err := store.List(ctx); err != nil || len(tasks) != 1 {
+		t.Errorf("List of reminders = %+v, %v, want the reminder", tasks, err)
+	}
+	if tasks, err := ListTasks(ctx, client); err != nil || len(tasks) != 0 {
+		t.Errorf("ListTasks = %+v, %v, want no tasks", tasks, err)
+	}
+}
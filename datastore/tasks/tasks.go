@@ -14,104 +14,372 @@
 
 // A simple command-line task list manager to demonstrate using the
 // cloud.google.com/go/datastore package.
+//
+// To run against the local datastore emulator instead of Cloud Datastore,
+// start it and export its environment before running the server or tests:
+//
+//	gcloud beta emulators datastore start
+//	$(gcloud beta emulators datastore env-init)
+//
+// Otherwise the server connects to Cloud Datastore with the credentials of
+// the Cloud Foundry service named by SERVICE_NAME in VCAP_SERVICES, or, when
+// neither is set, with Application Default Credentials. If the datastore
+// client cannot be created, the server retries with backoff and then every
+// 30 seconds, answering every request, /healthz included, with 503 Service
+// Unavailable in the meantime.
+//
+// The server listens on PORT, 8080 by default, on every network interface.
+// Setting HOST to an address, such as 127.0.0.1 to accept only local
+// connections, listens on that interface alone.
+//
+// Run with -backfill to repair the tasks in -namespace that were saved by
+// earlier versions of the server, instead of serving: tasks without the
+// deleted or starred property, which ListTasks leaves out, tasks without
+// a creation or update time, and tasks without the indexed description
+// prefix, which sorting by description leaves out.
+//
+// The server uses the project's default database. Setting
+// DATASTORE_DATABASE_ID to any other database stops it from starting, since
+// the datastore client it is built with cannot connect to named databases;
+// that needs cloud.google.com/go/datastore v1.11.0 or later.
+//
+// Datastore calls that fail with a transient error are retried with
+// exponential backoff. DATASTORE_RETRY_ATTEMPTS, DATASTORE_RETRY_INITIAL and
+// DATASTORE_RETRY_MAX override the number of attempts and the delays.
+//
+// Each request's datastore operations are canceled if they take longer than
+// REQUEST_TIMEOUT, a duration such as "5s", which defaults to 10 seconds.
+//
+// The number of requests and datastore operations and their latency are
+// served in the Prometheus format on /metrics, unless DISABLE_METRICS is
+// "true".
+//
+// If ACCESS_LOG is "true", a log entry is written for each request, with its
+// method, URL, status, response size and latency. Every entry logged for a
+// request carries the request's ID, which is taken from its X-Request-ID
+// header or else generated, and returned in the response's X-Request-ID.
+//
+// The default task listing is cached for LIST_CACHE_TTL, which defaults to 5
+// seconds; setting it to 0 disables the cache. Each server instance empties
+// its cache whenever it changes a task, but other instances may serve
+// listings that are out of date by up to the TTL.
+//
+// Each request is traced, continuing the trace in its W3C traceparent header,
+// and the datastore client's spans are nested under the request's span. Spans
+// are exported with OTLP/HTTP to OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or to
+// OTEL_EXPORTER_OTLP_ENDPOINT's /v1/traces path. Traces started by a caller
+// are sampled if the caller sampled them.
+//
+// If DONE_WEBHOOK_ENABLED is "true", a JSON notification is posted to
+// DONE_WEBHOOK_URL in the background whenever a task is marked done.
+//
+// The user named by a request's X-User header, if any, is recorded as the
+// completed_by of the tasks the request marks done, and cleared when they are
+// reopened. Like a task's owner, it is taken on trust.
+//
+// Each client, identified by its tenant header or else its IP address, may
+// make RATE_LIMIT requests that change tasks per second, in bursts of up to
+// RATE_LIMIT_BURST; the defaults are 10 and 20. Setting RATE_LIMIT to 0
+// removes the limit. Request bodies are limited to maxMsgSize bytes, except
+// that /import accepts any number of lines of up to that size, and task
+// descriptions to maxDescLen bytes.
+//
+// Setting MAX_OPEN_TASKS caps how many open tasks, neither done nor in the
+// recycle bin, each tenant may have; MAX_OPEN_TASKS_BY_TENANT, such as
+// "acme=1000,demo=20", sets the caps of particular tenants. Creating or
+// duplicating a task beyond the cap fails with 409 Conflict. Imported tasks
+// and occurrences of recurring tasks are not capped.
+//
+// At most MAX_CONCURRENT_CALLS datastore calls, 100 by default, are in flight
+// at once. Others wait up to MAX_CONCURRENT_WAIT, which defaults to 100ms,
+// and then fail, and the request is answered with 503 Service Unavailable.
+// Setting MAX_CONCURRENT_CALLS to 0 removes the limit.
+//
+// Tasks are stored as entities of kind Task, or of the kind named by
+// TASK_KIND; see WithKind.
+//
+// Reads of a task by ID are strongly consistent, so a task can always be read
+// back as soon as it is added or changed, as can every query within a task
+// list. Other queries, such as the default listing, may miss recent changes
+// for a short while. Setting READ_CONSISTENCY to "eventual" makes the queries
+// within task lists eventually consistent too, trading those guarantees for
+// lower latency; see WithEventualConsistency.
+//
+// JSON responses are compact. Adding pretty=true to a request's query
+// indents its response, for reading it with tools like curl; error responses
+// are always compact.
+//
+// POST /admin/reset permanently deletes all of a tenant's tasks, for
+// resetting test environments, and POST /admin/dedupe deletes the open tasks
+// that duplicate an older one's description. Both require the X-Admin-Secret
+// header to match ADMIN_SECRET, and are refused if ADMIN_SECRET is not set.
+//
+// Browsers may call the API from the origins in the comma-separated
+// CORS_ALLOWED_ORIGINS, such as "https://app.example.com", or from any origin
+// if it is "*". By default no other origin is allowed.
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"cloud.google.com/go/datastore"
+	"go.opencensus.io/trace"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 func main() {
-	creds, err := parseCreds()
+	backfill := flag.Bool("backfill", false, "repair tasks saved by earlier versions of the server, then exit")
+	backfillNamespace := flag.String("namespace", "", "the namespace to repair with -backfill")
+	flag.Parse()
+
+	ctx := context.Background()
+	kind := os.Getenv("TASK_KIND")
+	if err := checkKind(kind); err != nil {
+		log.Fatalf("Invalid TASK_KIND: %v", err)
+	}
+	var eventual bool
+	switch v := os.Getenv("READ_CONSISTENCY"); v {
+	case "", "strong":
+	case "eventual":
+		eventual = true
+	default:
+		log.Fatalf("Invalid READ_CONSISTENCY %q (must be strong or eventual)", v)
+	}
+	// Settings that can never work stop the server rather than being retried.
+	if err := checkDatabaseID(os.Getenv("DATASTORE_DATABASE_ID")); err != nil {
+		log.Fatalf("Could not create datastore client: %v", err)
+	}
+	if _, err := callLimiterFromEnv(); err != nil {
+		log.Fatalf("Could not create datastore client: %v", err)
+	}
+	clients := &clientManager{connect: newClient, retry: clientRetryPolicy, interval: clientRetryInterval}
+
+	if *backfill {
+		runCtx, cancel := context.WithCancel(ctx)
+		ok := clients.start(runCtx)
+		cancel()
+		if !ok {
+			log.Fatalf("Could not create datastore client")
+		}
+		client := clients.Client()
+		ctx := WithKind(WithNamespace(ctx, *backfillNamespace), kind)
+		n, err := UpgradeLegacyTasks(ctx, client)
+		if err != nil {
+			log.Fatalf("Could not upgrade legacy tasks after upgrading %d: %v", n, err)
+		}
+		logInfo(nil, "Upgraded %d legacy tasks", n)
+		n, err = BackfillTasks(ctx, client)
+		if err != nil {
+			log.Fatalf("Could not backfill tasks after repairing %d: %v", n, err)
+		}
+		logInfo(nil, "Repaired %d tasks", n)
+		client.Close()
+		return
+	}
+
+	addr := listenAddrFromEnv()
+	logInfo(nil, "Starting datastore task list on %s", addr)
+
+	retry, err := retryPolicyFromEnv()
 	if err != nil {
-		log.Fatalf("failed to parse creds: %s", err)
+		log.Fatalf("Could not configure retries: %v", err)
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	timeout := defaultRequestTimeout
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid REQUEST_TIMEOUT: %v", err)
+		}
 	}
-	log.Printf("Starting datastore task list on port %s", port)
 
-	ctx := context.Background()
-	client, err := datastore.NewClient(ctx, datastore.DetectProjectID, option.WithCredentials(creds))
+	var metrics Metrics = NewPrometheusMetrics()
+	if os.Getenv("DISABLE_METRICS") == "true" {
+		metrics = NopMetrics{}
+	}
+
+	cacheTTL := defaultCacheTTL
+	if v := os.Getenv("LIST_CACHE_TTL"); v != "" {
+		if cacheTTL, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("Invalid LIST_CACHE_TTL: %v", err)
+		}
+	}
+	var cache *taskCache
+	if cacheTTL > 0 {
+		cache = newTaskCache(cacheTTL)
+	}
+
+	hook, err := webhookFromEnv()
 	if err != nil {
-		log.Fatalf("Could not create datastore client: %v", err)
+		log.Fatalf("Could not configure webhook: %v", err)
+	}
+	if hook != nil {
+		defer hook.Close()
 	}
 
-	log.Fatal(http.ListenAndServe(":"+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			// List
-			tasks, err := ListTasks(ctx, client)
-			if err != nil {
-				log.Printf("failed to read from datastore: %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to read from datastore: %s", err)
-				return
-			}
-			json.NewEncoder(w).Encode(tasks)
-		case http.MethodPost:
-			// New
-			data, err := readMsg(r.Body)
-			if err != nil {
-				log.Printf("failed to read message: %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to read message: %s", err)
-				return
-			}
+	limiter, err := rateLimiterFromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure rate limit: %v", err)
+	}
 
-			key, err := AddTask(ctx, client, data)
-			if err != nil {
-				log.Printf("failed to create task: %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to create task: %s", err)
-				return
-			}
-			fmt.Fprintf(w, "created new task with ID %d\n", key.ID)
-		case http.MethodDelete:
-			// Delete
-			idStr, err := readMsg(r.Body)
-			if err != nil {
-				log.Printf("failed to read message: %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to read message: %s", err)
-				return
-			}
-			id, err := strconv.ParseInt(idStr, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "failed to parse ID (must be int64): %s", err)
-				return
-			}
+	quota, err := taskQuotaFromEnv()
+	if err != nil {
+		log.Fatalf("Could not configure task quota: %v", err)
+	}
 
-			if err := MarkDone(ctx, client, id); err != nil {
-				log.Printf("failed to mark task done: %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "failed to mark task done: %s", err)
-			}
-			fmt.Fprintf(w, "task %d marked done\n", id)
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+	origins := corsOriginsFromEnv()
+	clients.handler = func(client *datastore.Client) http.Handler {
+		s := &server{
+			client:      client,
+			store:       &DatastoreTaskStore{Client: client, Kind: kind},
+			kind:        kind,
+			eventual:    eventual,
+			timeout:     timeout,
+			retry:       retry,
+			metrics:     metrics,
+			cache:       cache,
+			webhook:     hook,
+			limiter:     limiter,
+			quota:       quota,
+			corsOrigins: origins,
+			adminSecret: os.Getenv("ADMIN_SECRET"),
+			accessLog:   os.Getenv("ACCESS_LOG") == "true",
 		}
-	})))
+		return s.routes()
+	}
+	if exporter := otlpExporterFromEnv(); exporter != nil {
+		trace.RegisterExporter(exporter)
+		defer exporter.Close()
+	}
+
+	// Requests are answered with 503 Service Unavailable until the client
+	// has been created.
+	runCtx, stopClients := context.WithCancel(ctx)
+	go clients.start(runCtx)
+	srv := &http.Server{Addr: addr, Handler: clients}
+	// Streams last until the client disconnects, so end them to shut down.
+	srv.RegisterOnShutdown(taskEvents.closeAll)
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("Could not serve: %v", err)
+		}
+	}()
+
+	// Wait for a signal to stop, such as the SIGTERM sent by Cloud Run and
+	// Kubernetes, then let in-flight requests finish before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	logInfo(nil, "Shutting down")
+	stopClients()
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logError(nil, "Could not shut down cleanly", err)
+	}
+	if client := clients.Client(); client != nil {
+		if err := client.Close(); err != nil {
+			logError(nil, "Could not close datastore client", err)
+		}
+	}
+}
+
+// shutdownTimeout is how long main waits for in-flight requests to finish
+// after being asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// newClient creates the datastore client used by the server. When the
+// DATASTORE_EMULATOR_HOST environment variable is set, the client connects to
+// the emulator without credentials, using the project in DATASTORE_PROJECT_ID.
+// Otherwise the credentials are chosen by clientOptions. DATASTORE_DATABASE_ID
+// may only name the default database; see checkDatabaseID. Either way, the
+// client's calls are limited by callLimiterFromEnv.
+func newClient(ctx context.Context) (*datastore.Client, error) {
+	if err := checkDatabaseID(os.Getenv("DATASTORE_DATABASE_ID")); err != nil {
+		return nil, err
+	}
+	limiter, err := callLimiterFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	var opts []option.ClientOption
+	if limiter != nil {
+		opts = append(opts, limiter.clientOption())
+	}
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		return datastore.NewClient(ctx, os.Getenv("DATASTORE_PROJECT_ID"), opts...)
+	}
+
+	creds, err := clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewClient(ctx, datastore.DetectProjectID, append(opts, creds...)...)
+}
+
+// clientOptions returns the options that give the datastore client its
+// credentials. On Cloud Foundry, where VCAP_SERVICES or SERVICE_NAME is set,
+// the credentials come from parseCreds. Elsewhere, such as on GKE, Cloud Run
+// or a machine logged in with gcloud, no options are needed and the client
+// uses Application Default Credentials.
+func clientOptions() ([]option.ClientOption, error) {
+	if os.Getenv("VCAP_SERVICES") == "" && os.Getenv("SERVICE_NAME") == "" {
+		return nil, nil
+	}
+	creds, err := parseCreds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse creds: %s", err)
+	}
+	return []option.ClientOption{option.WithCredentials(creds)}, nil
+}
+
+// listenAddrFromEnv returns the address to serve on: port PORT, 8080 by
+// default, of the interface with the address HOST, or of every interface if
+// HOST is empty.
+func listenAddrFromEnv() string {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return net.JoinHostPort(os.Getenv("HOST"), port)
+}
+
+// checkDatabaseID returns an error unless id names the default database.
+// The version of cloud.google.com/go/datastore used here always connects to
+// the project's default database, so a server configured for a named
+// database must not start and silently use the default one instead.
+func checkDatabaseID(id string) error {
+	if id == "" || id == defaultDatabaseID {
+		return nil
+	}
+	return fmt.Errorf("DATASTORE_DATABASE_ID %q is not supported: only the %s database can be used", id, defaultDatabaseID)
 }
 
+// defaultDatabaseID is the ID of a project's default database.
+const defaultDatabaseID = "(default)"
+
 func parseCreds() (*google.Credentials, error) {
 	serviceName := os.Getenv("SERVICE_NAME")
 	if serviceName == "" {
@@ -142,81 +410,2403 @@ func parseCreds() (*google.Credentials, error) {
 }
 
 // [START datastore_add_entity]
-// Task is the model used to store tasks in the datastore.
+// Task is the model used to store tasks in the datastore. It is served as
+// JSON with the same field names as its datastore properties.
 type Task struct {
-	Desc    string    `datastore:"description"`
-	Created time.Time `datastore:"created"`
-	Done    bool      `datastore:"done"`
-	Id      int64     `datastore:"id"` // The integer ID used in the datastore.
+	Desc        string    `datastore:"description,noindex" json:"description"`
+	Created     time.Time `datastore:"created" json:"created"`
+	UpdatedAt   time.Time `datastore:"updated_at" json:"updated_at"` // When the task was last changed.
+	Done        bool      `datastore:"done" json:"done"`
+	CompletedAt time.Time `datastore:"completed_at,omitempty" json:"completed_at"` // When the task was last marked done.
+	CompletedBy string    `datastore:"completed_by,omitempty" json:"completed_by"` // Who marked it done, if known; see WithUser.
+	Priority    int       `datastore:"priority" json:"priority"`                   // One of the Priority constants.
+	Due         time.Time `datastore:"due,omitempty" json:"due"`                   // The zero time means no deadline.
+	Tags        []string  `datastore:"tags" json:"tags"`                           // Each tag is indexed separately.
+	Id          int64     `datastore:"id" json:"id"`                               // The integer ID used in the datastore.
+	Deleted     bool      `datastore:"deleted" json:"deleted"`                     // Whether the task is in the recycle bin.
+	DeletedAt   time.Time `datastore:"deleted_at,omitempty" json:"deleted_at"`     // When the task was soft-deleted.
+	Recurrence  string    `datastore:"recurrence,omitempty" json:"recurrence"`     // How often a recurring task is due; see SpawnDueRecurrences.
+	NextDue     time.Time `datastore:"next_due,omitempty" json:"next_due"`         // The next occurrence of a recurring task.
+	Owner       string    `datastore:"owner" json:"owner"`                         // Who the task is assigned to, if anyone.
+	Version     int       `datastore:"version" json:"version"`                     // Incremented each time the task is changed.
+	Starred     bool      `datastore:"starred" json:"starred"`                     // Starred tasks are listed first.
+	DependsOn   []int64   `datastore:"depends_on" json:"depends_on"`               // The IDs of the tasks that must be done first; see AddDependency.
+	Position    float64   `datastore:"position" json:"position"`                   // Where the task is in ListTasksByPosition; see ReorderTask.
+	Color       string    `datastore:"color,omitempty" json:"color"`               // A label color for clients to show; see normalizeColor.
+	// EstimateMinutes is the effort the task is expected to take. Zero
+	// means no estimate, and is not stored; see ListTasksUnderEstimate.
+	EstimateMinutes int `datastore:"estimate_minutes,omitempty" json:"estimate_minutes"`
+	// SnoozedUntil hides the task from ListTasks until the given time. The
+	// zero time means the task is not snoozed.
+	SnoozedUntil time.Time `datastore:"snoozed_until,omitempty" json:"snoozed_until"`
+	// Keywords are the words of the description, in lower case, for
+	// SearchTasks. They are kept up to date whenever the description is
+	// set, and are not part of the task's JSON.
+	Keywords []string `datastore:"keywords" json:"-"`
+	// DescPrefix is the first descPrefixLen bytes of the description, for
+	// sorting by description, which is not indexed. Like Keywords, it is kept
+	// up to date whenever the description is set.
+	DescPrefix string `datastore:"desc_prefix" json:"-"`
 }
 
+// Task priorities, from least to most important. Tasks stored before
+// priorities were introduced load with PriorityNone.
+const (
+	PriorityNone = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
+
 // AddTask adds a task with the given description to the datastore,
 // returning the key of the newly created entity.
 func AddTask(ctx context.Context, client *datastore.Client, desc string) (*datastore.Key, error) {
-	task := &Task{
-		Desc:    desc,
-		Created: time.Now(),
+	return CreateTask(ctx, client, &Task{Desc: desc})
+}
+
+// CreateTask adds the given task to the datastore, returning the key of the
+// newly created entity. Leading and trailing whitespace is trimmed from the
+// description, which must not then be empty. The task's creation and update
+// times are set to now, and its Id to the ID of the new entity. A zero
+// Position is set by nextPosition, placing the task last.
+func CreateTask(ctx context.Context, client *datastore.Client, task *Task) (*datastore.Key, error) {
+	if err := validateTask(task); err != nil {
+		return nil, err
+	}
+	key, err := allocateTaskKey(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := createTaskAt(ctx, client, key, task); err != nil {
+		return nil, err
 	}
-	key := datastore.IncompleteKey("Task", nil)
-	return client.Put(ctx, key, task)
+	return key, nil
 }
 
-// [END datastore_add_entity]
+// allocateTaskKey returns a complete key for a new task in the context's
+// namespace and task list. The task's ID is allocated before it is stored so
+// that its history, whose key is a child of the task's, can be written in
+// the same transaction, and so that a retried write goes to the same key.
+func allocateTaskKey(ctx context.Context, client *datastore.Client) (*datastore.Key, error) {
+	keys, err := allocateTaskKeys(ctx, client, 1)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
 
-// [START datastore_update_entity]
-// MarkDone marks the task done with the given ID.
-func MarkDone(ctx context.Context, client *datastore.Client, taskID int64) error {
-	// Create a key using the given integer ID.
-	key := datastore.IDKey("Task", taskID, nil)
+// nextPosition returns the Position that places a new task after all the
+// tasks in the context's namespace and task list: one more than the largest,
+// or 1 if there are none. Tasks added concurrently may be given the same
+// position, in which case ListTasksByPosition orders them by creation time.
+func nextPosition(ctx context.Context, client *datastore.Client) (float64, error) {
+	var last []Task
+	if _, err := client.GetAll(ctx, taskQuery(ctx).Order("-position").Limit(1), &last); err != nil {
+		return 0, err
+	}
+	if len(last) == 0 {
+		return 1, nil
+	}
+	return last[0].Position + 1, nil
+}
+
+// setPositions places the new tasks after all the stored ones, in order.
+func setPositions(ctx context.Context, client *datastore.Client, tasks []*Task) error {
+	next, err := nextPosition(ctx, client)
+	if err != nil {
+		return err
+	}
+	for i, task := range tasks {
+		task.Position = next + float64(i)
+	}
+	return nil
+}
+
+// createTaskAt validates task as CreateTask does and stores it under key,
+// which is from allocateTaskKey. It is safe to retry: if an earlier attempt
+// already stored the task, task is replaced by the stored task and nothing
+// is written.
+func createTaskAt(ctx context.Context, client *datastore.Client, key *datastore.Key, task *Task) error {
+	if err := validateTask(task); err != nil {
+		return err
+	}
+	if task.Position == 0 {
+		var err error
+		if task.Position, err = nextPosition(ctx, client); err != nil {
+			return err
+		}
+	}
 
-	// In a transaction load each task, set done to true and store.
+	created := false
 	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		var task Task
-		if err := tx.Get(key, &task); err != nil {
+		created = false
+		var existing Task
+		err := tx.Get(key, &existing)
+		if err == nil {
+			*task = existing
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
 			return err
 		}
-		task.Done = true
-		_, err := tx.Put(key, &task)
+
+		task.Created = time.Now()
+		task.UpdatedAt = task.Created
+		scheduleRecurrence(task)
+		created = true
+		if _, err := tx.Put(key, task); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, ActionCreated, task.Created)
+	})
+	if err != nil {
+		return err
+	}
+	task.Id = key.ID
+	if created {
+		publishEvent(ctx, eventAdded, key)
+	}
+	return nil
+}
+
+// [END datastore_add_entity]
+
+// DuplicateTask adds a new task with the description, tags, priority and due
+// date of the task with the given ID, returning the key of the new entity.
+// The copy is open, with its own creation time and history; everything else
+// about the original, such as its completion, is left behind. It returns
+// ErrTaskNotFound if there is no task with the ID.
+func DuplicateTask(ctx context.Context, client *datastore.Client, id int64) (*datastore.Key, error) {
+	task, err := GetTask(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	return CreateTask(ctx, client, duplicateOf(task))
+}
+
+// duplicateOf returns a new task copying the fields of task that
+// DuplicateTask copies.
+func duplicateOf(task *Task) *Task {
+	return &Task{
+		Desc:            task.Desc,
+		Tags:            append([]string(nil), task.Tags...),
+		Priority:        task.Priority,
+		Due:             task.Due,
+		Color:           task.Color,
+		EstimateMinutes: task.EstimateMinutes,
+	}
+}
+
+// validateTask trims the task's description and checks that it is ready to
+// be stored.
+func validateTask(task *Task) error {
+	desc, err := checkDesc(task.Desc)
+	if err != nil {
+		return err
+	}
+	setDesc(task, desc)
+	if task.Tags, err = normalizeTags(task.Tags); err != nil {
+		return err
+	}
+	if task.Priority < PriorityNone || task.Priority > PriorityHigh {
+		return ErrInvalidPriority
+	}
+	if task.Color, err = normalizeColor(task.Color); err != nil {
 		return err
+	}
+	if task.EstimateMinutes < 0 {
+		return ErrInvalidEstimate
+	}
+	if _, ok := recurrenceIntervals[task.Recurrence]; task.Recurrence != "" && !ok {
+		return ErrInvalidRecurrence
+	}
+	return nil
+}
+
+// CreateTaskOnce is like CreateTask, but creates at most one task for each
+// idempotency key, so that a request that is retried after its response was
+// lost does not add a duplicate. The first task created with an idempotency
+// key is recorded under that key; later calls with the same key store
+// nothing, and task is replaced by the task created first. created reports
+// whether a new task was stored.
+func CreateTaskOnce(ctx context.Context, client *datastore.Client, idempotencyKey string, task *Task) (key *datastore.Key, created bool, err error) {
+	if idempotencyKey == "" {
+		key, err = CreateTask(ctx, client, task)
+		return key, err == nil, err
+	}
+	if err := validateTask(task); err != nil {
+		return nil, false, err
+	}
+	if task.Position == 0 {
+		if task.Position, err = nextPosition(ctx, client); err != nil {
+			return nil, false, err
+		}
+	}
+	newKey, err := allocateTaskKey(ctx, client)
+	if err != nil {
+		return nil, false, err
+	}
+
+	recordKey := idempotencyRecordKey(ctx, idempotencyKey)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		created = false
+		// A task recorded under the idempotency key that has since been
+		// purged is created again.
+		var record idempotencyRecord
+		err := tx.Get(recordKey, &record)
+		if err == nil {
+			var existing Task
+			err = tx.Get(taskKey(ctx, record.TaskID), &existing)
+			if err == nil {
+				key = taskKey(ctx, record.TaskID)
+				*task = existing
+				return nil
+			}
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		key = newKey
+		task.Created = time.Now()
+		task.UpdatedAt = task.Created
+		scheduleRecurrence(task)
+		created = true
+		if _, err := tx.Put(key, task); err != nil {
+			return err
+		}
+		if _, err := tx.Put(recordKey, &idempotencyRecord{TaskID: key.ID}); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, ActionCreated, task.Created)
 	})
-	return err
+	if err != nil {
+		return nil, false, err
+	}
+	task.Id = key.ID
+	if created {
+		publishEvent(ctx, eventAdded, key)
+	}
+	return key, created, nil
 }
 
-// [END datastore_update_entity]
+// idempotencyRecord records the task created with an idempotency key. It is
+// stored under idempotencyRecordKey, so that tasks keep their allocated IDs.
+type idempotencyRecord struct {
+	TaskID int64 `datastore:"task_id,noindex"`
+}
 
-// [START datastore_retrieve_entities]
-// ListTasks returns all the tasks in ascending order of creation time.
-func ListTasks(ctx context.Context, client *datastore.Client) ([]*Task, error) {
-	var tasks []*Task
+// idempotencyRecordKey returns the key of the idempotencyRecord for the given
+// idempotency key in the context's namespace and task list.
+func idempotencyRecordKey(ctx context.Context, idempotencyKey string) *datastore.Key {
+	key := datastore.NameKey("IdempotencyKey", idempotencyKey, parentKey(ctx))
+	key.Namespace = namespace(ctx)
+	return key
+}
 
-	// Create a query to fetch all Task entities, ordered by "created".
-	query := datastore.NewQuery("Task").Order("created")
-	keys, err := client.GetAll(ctx, query, &tasks)
+// AddTaskToList adds a task with the given description to the named task
+// list, returning the key of the newly created entity.
+func AddTaskToList(ctx context.Context, client *datastore.Client, list, desc string) (*datastore.Key, error) {
+	return AddTask(WithList(ctx, list), client, desc)
+}
+
+// addTasksBatchSize is the most tasks AddTasks stores in one datastore call,
+// and AddTasksAtomic in one transaction: each is stored with an ActionCreated
+// event in its history, and a call may write at most maxBatchSize entities.
+const addTasksBatchSize = maxBatchSize / 2
+
+// AddTasks adds a task for each of the given descriptions, returning the keys
+// of the new entities in the same order. As with CreateTask, descriptions are
+// trimmed and must not be empty. The tasks are stored, each with its
+// ActionCreated event, in batches of up to addTasksBatchSize with a single
+// datastore call each, so if a batch fails the earlier ones are still added.
+func AddTasks(ctx context.Context, client *datastore.Client, descs []string) ([]*datastore.Key, error) {
+	tasks, err := newTasks(ctx, client, descs)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set the id field on each Task from the corresponding key.
-	for i, key := range keys {
-		tasks[i].Id = key.ID
+	var keys []*datastore.Key
+	for start := 0; start < len(tasks); start += addTasksBatchSize {
+		end := start + addTasksBatchSize
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		batch := tasks[start:end]
+		batchKeys, err := allocateTaskKeys(ctx, client, len(batch))
+		if err != nil {
+			return nil, err
+		}
+
+		// Each task is followed by its event, so that an error for either
+		// is identified by the task's index.
+		entityKeys := make([]*datastore.Key, 0, 2*len(batch))
+		entities := make([]interface{}, 0, 2*len(batch))
+		for i, task := range batch {
+			eventKey, event := newEvent(batchKeys[i], ActionCreated, task.Created)
+			entityKeys = append(entityKeys, batchKeys[i], eventKey)
+			entities = append(entities, task, event)
+		}
+		_, err = client.PutMulti(ctx, entityKeys, entities)
+		if me, ok := err.(datastore.MultiError); ok {
+			failed := make(datastore.MultiError, len(tasks))
+			for i, err := range me {
+				if err != nil {
+					failed[start+i/2] = err
+				}
+			}
+			return nil, describeMultiError("add", failed)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batchKeys...)
+	}
+	publishEvent(ctx, eventAdded, keys...)
+	return keys, nil
+}
+
+// ErrBatchTooLarge is returned by AddTasksAtomic when it is given more tasks
+// than fit in one transaction.
+var ErrBatchTooLarge = fmt.Errorf("at most %d tasks can be added in one transaction", addTasksBatchSize)
+
+// AddTasksAtomic adds a task for each of the given descriptions in a single
+// transaction, so that either all of the tasks are added or, if any fails,
+// none are. Each task is added with its ActionCreated event. It returns the
+// keys of the new entities in the same order. As with CreateTask,
+// descriptions are trimmed and must not be empty, and there may be at most
+// addTasksBatchSize of them.
+func AddTasksAtomic(ctx context.Context, client *datastore.Client, descs []string) ([]*datastore.Key, error) {
+	if len(descs) > addTasksBatchSize {
+		return nil, ErrBatchTooLarge
+	}
+	tasks, err := newTasks(ctx, client, descs)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := allocateTaskKeys(ctx, client, len(tasks))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		for i, task := range tasks {
+			if _, err := tx.Put(keys[i], task); err != nil {
+				return err
+			}
+			if err := recordEvent(tx, keys[i], ActionCreated, task.Created); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	publishEvent(ctx, eventAdded, keys...)
+	return keys, nil
+}
 
+// newTasks returns a new task for each of the given descriptions, checked as
+// CreateTask does and placed after the existing tasks, for AddTasks and
+// AddTasksAtomic.
+func newTasks(ctx context.Context, client *datastore.Client, descs []string) ([]*Task, error) {
+	now := time.Now()
+	tasks := make([]*Task, len(descs))
+	for i, desc := range descs {
+		desc, err := checkDesc(desc)
+		if err != nil {
+			return nil, err
+		}
+		tasks[i] = &Task{Created: now, UpdatedAt: now}
+		setDesc(tasks[i], desc)
+	}
+	if err := setPositions(ctx, client, tasks); err != nil {
+		return nil, err
+	}
 	return tasks, nil
 }
 
-// [END datastore_retrieve_entities]
+// allocateTaskKeys returns n complete keys for new tasks, as allocateTaskKey
+// does.
+func allocateTaskKeys(ctx context.Context, client *datastore.Client, n int) ([]*datastore.Key, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = newTaskKey(ctx)
+	}
+	return client.AllocateIDs(ctx, keys)
+}
 
-// [START datastore_delete_entity]
-// DeleteTask deletes the task with the given ID.
-func DeleteTask(ctx context.Context, client *datastore.Client, taskID int64) error {
-	return client.Delete(ctx, datastore.IDKey("Task", taskID, nil))
+// describeMultiError summarizes the failures in a datastore.MultiError from a
+// batch operation, identifying each failed item by its index in the batch.
+func describeMultiError(op string, me datastore.MultiError) error {
+	var msgs []string
+	for i, err := range me {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("task %d: %v", i, err))
+		}
+	}
+	return fmt.Errorf("failed to %s %d of %d tasks: %s", op, len(msgs), len(me), strings.Join(msgs, "; "))
 }
 
-func readMsg(r io.Reader) (string, error) {
-	var buf bytes.Buffer
-	if _, err := io.CopyN(&buf, r, 256); err != nil && err != io.EOF {
-		return "", err
+type namespaceKey struct{}
+
+// WithNamespace returns a copy of ctx in which the task functions act on the
+// given datastore namespace, isolating its tasks from those in every other
+// namespace. Without it they use the default namespace.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// namespace returns the datastore namespace set by WithNamespace.
+func namespace(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey{}).(string)
+	return ns
+}
+
+type kindKey struct{}
+
+// defaultKind is the datastore kind of tasks, unless WithKind sets another.
+const defaultKind = "Task"
+
+// WithKind returns a copy of ctx in which the task functions store and query
+// entities of the given datastore kind rather than Task, so that the same
+// code can keep, say, reminders or notes apart from tasks. Only the kind of
+// the tasks themselves changes; their history, for example, is still kept
+// in TaskEvent entities. The composite indexes in index.yaml are for the
+// Task kind, so another kind needs a copy of each that it uses.
+func WithKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, kindKey{}, kind)
+}
+
+// taskKind returns the datastore kind set by WithKind, or defaultKind.
+func taskKind(ctx context.Context) string {
+	if kind, _ := ctx.Value(kindKey{}).(string); kind != "" {
+		return kind
+	}
+	return defaultKind
+}
+
+// checkKind returns an error unless kind is empty, meaning defaultKind, or a
+// kind name that datastore accepts for entities: one that is not reserved,
+// as kinds starting with two underscores are, and not too long.
+func checkKind(kind string) error {
+	if strings.HasPrefix(kind, "__") || len(kind) > 1500 {
+		return fmt.Errorf("invalid kind %q (must not start with __ or exceed 1500 bytes)", kind)
+	}
+	return nil
+}
+
+type listKey struct{}
+
+// WithList returns a copy of ctx in which the task functions act on the tasks
+// in the named task list. Each list is a TaskList key that is the parent of
+// its tasks' keys, so queries within a list are ancestor queries and are
+// strongly consistent. No TaskList entity is stored; the key exists only to
+// group its tasks.
+//
+// Without a list, new tasks have no parent and queries match the tasks in
+// every list. Tasks in a list can only be found by ID within that list.
+func WithList(ctx context.Context, list string) context.Context {
+	return context.WithValue(ctx, listKey{}, list)
+}
+
+// listName returns the task list set by WithList.
+func listName(ctx context.Context) string {
+	list, _ := ctx.Value(listKey{}).(string)
+	return list
+}
+
+type consistencyKey struct{}
+
+// WithEventualConsistency returns a copy of ctx in which the task functions'
+// queries within a task list are eventually consistent, like the queries
+// that span task lists. They may then miss changes made shortly before, but
+// are faster and are not held up by concurrent writes to the list. Reads by
+// ID are strongly consistent either way.
+func WithEventualConsistency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, true)
+}
+
+// eventuallyConsistent reports whether ctx is from WithEventualConsistency.
+func eventuallyConsistent(ctx context.Context) bool {
+	eventual, _ := ctx.Value(consistencyKey{}).(bool)
+	return eventual
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx in which the task functions that mark tasks
+// done record user as the task's CompletedBy. Without it, CompletedBy is left
+// empty.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// userName returns the user set by WithUser.
+func userName(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// parentKey returns the key of the context's task list, or nil if there is
+// none.
+func parentKey(ctx context.Context) *datastore.Key {
+	list := listName(ctx)
+	if list == "" {
+		return nil
+	}
+	key := datastore.NameKey("TaskList", list, nil)
+	key.Namespace = namespace(ctx)
+	return key
+}
+
+// taskKey returns the key of the task with the given ID in the context's
+// namespace and task list.
+func taskKey(ctx context.Context, taskID int64) *datastore.Key {
+	key := datastore.IDKey(taskKind(ctx), taskID, parentKey(ctx))
+	key.Namespace = namespace(ctx)
+	return key
+}
+
+// newTaskKey returns an incomplete key for a new task in the context's
+// namespace and task list.
+func newTaskKey(ctx context.Context) *datastore.Key {
+	key := datastore.IncompleteKey(taskKind(ctx), parentKey(ctx))
+	key.Namespace = namespace(ctx)
+	return key
+}
+
+// taskQuery returns a query for tasks in the context's namespace, limited to
+// the context's task list if it has one.
+func taskQuery(ctx context.Context) *datastore.Query {
+	return scopeQuery(ctx, datastore.NewQuery(taskKind(ctx)))
+}
+
+// scopeQuery limits query to the context's namespace and task list, with the
+// context's consistency.
+func scopeQuery(ctx context.Context, query *datastore.Query) *datastore.Query {
+	query = query.Namespace(namespace(ctx))
+	if parent := parentKey(ctx); parent != nil {
+		query = query.Ancestor(parent)
+		if eventuallyConsistent(ctx) {
+			query = query.EventualConsistency()
+		}
+	}
+	return query
+}
+
+// ErrTaskNotFound is returned when no task exists with the requested ID.
+var ErrTaskNotFound = errors.New("task not found")
+
+// ErrVersionConflict is returned when a task is to be changed only if it has
+// a given version, and it has been changed since.
+var ErrVersionConflict = errors.New("task has been changed since the expected version")
+
+// checkVersion returns ErrVersionConflict if version is not nil and differs
+// from the task's version.
+func checkVersion(task *Task, version *int) error {
+	if version != nil && task.Version != *version {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// ErrInvalidPriority is returned when a task's priority is not one of the
+// Priority constants.
+var ErrInvalidPriority = errors.New("task priority must be between 0 (none) and 3 (high)")
+
+// ErrInvalidEstimate is returned when a task's estimate is negative.
+var ErrInvalidEstimate = errors.New("task estimate must not be negative")
+
+// taskColors are the named colors a task's Color can be.
+var taskColors = []string{"red", "orange", "yellow", "green", "blue", "purple", "pink", "gray"}
+
+// hexColor matches the other colors a task's Color can be, such as "#1e90ff".
+var hexColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// ErrInvalidColor is returned when a task's color is neither one of
+// taskColors nor a hex color.
+var ErrInvalidColor = fmt.Errorf("task color must be one of %s, or a hex color such as #1e90ff", strings.Join(taskColors, ", "))
+
+// normalizeColor returns color trimmed of surrounding space and in lower
+// case, or ErrInvalidColor if it is neither empty, for no color, nor one of
+// taskColors nor a hex color.
+func normalizeColor(color string) (string, error) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color == "" || hexColor.MatchString(color) {
+		return color, nil
+	}
+	for _, c := range taskColors {
+		if color == c {
+			return color, nil
+		}
+	}
+	return "", ErrInvalidColor
+}
+
+// maxTagLen is the longest tag, in bytes, and maxTaskTags the most tags a
+// task can have.
+const (
+	maxTagLen   = 100
+	maxTaskTags = 20
+)
+
+// ErrTagTooLong is returned when a task's tag is longer than maxTagLen bytes.
+var ErrTagTooLong = fmt.Errorf("tags must not exceed %d bytes", maxTagLen)
+
+// ErrTooManyTaskTags is returned when a task would have more than
+// maxTaskTags tags.
+var ErrTooManyTaskTags = fmt.Errorf("a task can have at most %d tags", maxTaskTags)
+
+// normalizeTags returns the tags trimmed of surrounding space and in lower
+// case, in their original order without the empty and repeated ones, so that
+// "Work" and " work " are the same tag. It returns ErrTagTooLong or
+// ErrTooManyTaskTags if the tags cannot be stored.
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLen {
+			return nil, ErrTagTooLong
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTaskTags {
+		return nil, ErrTooManyTaskTags
+	}
+	return normalized, nil
+}
+
+// sameTags reports whether a and b hold the same tags in the same order.
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrEmptyDescription is returned when a task would be left without a
+// description.
+var ErrEmptyDescription = errors.New("task description must not be empty")
+
+// maxDescLen is the longest task description, in bytes. Descriptions are not
+// indexed, so they are not bound by maxIndexedLen.
+const maxDescLen = 16 << 10
+
+// maxIndexedLen is the longest string, in bytes, that datastore indexes.
+const maxIndexedLen = 1500
+
+// descPrefixLen is the most bytes of a description kept in a task's
+// DescPrefix.
+const descPrefixLen = 500
+
+// setDesc sets the task's description, together with its Keywords and
+// DescPrefix.
+func setDesc(task *Task, desc string) {
+	task.Desc = desc
+	task.Keywords = keywords(desc)
+	task.DescPrefix = descPrefix(desc)
+}
+
+// descPrefix returns the first descPrefixLen bytes of desc, shortened further
+// if need be so as not to split a UTF-8 encoded character.
+func descPrefix(desc string) string {
+	if len(desc) <= descPrefixLen {
+		return desc
+	}
+	n := descPrefixLen
+	for n > 0 && !utf8.RuneStart(desc[n]) {
+		n--
+	}
+	return desc[:n]
+}
+
+// ErrDescriptionTooLong is returned when a task's description is longer than
+// maxDescLen bytes.
+var ErrDescriptionTooLong = fmt.Errorf("task description must not exceed %d bytes", maxDescLen)
+
+// checkDesc returns desc with surrounding space trimmed, or
+// ErrEmptyDescription or ErrDescriptionTooLong if it cannot be stored.
+func checkDesc(desc string) (string, error) {
+	desc = strings.TrimSpace(desc)
+	if desc == "" {
+		return "", ErrEmptyDescription
+	}
+	if len(desc) > maxDescLen {
+		return "", ErrDescriptionTooLong
+	}
+	return desc, nil
+}
+
+// GetTask returns the task with the given ID. Like every lookup by key, it is
+// strongly consistent: it sees every change committed before it was called.
+func GetTask(ctx context.Context, client *datastore.Client, taskID int64) (*Task, error) {
+	key := taskKey(ctx, taskID)
+
+	var task Task
+	if err := client.Get(ctx, key, &task); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+	task.Id = key.ID
+
+	return &task, nil
+}
+
+// GetTasks returns the tasks with the given IDs in a single datastore call.
+// The result has an entry for each ID, in the same order, which is nil if
+// no task has that ID.
+func GetTasks(ctx context.Context, client *datastore.Client, ids []int64) ([]*Task, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = taskKey(ctx, id)
+	}
+
+	tasks := make([]*Task, len(ids))
+	if err := client.GetMulti(ctx, keys, tasks); err != nil {
+		me, ok := err.(datastore.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for i, err := range me {
+			if err == datastore.ErrNoSuchEntity {
+				tasks[i] = nil
+			} else if err != nil {
+				return nil, describeMultiError("get", me)
+			}
+		}
+	}
+
+	for i, task := range tasks {
+		if task != nil {
+			task.Id = ids[i]
+		}
+	}
+	return tasks, nil
+}
+
+// [START datastore_update_entity]
+// MarkDone marks the task done with the given ID. If the task is already
+// done, nothing is stored and its original completion time is kept, so that
+// retried calls are cheap.
+func MarkDone(ctx context.Context, client *datastore.Client, taskID int64) error {
+	_, err := markDone(ctx, client, taskID)
+	return err
+}
+
+// markDone marks the task done as MarkDone does, and reports whether it
+// changed the task: false if the task was already done.
+func markDone(ctx context.Context, client *datastore.Client, taskID int64) (bool, error) {
+	return setDone(ctx, client, taskID, true, nil)
+}
+
+// MarkUndone reopens the task with the given ID.
+func MarkUndone(ctx context.Context, client *datastore.Client, taskID int64) error {
+	return SetDone(ctx, client, taskID, false)
+}
+
+// MarkDoneIfVersion marks the task done with the given ID if it still has the
+// given version, and otherwise returns ErrVersionConflict.
+func MarkDoneIfVersion(ctx context.Context, client *datastore.Client, taskID int64, version int) error {
+	_, err := setDone(ctx, client, taskID, true, &version)
+	return err
+}
+
+// SetDone sets whether the task with the given ID is done, recording the
+// completion time and the user set by WithUser when it is done and clearing
+// them otherwise. The task's UpdatedAt is set to now. If the task is already
+// done, or not done, as requested, it is left unchanged and not stored again.
+func SetDone(ctx context.Context, client *datastore.Client, taskID int64, done bool) error {
+	_, err := setDone(ctx, client, taskID, done, nil)
+	return err
+}
+
+// setDone implements SetDone, first checking the task's version if version is
+// not nil, and reports whether it changed the task.
+func setDone(ctx context.Context, client *datastore.Client, taskID int64, done bool, version *int) (changed bool, err error) {
+	// Create a key using the given integer ID.
+	key := taskKey(ctx, taskID)
+
+	// In a transaction load each task, set done and store.
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		if err := checkVersion(&task, version); err != nil {
+			return err
+		}
+		if changed = task.Done != done; !changed {
+			return nil
+		}
+		task.Done = done
+		task.Version++
+		task.UpdatedAt = time.Now()
+		action := ActionDone
+		if done {
+			task.CompletedAt = task.UpdatedAt
+			task.CompletedBy = userName(ctx)
+		} else {
+			task.CompletedAt = time.Time{}
+			task.CompletedBy = ""
+			action = ActionReopened
+		}
+		if _, err := tx.Put(key, &task); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, action, task.UpdatedAt)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return false, ErrTaskNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	if done && changed {
+		publishEvent(ctx, eventCompleted, key)
+	}
+	return changed, nil
+}
+
+// [END datastore_update_entity]
+
+// UpdateTaskDescription replaces the description of the task with the given
+// ID and sets its UpdatedAt to now. As with CreateTask, the new description
+// is trimmed and must not be empty.
+func UpdateTaskDescription(ctx context.Context, client *datastore.Client, taskID int64, newDesc string) error {
+	newDesc, err := checkDesc(newDesc)
+	if err != nil {
+		return err
+	}
+
+	key := taskKey(ctx, taskID)
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		setDesc(&task, newDesc)
+		task.Version++
+		task.UpdatedAt = time.Now()
+		if _, err := tx.Put(key, &task); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, ActionEdited, task.UpdatedAt, "description")
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// TaskPatch is a partial update of a task for UpdateTask. A nil field leaves
+// the task's value unchanged.
+type TaskPatch struct {
+	Desc *string
+	Done *bool
+	Due  *time.Time // The zero time removes the deadline.
+	Tags *[]string  // Replaces all the tags; normalized as by normalizeTags.
+	// Position moves the task in ListTasksByPosition; see ReorderTask.
+	Position *float64
+	Color    *string // The empty string removes the color; see normalizeColor.
+	// EstimateMinutes replaces the task's estimate; 0 removes it.
+	EstimateMinutes *int
+
+	// Version, if not nil, is the version the task must have for the patch
+	// to be applied.
+	Version *int
+}
+
+// UpdateTask applies patch to the task with the given ID in a transaction and
+// returns the updated task. As with CreateTask, a new description is trimmed
+// and must not be empty, and new tags and colors are normalized. The task is
+// only stored, with its UpdatedAt set to now and its version incremented, if
+// the patch changes it. If the patch has a version that the task no longer
+// has, UpdateTask returns ErrVersionConflict.
+func UpdateTask(ctx context.Context, client *datastore.Client, taskID int64, patch TaskPatch) (*Task, error) {
+	task, _, err := updateTask(ctx, client, taskID, patch)
+	return task, err
+}
+
+// updateTask implements UpdateTask, and reports whether the patch marked the
+// task done.
+func updateTask(ctx context.Context, client *datastore.Client, taskID int64, patch TaskPatch) (*Task, bool, error) {
+	var desc string
+	if patch.Desc != nil {
+		var err error
+		if desc, err = checkDesc(*patch.Desc); err != nil {
+			return nil, false, err
+		}
+	}
+	if patch.Position != nil && (math.IsNaN(*patch.Position) || math.IsInf(*patch.Position, 0)) {
+		return nil, false, ErrInvalidPosition
+	}
+	var tags []string
+	if patch.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(*patch.Tags); err != nil {
+			return nil, false, err
+		}
+	}
+	if patch.EstimateMinutes != nil && *patch.EstimateMinutes < 0 {
+		return nil, false, ErrInvalidEstimate
+	}
+	var color string
+	if patch.Color != nil {
+		var err error
+		if color, err = normalizeColor(*patch.Color); err != nil {
+			return nil, false, err
+		}
+	}
+
+	key := taskKey(ctx, taskID)
+	var (
+		task      Task
+		completed bool
+	)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		task, completed = Task{}, false
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		if err := checkVersion(&task, patch.Version); err != nil {
+			return err
+		}
+
+		// The history records a change to done, or else an edit of the
+		// other fields.
+		var edited []string
+		action := ActionEdited
+		if patch.Desc != nil && task.Desc != desc {
+			setDesc(&task, desc)
+			edited = append(edited, "description")
+		}
+		now := time.Now()
+		if patch.Done != nil && task.Done != *patch.Done {
+			task.Done = *patch.Done
+			if task.Done {
+				task.CompletedAt = now
+				task.CompletedBy = userName(ctx)
+				completed = true
+				action = ActionDone
+			} else {
+				task.CompletedAt = time.Time{}
+				task.CompletedBy = ""
+				action = ActionReopened
+			}
+		}
+		if patch.Due != nil && !task.Due.Equal(*patch.Due) {
+			task.Due = *patch.Due
+			edited = append(edited, "due")
+		}
+		if patch.Tags != nil && !sameTags(task.Tags, tags) {
+			task.Tags = tags
+			edited = append(edited, "tags")
+		}
+		if patch.Position != nil && task.Position != *patch.Position {
+			task.Position = *patch.Position
+			edited = append(edited, "position")
+		}
+		if patch.Color != nil && task.Color != color {
+			task.Color = color
+			edited = append(edited, "color")
+		}
+		if patch.EstimateMinutes != nil && task.EstimateMinutes != *patch.EstimateMinutes {
+			task.EstimateMinutes = *patch.EstimateMinutes
+			edited = append(edited, "estimate_minutes")
+		}
+		if action == ActionEdited && edited == nil {
+			return nil
+		}
+
+		task.Version++
+		task.UpdatedAt = now
+		if _, err := tx.Put(key, &task); err != nil {
+			return err
+		}
+		return recordEvent(tx, key, action, now, edited...)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, false, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	task.Id = key.ID
+	if completed {
+		publishEvent(ctx, eventCompleted, key)
+	}
+	return &task, completed, nil
+}
+
+// [START datastore_retrieve_entities]
+// ListTasks returns all the tasks that have not been soft-deleted or snoozed
+// with SnoozeTask, starred tasks first, each in ascending order of creation
+// time. The query requires the composite index on deleted, starred and
+// created defined in index.yaml. Tasks stored before soft deletion or
+// starring were introduced lack the deleted or starred property and are left
+// out until UpgradeLegacyTasks is run, as the -backfill flag does.
+func ListTasks(ctx context.Context, client *datastore.Client) ([]*Task, error) {
+	var tasks []*Task
+
+	// Create a query to fetch all live Task entities, starred ones first,
+	// ordered by "created".
+	query := taskQuery(ctx).Filter("deleted =", false).Order("-starred").Order("created")
+	keys, err := client.GetAll(ctx, query, &tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the id field on each Task from the corresponding key.
+	for i, key := range keys {
+		tasks[i].Id = key.ID
+	}
+
+	return hideSnoozed(tasks, time.Now()), nil
+}
+
+// hideSnoozed returns the tasks that are not snoozed at now, reusing the
+// tasks slice. Snoozed tasks are filtered here rather than in the query
+// because a "snoozed_until <=" filter would drop every task that was never
+// snoozed, which has no snoozed_until property, and would have to be the
+// query's first sort order.
+func hideSnoozed(tasks []*Task, now time.Time) []*Task {
+	active := tasks[:0]
+	for _, t := range tasks {
+		if !t.SnoozedUntil.After(now) {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// [END datastore_retrieve_entities]
+
+// IterateTasks calls fn for each task, including soft-deleted ones, in
+// ascending order of creation time, with its Id set. The tasks are read from
+// the datastore as they are needed rather than loaded all at once, so there
+// can be more of them than fit in memory. If fn returns an error, IterateTasks
+// stops and returns it.
+func IterateTasks(ctx context.Context, client *datastore.Client, fn func(*Task) error) error {
+	return iterateTasks(ctx, client, taskQuery(ctx).Order("created"), func(_ *datastore.Key, task *Task) error {
+		return fn(task)
+	})
+}
+
+// iterateTasks calls fn with the key of each task matched by query and the
+// task, as IterateTasks does.
+func iterateTasks(ctx context.Context, client *datastore.Client, query *datastore.Query, fn func(*datastore.Key, *Task) error) error {
+	it := client.Run(ctx, query)
+	for {
+		var task Task
+		key, err := it.Next(&task)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		task.Id = key.ID
+		if err := fn(key, &task); err != nil {
+			return err
+		}
+	}
+}
+
+// ListAllTasks returns all the tasks, including soft-deleted ones, in
+// ascending order of creation time.
+func ListAllTasks(ctx context.Context, client *datastore.Client) ([]*Task, error) {
+	return getTasks(ctx, client, taskQuery(ctx).Order("created"))
+}
+
+// getTasks runs the query and returns the matching tasks with their Id set.
+func getTasks(ctx context.Context, client *datastore.Client, query *datastore.Query) ([]*Task, error) {
+	var tasks []*Task
+	keys, err := client.GetAll(ctx, query, &tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		tasks[i].Id = key.ID
+	}
+
+	return tasks, nil
+}
+
+// getLiveTasks runs the query and returns the matching tasks that have not
+// been soft-deleted, with their Id set. The filtered listings leave out
+// soft-deleted tasks here rather than in their queries, which would
+// otherwise each need a composite index that also includes deleted.
+func getLiveTasks(ctx context.Context, client *datastore.Client, query *datastore.Query) ([]*Task, error) {
+	tasks, err := getTasks(ctx, client, query)
+	if err != nil {
+		return nil, err
+	}
+
+	live := tasks[:0]
+	for _, task := range tasks {
+		if !task.Deleted {
+			live = append(live, task)
+		}
+	}
+	return live, nil
+}
+
+// ListTasksInList returns the tasks in the named task list in ascending order
+// of creation time. Unlike ListTasks, the results are strongly consistent.
+// The query requires the ancestor index on created defined in index.yaml.
+func ListTasksInList(ctx context.Context, client *datastore.Client, list string) ([]*Task, error) {
+	return ListTasks(WithList(ctx, list), client)
+}
+
+// ListTasksOrdered returns all the tasks that have not been soft-deleted,
+// sorted by the given property, in descending order if desc is set. Tasks
+// with equal values are in ascending order of creation time, which requires a
+// composite index on the property and created for each direction; see
+// index.yaml.
+//
+// Datastore leaves entities without the property out of queries ordered by
+// it, so tasks stored before the property was introduced are not returned
+// until they are next written or, for desc_prefix, backfilled.
+func ListTasksOrdered(ctx context.Context, client *datastore.Client, property string, desc bool) ([]*Task, error) {
+	order := property
+	if desc {
+		order = "-" + property
+	}
+	query := taskQuery(ctx).Order(order)
+	if property != "created" {
+		query = query.Order("created")
+	}
+	return getLiveTasks(ctx, client, query)
+}
+
+// ErrInvalidPosition is returned when a task's position is not a finite
+// number.
+var ErrInvalidPosition = errors.New("task position must be a finite number")
+
+// ReorderTask moves the task with the given ID to newPosition in
+// ListTasksByPosition. To move a task between two others, give it the
+// midpoint of their positions; no other task needs to change. Tasks with
+// the same position are ordered by creation time.
+func ReorderTask(ctx context.Context, client *datastore.Client, id int64, newPosition float64) error {
+	_, err := UpdateTask(ctx, client, id, TaskPatch{Position: &newPosition})
+	return err
+}
+
+// ListTasksByPosition returns all the tasks that have not been soft-deleted,
+// in ascending order of position, as set by ReorderTask. Like
+// ListTasksOrdered, it requires the composite index on position and created
+// defined in index.yaml.
+func ListTasksByPosition(ctx context.Context, client *datastore.Client) ([]*Task, error) {
+	return ListTasksOrdered(ctx, client, "position", false)
+}
+
+// ListTasksByPriority returns all the tasks that have not been soft-deleted,
+// most important first. Tasks of equal priority are in ascending order of
+// creation time.
+func ListTasksByPriority(ctx context.Context, client *datastore.Client) ([]*Task, error) {
+	return ListTasksOrdered(ctx, client, "priority", true)
+}
+
+// ListTasksByTag returns the tasks that have the given tag and have not been
+// soft-deleted, in ascending order of creation time. The query requires the
+// composite index on tags and created defined in index.yaml.
+func ListTasksByTag(ctx context.Context, client *datastore.Client, tag string) ([]*Task, error) {
+	// An equality filter on a list property matches if any element is equal.
+	query := taskQuery(ctx).Filter("tags =", tag).Order("created")
+	return getLiveTasks(ctx, client, query)
+}
+
+// maxTagFilters is the most tags ListTasksByAllTags accepts. Datastore limits
+// the number of filters in a query, and each equality filter on tags adds
+// another index scan to merge.
+const maxTagFilters = 10
+
+// ErrTooManyTags is returned by ListTasksByAllTags when it is given more than
+// maxTagFilters tags.
+var ErrTooManyTags = fmt.Errorf("at most %d tags can be queried at once", maxTagFilters)
+
+// ListTasksByAllTags returns the tasks that have every one of the given tags
+// and have not been soft-deleted, in ascending order of creation time.
+// Repeated equality filters on a list property match entities with an
+// element equal to each value, so each tag adds a filter. Without a sort
+// order, datastore answers the query by merging the built-in index on tags,
+// so no composite index is needed and the tasks are sorted after they are
+// read.
+func ListTasksByAllTags(ctx context.Context, client *datastore.Client, tags []string) ([]*Task, error) {
+	if len(tags) > maxTagFilters {
+		return nil, ErrTooManyTags
+	}
+	query := taskQuery(ctx)
+	for _, tag := range tags {
+		query = query.Filter("tags =", tag)
+	}
+	tasks, err := getLiveTasks(ctx, client, query)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Created.Before(tasks[j].Created)
+	})
+	return tasks, nil
+}
+
+// TagCounts returns how many of the tasks that have not been soft-deleted
+// have each tag. Datastore cannot group results, so the counts are tallied as
+// the results of a projection query on tags are read, without holding the
+// tasks in memory. The projection returns one result for each of a task's
+// tags, and none for a task without tags. The query requires the composite
+// index on deleted and tags defined in index.yaml.
+func TagCounts(ctx context.Context, client *datastore.Client) (map[string]int, error) {
+	query := taskQuery(ctx).Filter("deleted =", false).Project("tags")
+	counts := make(map[string]int)
+	it := client.Run(ctx, query)
+	for {
+		var row struct {
+			Tag string `datastore:"tags"`
+		}
+		_, err := it.Next(&row)
+		if err == iterator.Done {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		counts[row.Tag]++
+	}
+}
+
+// TagStatus is the number of open and done tasks with a tag.
+type TagStatus struct {
+	Open int `json:"open"`
+	Done int `json:"done"`
+}
+
+// TagStatusBreakdown returns how many of the tasks that have not been
+// soft-deleted have each tag, split into open and done tasks. Like
+// TagCounts, it tallies the results of a projection query, on tags and done,
+// as they are read. The query requires the composite index on deleted, done
+// and tags defined in index.yaml.
+func TagStatusBreakdown(ctx context.Context, client *datastore.Client) (map[string]TagStatus, error) {
+	query := taskQuery(ctx).Filter("deleted =", false).Project("done", "tags")
+	breakdown := make(map[string]TagStatus)
+	it := client.Run(ctx, query)
+	for {
+		var row struct {
+			Done bool   `datastore:"done"`
+			Tag  string `datastore:"tags"`
+		}
+		_, err := it.Next(&row)
+		if err == iterator.Done {
+			return breakdown, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		status := breakdown[row.Tag]
+		if row.Done {
+			status.Done++
+		} else {
+			status.Open++
+		}
+		breakdown[row.Tag] = status
+	}
+}
+
+// ErrEmptySearch is returned by SearchTasks when the search term has no words
+// to search for.
+var ErrEmptySearch = errors.New("search term must contain a word")
+
+// SearchTasks returns the tasks that have not been soft-deleted and whose
+// descriptions contain every word of term, in ascending order of creation
+// time. Words are compared case-insensitively but only as whole words:
+// datastore cannot search for substrings, so "milk" finds "buy milk" but
+// "mil" does not. Tasks whose descriptions were last set before keywords
+// were introduced are never found. As with ListTasksByAllTags, each word adds
+// an equality filter on the keywords list, so there may be at most
+// maxTagFilters words and no composite index is needed.
+func SearchTasks(ctx context.Context, client *datastore.Client, term string) ([]*Task, error) {
+	words := keywords(term)
+	if len(words) == 0 {
+		return nil, ErrEmptySearch
+	}
+	if len(words) > maxTagFilters {
+		return nil, fmt.Errorf("at most %d words can be searched for at once", maxTagFilters)
+	}
+	query := taskQuery(ctx).Filter("deleted =", false)
+	for _, word := range words {
+		query = query.Filter("keywords =", word)
+	}
+	tasks, err := getTasks(ctx, client, query)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Created.Before(tasks[j].Created)
+	})
+	return tasks, nil
+}
+
+// keywords returns the distinct words of s in lower case, in the order they
+// first appear, other than those too long to index. A word is a run of
+// letters and digits.
+func keywords(s string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		// Datastore cannot index a word longer than maxIndexedLen.
+		if !seen[word] && len(word) <= maxIndexedLen {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// ListTasksByOwner returns the tasks assigned to owner that have not been
+// soft-deleted, in ascending order of creation time. The query requires the
+// composite index on owner and created defined in index.yaml.
+func ListTasksByOwner(ctx context.Context, client *datastore.Client, owner string) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("owner =", owner).Order("created")
+	return getLiveTasks(ctx, client, query)
+}
+
+// ListTasksUnderEstimate returns the open tasks, other than those in the
+// recycle bin, estimated to take at most maxMinutes, quickest first: the
+// quick wins that can be done now. Tasks without an estimate are left out,
+// since their effort is unknown. An estimate of zero is not stored, and
+// datastore leaves entities without the property out of an inequality
+// filter, so the query itself skips them. It requires the composite index on
+// done and estimate_minutes defined in index.yaml.
+func ListTasksUnderEstimate(ctx context.Context, client *datastore.Client, maxMinutes int) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("done =", false).Filter("estimate_minutes <=", maxMinutes).Order("estimate_minutes")
+	return getLiveTasks(ctx, client, query)
+}
+
+// ListOverdueTasks returns the open tasks that were due before now and have
+// not been soft-deleted, earliest deadline first. Tasks without a due date
+// are never overdue: the due property is omitted when it is zero, and
+// datastore leaves entities without the property out of the query. The query
+// requires the composite index on done and due defined in index.yaml.
+func ListOverdueTasks(ctx context.Context, client *datastore.Client, now time.Time) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("done =", false).Filter("due <", now).Order("due")
+	return getLiveTasks(ctx, client, query)
+}
+
+// ListTasksDueToday returns the tasks due on the day, in loc, that contains
+// now and that have not been soft-deleted, earliest deadline first. The
+// query is served by the built-in index on due.
+func ListTasksDueToday(ctx context.Context, client *datastore.Client, loc *time.Location, now time.Time) ([]*Task, error) {
+	start, end := dayBounds(now, loc)
+	query := taskQuery(ctx).Filter("due >=", start).Filter("due <", end).Order("due")
+	return getLiveTasks(ctx, client, query)
+}
+
+// dayBounds returns the start of the day, in loc, that contains t, and the
+// start of the next day. Days are not always 24 hours long: on the days that
+// daylight saving time begins or ends they are an hour shorter or longer.
+func dayBounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// ListTaskDescriptions returns the descriptions of the tasks that have not
+// been soft-deleted, in alphabetical order. Descriptions are not indexed, so
+// they cannot be projected and the whole tasks are read. The query orders
+// them by their description prefix, which requires the composite indexes on
+// deleted and desc_prefix defined in index.yaml. Descriptions that share a
+// prefix are then sorted in full. Tasks stored without a prefix are left out
+// until -backfill adds it.
+func ListTaskDescriptions(ctx context.Context, client *datastore.Client) ([]string, error) {
+	var tasks []*Task
+	query := taskQuery(ctx).Filter("deleted =", false).Order("desc_prefix")
+	if _, err := client.GetAll(ctx, query, &tasks); err != nil {
+		return nil, err
+	}
+
+	descs := make([]string, len(tasks))
+	for i, task := range tasks {
+		descs[i] = task.Desc
+	}
+	sort.Strings(descs)
+	return descs, nil
+}
+
+// ListTaskIDs returns the IDs of the tasks that have not been soft-deleted,
+// in ascending order of creation time. It runs a keys-only query, so no task
+// entities are transferred. The query requires the composite indexes on
+// deleted and created defined in index.yaml.
+func ListTaskIDs(ctx context.Context, client *datastore.Client) ([]int64, error) {
+	keys, err := client.GetAll(ctx, taskQuery(ctx).Filter("deleted =", false).Order("created").KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return keyIDs(keys), nil
+}
+
+// ListTasksBetween returns the tasks created at or after from and before to
+// that have not been soft-deleted, in ascending order of creation time. The
+// query is served by the built-in index on created.
+func ListTasksBetween(ctx context.Context, client *datastore.Client, from, to time.Time) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("created >=", from).Filter("created <", to).Order("created")
+	return getLiveTasks(ctx, client, query)
+}
+
+// ListTasksModifiedSince returns the tasks that were created or changed after
+// since, least recently changed first. Tasks last written before the
+// updated_at property was introduced have no update time and are never
+// returned.
+func ListTasksModifiedSince(ctx context.Context, client *datastore.Client, since time.Time) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("updated_at >", since).Order("updated_at")
+	return getTasks(ctx, client, query)
+}
+
+// defaultPageSize is the number of tasks ListTasksPage returns when no
+// page size is given.
+const defaultPageSize = 50
+
+// maxPageSize is the most tasks ListTasksPage returns in one page.
+const maxPageSize = 1000
+
+// ListTasksPage returns up to pageSize tasks, and no more than maxPageSize,
+// in the order of ListTasks, starting at the given cursor. As with ListTasks,
+// soft-deleted and snoozed tasks are left out. An empty or invalid cursor
+// starts from the first task. The returned cursor fetches the next page and
+// is empty once there are no more tasks.
+func ListTasksPage(ctx context.Context, client *datastore.Client, cursor string, pageSize int) ([]*Task, string, error) {
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	// Snoozed tasks are skipped as they are read, so the query cannot be
+	// limited to the page size.
+	query := taskQuery(ctx).Filter("deleted =", false).Order("-starred").Order("created")
+	if cursor != "" {
+		if c, err := datastore.DecodeCursor(cursor); err == nil {
+			query = query.Start(c)
+		}
+	}
+
+	tasks := make([]*Task, 0, pageSize)
+	var next string
+	now := time.Now()
+	it := client.Run(ctx, query)
+	for {
+		if len(tasks) == pageSize {
+			c, err := it.Cursor()
+			if err != nil {
+				return nil, "", err
+			}
+			next = c.String()
+		}
+
+		var task Task
+		key, err := it.Next(&task)
+		if err == iterator.Done {
+			// There was nothing past the end of this page.
+			next = ""
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if task.SnoozedUntil.After(now) {
+			continue
+		}
+		if len(tasks) == pageSize {
+			// There is a task past the end of this page.
+			break
+		}
+		task.Id = key.ID
+		tasks = append(tasks, &task)
+	}
+
+	return tasks, next, nil
+}
+
+// ListTasksByStatus returns the tasks that are done, or not done, and have
+// not been soft-deleted, in ascending order of creation time. The query
+// requires the composite index on done and created defined in index.yaml.
+func ListTasksByStatus(ctx context.Context, client *datastore.Client, done bool) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("done =", done).Order("created")
+	return getLiveTasks(ctx, client, query)
+}
+
+// ListRecentlyCompleted returns up to limit of the tasks that are done and
+// have not been soft-deleted, the most recently completed first. Because of
+// the limit, soft-deleted tasks are left out by the query rather than by
+// getLiveTasks, which requires the composite index on done, deleted and
+// completed_at defined in index.yaml. Tasks marked done before completion
+// times were recorded are left out.
+func ListRecentlyCompleted(ctx context.Context, client *datastore.Client, limit int) ([]*Task, error) {
+	query := taskQuery(ctx).Filter("done =", true).Filter("deleted =", false).Order("-completed_at").Limit(limit)
+	return getTasks(ctx, client, query)
+}
+
+// [START datastore_delete_entity]
+// DeleteTask deletes the task with the given ID. In the same transaction it
+// stores a TaskTombstone, so that ListChangesSince reports the deletion.
+// Deleting a task that does not exist does nothing.
+func DeleteTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	if err := deleteTask(ctx, client, taskID); err != ErrTaskNotFound {
+		return err
+	}
+	return nil
+}
+
+// [END datastore_delete_entity]
+
+// deleteTask deletes the task with the given ID as DeleteTask does, but
+// returns ErrTaskNotFound if there is no such task.
+func deleteTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	key := taskKey(ctx, taskID)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		// Deleting a task that does not exist leaves no tombstone.
+		if err := tx.Get(key, &Task{}); err != nil {
+			return err
+		}
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+		tombstoneKeys, tombstones := newTombstones([]*datastore.Key{key}, time.Now())
+		_, err := tx.PutMulti(tombstoneKeys, tombstones)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	if err != nil {
+		return err
+	}
+	publishEvent(ctx, eventDeleted, key)
+	return nil
+}
+
+// SoftDeleteTask moves the task with the given ID to the recycle bin, from
+// which it can be restored with RestoreTask. Soft-deleted tasks are left out
+// of ListTasks.
+func SoftDeleteTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	return setDeleted(ctx, client, taskID, true)
+}
+
+// RestoreTask takes the task with the given ID out of the recycle bin.
+func RestoreTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	return setDeleted(ctx, client, taskID, false)
+}
+
+func setDeleted(ctx context.Context, client *datastore.Client, taskID int64, deleted bool) error {
+	key := taskKey(ctx, taskID)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		task.Deleted = deleted
+		task.Version++
+		task.UpdatedAt = time.Now()
+		if deleted {
+			task.DeletedAt = task.UpdatedAt
+		} else {
+			task.DeletedAt = time.Time{}
+		}
+		_, err := tx.Put(key, &task)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	if err == nil && deleted {
+		publishEvent(ctx, eventDeleted, key)
+	}
+	return err
+}
+
+// StarTask stars the task with the given ID, so that it is listed first.
+func StarTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	return setStarred(ctx, client, taskID, true)
+}
+
+// UnstarTask unstars the task with the given ID.
+func UnstarTask(ctx context.Context, client *datastore.Client, taskID int64) error {
+	return setStarred(ctx, client, taskID, false)
+}
+
+func setStarred(ctx context.Context, client *datastore.Client, taskID int64, starred bool) error {
+	key := taskKey(ctx, taskID)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		if task.Starred == starred {
+			return nil
+		}
+		task.Starred = starred
+		task.Version++
+		task.UpdatedAt = time.Now()
+		_, err := tx.Put(key, &task)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// ErrSameList is returned by MoveTask when asked to move a task to the list it
+// is already in.
+var ErrSameList = errors.New("task is already in that list")
+
+// MoveTask moves the task with the given ID from the task list fromList to
+// toList, where "" means no list, and returns the task's new key. A key's
+// parent cannot be changed, so in a single transaction the task is copied to
+// a new entity, with a new ID, under the destination list, its history is
+// copied to the new task, and the original is deleted, leaving a
+// TaskTombstone. As with a deleted task, the original's history is kept. The
+// context's list, if any, is ignored.
+func MoveTask(ctx context.Context, client *datastore.Client, taskID int64, fromList, toList string) (*datastore.Key, error) {
+	if fromList == toList {
+		return nil, ErrSameList
+	}
+	oldKey := taskKey(WithList(ctx, fromList), taskID)
+
+	// As in CreateTask, the new ID is allocated first so that the history
+	// can be copied under the new key in the same transaction.
+	keys, err := client.AllocateIDs(ctx, []*datastore.Key{newTaskKey(WithList(ctx, toList))})
+	if err != nil {
+		return nil, err
+	}
+	newKey := keys[0]
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(oldKey, &task); err != nil {
+			return err
+		}
+		task.Version++
+		task.UpdatedAt = time.Now()
+		if _, err := tx.Put(newKey, &task); err != nil {
+			return err
+		}
+		if err := copyHistory(ctx, client, tx, oldKey, newKey); err != nil {
+			return err
+		}
+		tombstoneKeys, tombstones := newTombstones([]*datastore.Key{oldKey}, task.UpdatedAt)
+		if _, err := tx.PutMulti(tombstoneKeys, tombstones); err != nil {
+			return err
+		}
+		return tx.Delete(oldKey)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	publishEvent(ctx, eventDeleted, oldKey)
+	publishEvent(ctx, eventAdded, newKey)
+	return newKey, nil
+}
+
+// SnoozeTask hides the task with the given ID from ListTasks until the given
+// time. Snoozing a task until the zero time, or any time in the past, wakes
+// it up again.
+func SnoozeTask(ctx context.Context, client *datastore.Client, taskID int64, until time.Time) error {
+	key := taskKey(ctx, taskID)
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var task Task
+		if err := tx.Get(key, &task); err != nil {
+			return err
+		}
+		if task.SnoozedUntil.Equal(until) {
+			return nil
+		}
+		task.SnoozedUntil = until
+		task.Version++
+		task.UpdatedAt = time.Now()
+		_, err := tx.Put(key, &task)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return ErrTaskNotFound
+	}
+	return err
+}
+
+// maxSnoozeDays is the longest, in days, that SnoozeTaskFor snoozes a task.
+const maxSnoozeDays = 365
+
+// ErrInvalidSnooze is returned by SnoozeTaskFor when the duration is not
+// positive or is longer than maxSnoozeDays.
+var ErrInvalidSnooze = fmt.Errorf("task snooze duration must be positive and at most %d days", maxSnoozeDays)
+
+// SnoozeTaskFor snoozes the task with the given ID, as SnoozeTask does, until
+// d from now, and returns the time it wakes up.
+func SnoozeTaskFor(ctx context.Context, client *datastore.Client, taskID int64, d time.Duration) (time.Time, error) {
+	if d <= 0 || d > maxSnoozeDays*24*time.Hour {
+		return time.Time{}, ErrInvalidSnooze
+	}
+	until := time.Now().Add(d)
+	return until, SnoozeTask(ctx, client, taskID, until)
+}
+
+// maxBatchSize is the most entities datastore accepts in a single batch
+// operation or transaction.
+const maxBatchSize = 500
+
+// markAllDoneBatchSize is the most tasks markAllDone updates in one
+// transaction: each also adds an event to the task's history, and the
+// transaction may write at most maxBatchSize entities.
+const markAllDoneBatchSize = maxBatchSize / 2
+
+// MarkAllDone marks every open task done, other than those in the recycle
+// bin, and returns the number of tasks it updated. The tasks are updated in
+// transactions of up to markAllDoneBatchSize tasks, so if it fails part way
+// some of the tasks may already be done.
+func MarkAllDone(ctx context.Context, client *datastore.Client) (int, error) {
+	ids, err := markAllDone(ctx, client, false)
+	return len(ids), err
+}
+
+// MarkAllDoneDryRun returns the IDs of the tasks that MarkAllDone would mark
+// done, without changing them.
+func MarkAllDoneDryRun(ctx context.Context, client *datastore.Client) ([]int64, error) {
+	return markAllDone(ctx, client, true)
+}
+
+// markAllDone marks every open task done, other than those in the recycle
+// bin, and returns the IDs of the tasks it updated. If dryRun is set, it
+// returns the IDs of those open tasks instead.
+func markAllDone(ctx context.Context, client *datastore.Client, dryRun bool) ([]int64, error) {
+	keys, err := client.GetAll(ctx, taskQuery(ctx).Filter("done =", false).Filter("deleted =", false).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return keyIDs(keys), nil
+	}
+
+	var updated []int64
+	for start := 0; start < len(keys); start += markAllDoneBatchSize {
+		end := start + markAllDoneBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		var changed []*datastore.Key
+		_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			changed = nil
+			tasks := make([]*Task, len(batch))
+			if err := tx.GetMulti(batch, tasks); err != nil {
+				me, ok := err.(datastore.MultiError)
+				if !ok {
+					return err
+				}
+				for _, err := range me {
+					if err != nil && err != datastore.ErrNoSuchEntity {
+						return err
+					}
+				}
+			}
+			now := time.Now()
+			var changedTasks []*Task
+			for i, task := range tasks {
+				// The query may be stale, so skip tasks that have since been
+				// deleted or marked done.
+				if task == nil || task.Done || task.Deleted {
+					continue
+				}
+				task.Done = true
+				task.CompletedAt = now
+				task.CompletedBy = userName(ctx)
+				task.Version++
+				task.UpdatedAt = now
+				changed = append(changed, batch[i])
+				changedTasks = append(changedTasks, task)
+			}
+			if _, err := tx.PutMulti(changed, changedTasks); err != nil {
+				return err
+			}
+			for _, key := range changed {
+				if err := recordEvent(tx, key, ActionDone, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return updated, err
+		}
+		updated = append(updated, keyIDs(changed)...)
+		publishEvent(ctx, eventCompleted, changed...)
+	}
+	return updated, nil
+}
+
+// The statuses of a DoneResult.
+const (
+	doneStatusDone        = "done"
+	doneStatusAlreadyDone = "already_done"
+	doneStatusNotFound    = "not_found"
+)
+
+// DoneResult reports what MarkDoneMulti did with one of the IDs it was given:
+// its Status is "done" if the task was marked done, "already_done" if it was
+// done before, or "not_found" if no task has the ID.
+type DoneResult struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+}
+
+// MarkDoneMulti marks the tasks with the given IDs done and returns a result
+// for each ID, in the same order. IDs with no task are reported as not found
+// rather than failing the others. The tasks are read with one GetMulti and
+// written with one PutMulti in a transaction, unless there are more than
+// markAllDoneBatchSize of them; then each batch of that many is updated in
+// its own transaction, and an error leaves the earlier batches done.
+func MarkDoneMulti(ctx context.Context, client *datastore.Client, ids []int64) ([]DoneResult, error) {
+	var keys []*datastore.Key
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, taskKey(ctx, id))
+		}
+	}
+
+	status := make(map[int64]string)
+	for start := 0; start < len(keys); start += markAllDoneBatchSize {
+		end := start + markAllDoneBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		var changed []*datastore.Key
+		var batchStatus map[int64]string
+		_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			changed = nil
+			batchStatus = make(map[int64]string)
+			tasks := make([]*Task, len(batch))
+			missing := make([]bool, len(batch))
+			if err := tx.GetMulti(batch, tasks); err != nil {
+				me, ok := err.(datastore.MultiError)
+				if !ok {
+					return err
+				}
+				for i, err := range me {
+					if err == datastore.ErrNoSuchEntity {
+						missing[i] = true
+					} else if err != nil {
+						return describeMultiError("get", me)
+					}
+				}
+			}
+			now := time.Now()
+			var changedTasks []*Task
+			for i, task := range tasks {
+				id := batch[i].ID
+				switch {
+				case missing[i] || task == nil:
+					batchStatus[id] = doneStatusNotFound
+				case task.Done:
+					batchStatus[id] = doneStatusAlreadyDone
+				default:
+					task.Done = true
+					task.CompletedAt = now
+					task.CompletedBy = userName(ctx)
+					task.Version++
+					task.UpdatedAt = now
+					batchStatus[id] = doneStatusDone
+					changed = append(changed, batch[i])
+					changedTasks = append(changedTasks, task)
+				}
+			}
+			if _, err := tx.PutMulti(changed, changedTasks); err != nil {
+				return err
+			}
+			for _, key := range changed {
+				if err := recordEvent(tx, key, ActionDone, now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for id, s := range batchStatus {
+			status[id] = s
+		}
+		publishEvent(ctx, eventCompleted, changed...)
+	}
+
+	results := make([]DoneResult, len(ids))
+	for i, id := range ids {
+		results[i] = DoneResult{ID: id, Status: status[id]}
+	}
+	return results, nil
+}
+
+// PurgeDoneTasks permanently deletes every task that is done, including those
+// in the recycle bin, and returns how many it deleted. It deletes nothing and
+// returns 0 if no tasks are done.
+func PurgeDoneTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	ids, err := purgeDoneTasks(ctx, client, false)
+	return len(ids), err
+}
+
+// purgeDoneTasks deletes every done task and returns the IDs of the tasks it
+// deleted. If dryRun is set, it returns the IDs of the done tasks instead.
+func purgeDoneTasks(ctx context.Context, client *datastore.Client, dryRun bool) ([]int64, error) {
+	keys, err := client.GetAll(ctx, taskQuery(ctx).Filter("done =", true).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return keyIDs(keys), nil
+	}
+
+	var deleted []int64
+	for start := 0; start < len(keys); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+		if err := deleteTaskKeys(ctx, client, batch); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, keyIDs(batch)...)
+	}
+	return deleted, nil
+}
+
+// DeleteAllTasks permanently deletes every task in the context's namespace,
+// or in its task list if it has one, and returns how many it deleted. It is
+// meant for resetting test environments. Each deleted task leaves a
+// tombstone, as DeleteTask does.
+func DeleteAllTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	ids, err := deleteAllTasks(ctx, client)
+	return len(ids), err
+}
+
+// deleteAllTasks deletes the tasks in batches of up to maxBatchSize, querying
+// for the next batch until none remain, and returns the IDs of the tasks it
+// deleted, even if it fails part way.
+func deleteAllTasks(ctx context.Context, client *datastore.Client) ([]int64, error) {
+	var deleted []int64
+	seen := make(map[string]bool)
+	for {
+		keys, err := client.GetAll(ctx, taskQuery(ctx).KeysOnly().Limit(maxBatchSize), nil)
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		if err := deleteTaskKeys(ctx, client, keys); err != nil {
+			return deleted, err
+		}
+		// An eventually consistent query may return tasks already
+		// deleted, which are deleted again but not counted twice.
+		for _, key := range keys {
+			if !seen[key.String()] {
+				seen[key.String()] = true
+				deleted = append(deleted, key.ID)
+			}
+		}
+	}
+}
+
+// deleteTaskKeys permanently deletes the tasks with the given keys, of which
+// there must be at most maxBatchSize, leaving a tombstone for each.
+func deleteTaskKeys(ctx context.Context, client *datastore.Client, keys []*datastore.Key) error {
+	// The tombstones are stored first, so that no deletion goes unreported,
+	// even if some of them end up naming tasks that the failed call left in
+	// place.
+	tombstoneKeys, tombstones := newTombstones(keys, time.Now())
+	if _, err := client.PutMulti(ctx, tombstoneKeys, tombstones); err != nil {
+		return err
+	}
+	if err := client.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	publishEvent(ctx, eventDeleted, keys...)
+	return nil
+}
+
+// dedupeBatchSize is the most duplicates dedupeTasks deletes in one
+// transaction: each also leaves a tombstone, and the transaction may write at
+// most maxBatchSize entities.
+const dedupeBatchSize = maxBatchSize / 2
+
+// normalizeDesc returns the form of desc that DedupeTasks compares: lower
+// case, with each run of white space replaced by a single space.
+func normalizeDesc(desc string) string {
+	return strings.ToLower(strings.Join(strings.Fields(desc), " "))
+}
+
+// DedupeTasks permanently deletes the open tasks whose descriptions are the
+// same, once normalized by normalizeDesc, as that of an older open task, as
+// exact duplicates created by importing the same tasks twice are, and
+// returns how many it deleted. The oldest task with each description is
+// kept. Tasks that are done or in the recycle bin are neither deleted nor
+// compared. Each deleted task leaves a tombstone, as DeleteTask does.
+func DedupeTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	ids, err := dedupeTasks(ctx, client)
+	return len(ids), err
+}
+
+// dedupeTasks finds the duplicates with one query and deletes them in
+// batches of up to dedupeBatchSize, returning the IDs of the tasks it
+// deleted, even if it fails part way.
+func dedupeTasks(ctx context.Context, client *datastore.Client) ([]int64, error) {
+	tasks, err := ListTasksByStatus(ctx, client, false)
+	if err != nil {
+		return nil, err
+	}
+	// The tasks are in order of creation, so the first with each
+	// description is the one kept.
+	kept := make(map[string]*datastore.Key)
+	var dups, originals []*datastore.Key
+	for _, task := range tasks {
+		desc := normalizeDesc(task.Desc)
+		key := taskKey(ctx, task.Id)
+		if original, ok := kept[desc]; ok {
+			dups = append(dups, key)
+			originals = append(originals, original)
+			continue
+		}
+		kept[desc] = key
+	}
+
+	var deleted []int64
+	for start := 0; start < len(dups); start += dedupeBatchSize {
+		end := start + dedupeBatchSize
+		if end > len(dups) {
+			end = len(dups)
+		}
+		keys, err := deleteDuplicates(ctx, client, dups[start:end], originals[start:end])
+		deleted = append(deleted, keyIDs(keys)...)
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// deleteDuplicates permanently deletes, in one transaction, each task in keys
+// that is still a duplicate of the task with the corresponding key in
+// originals: both must still be open and out of the recycle bin, with the
+// same normalized description. The query that found them may be stale, and
+// either task may have changed since, so this is checked again. It returns
+// the keys of the tasks it deleted.
+func deleteDuplicates(ctx context.Context, client *datastore.Client, keys, originals []*datastore.Key) ([]*datastore.Key, error) {
+	// Many duplicates may share an original, which is read only once.
+	lookup := append([]*datastore.Key(nil), keys...)
+	index := make(map[string]int)
+	for _, key := range originals {
+		if _, ok := index[key.String()]; !ok {
+			index[key.String()] = len(lookup)
+			lookup = append(lookup, key)
+		}
+	}
+
+	var deleted []*datastore.Key
+	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		deleted = nil
+		tasks := make([]*Task, len(lookup))
+		missing := make([]bool, len(lookup))
+		if err := tx.GetMulti(lookup, tasks); err != nil {
+			me, ok := err.(datastore.MultiError)
+			if !ok {
+				return err
+			}
+			for i, err := range me {
+				if err == datastore.ErrNoSuchEntity {
+					missing[i] = true
+				} else if err != nil {
+					return describeMultiError("get", me)
+				}
+			}
+		}
+		live := func(i int) bool {
+			return !missing[i] && tasks[i] != nil && !tasks[i].Done && !tasks[i].Deleted
+		}
+		for i, key := range keys {
+			j := index[originals[i].String()]
+			if live(i) && live(j) && normalizeDesc(tasks[i].Desc) == normalizeDesc(tasks[j].Desc) {
+				deleted = append(deleted, key)
+			}
+		}
+		if len(deleted) == 0 {
+			return nil
+		}
+		tombstoneKeys, tombstones := newTombstones(deleted, time.Now())
+		if _, err := tx.PutMulti(tombstoneKeys, tombstones); err != nil {
+			return err
+		}
+		return tx.DeleteMulti(deleted)
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishEvent(ctx, eventDeleted, deleted...)
+	return deleted, nil
+}
+
+// keyIDs returns the integer IDs of the keys.
+func keyIDs(keys []*datastore.Key) []int64 {
+	ids := make([]int64, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+// UpgradeLegacyTasks stores the deleted and starred properties on the tasks
+// saved before soft deletion or starring were introduced, which ListTasks
+// otherwise leaves out, and returns the number of tasks it updated.
+func UpgradeLegacyTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	all, err := client.GetAll(ctx, taskQuery(ctx).KeysOnly(), nil)
+	if err != nil {
+		return 0, err
+	}
+	hasDeleted, err := keysWithBool(ctx, client, "deleted")
+	if err != nil {
+		return 0, err
+	}
+	hasStarred, err := keysWithBool(ctx, client, "starred")
+	if err != nil {
+		return 0, err
+	}
+	var legacy []*datastore.Key
+	for _, key := range all {
+		if !hasDeleted[key.String()] || !hasStarred[key.String()] {
+			legacy = append(legacy, key)
+		}
+	}
+
+	for start := 0; start < len(legacy); start += maxBatchSize {
+		end := start + maxBatchSize
+		if end > len(legacy) {
+			end = len(legacy)
+		}
+		keys := legacy[start:end]
+		// Loading and saving a legacy task stores its zero Deleted and
+		// Starred fields.
+		tasks := make([]*Task, len(keys))
+		if err := client.GetMulti(ctx, keys, tasks); err != nil {
+			return start, err
+		}
+		if _, err := client.PutMulti(ctx, keys, tasks); err != nil {
+			return start, err
+		}
+	}
+	return len(legacy), nil
+}
+
+// BackfillTasks repairs the tasks saved before their Created or UpdatedAt
+// fields were maintained, and returns the number of tasks it repaired. See
+// backfillTask for how each field is filled in. The tasks are read one at a
+// time and written back in batches of up to maxBatchSize, so if it fails part
+// way some of the tasks may already be repaired.
+func BackfillTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	now := time.Now()
+	n := 0
+	var keys []*datastore.Key
+	var repaired []*Task
+	flush := func() error {
+		if len(repaired) == 0 {
+			return nil
+		}
+		if _, err := client.PutMulti(ctx, keys, repaired); err != nil {
+			return err
+		}
+		n += len(repaired)
+		keys, repaired = nil, nil
+		return nil
+	}
+
+	// The query has no sort order, so it includes tasks without a created
+	// property.
+	err := iterateTasks(ctx, client, taskQuery(ctx), func(key *datastore.Key, task *Task) error {
+		if !backfillTask(task, key.ID, now) {
+			return nil
+		}
+		keys = append(keys, key)
+		repaired = append(repaired, task)
+		if len(repaired) == maxBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return n, err
+}
+
+// backfillTask fills in the task's missing timestamps and description prefix
+// and reports whether it changed any. A zero Created is set to the earliest
+// time the task is known to have existed, its update, completion or deletion
+// time, or else to now, and a zero UpdatedAt is set to Created. The Id is set
+// from the key's ID, as it is whenever a task is read, but a stale stored id
+// alone is not worth a write.
+func backfillTask(task *Task, id int64, now time.Time) bool {
+	task.Id = id
+	changed := false
+	if task.DescPrefix == "" && task.Desc != "" {
+		task.DescPrefix = descPrefix(task.Desc)
+		changed = true
+	}
+	if task.Created.IsZero() {
+		task.Created = now
+		for _, t := range []time.Time{task.UpdatedAt, task.CompletedAt, task.DeletedAt} {
+			if !t.IsZero() && t.Before(task.Created) {
+				task.Created = t
+			}
+		}
+		changed = true
+	}
+	if task.UpdatedAt.IsZero() {
+		task.UpdatedAt = task.Created
+		changed = true
+	}
+	if changed {
+		task.Version++
+	}
+	return changed
+}
+
+// keysWithBool returns the keys, as strings, of the tasks that have the given
+// bool property. Entities without the property match neither property =
+// false nor property = true, so they are missing from both queries.
+func keysWithBool(ctx context.Context, client *datastore.Client, property string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	for _, v := range []bool{false, true} {
+		keys, err := client.GetAll(ctx, taskQuery(ctx).Filter(property+" =", v).KeysOnly(), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			found[key.String()] = true
+		}
+	}
+	return found, nil
+}
+
+// CountTasks returns the number of tasks that have not been soft-deleted, or
+// when done is not nil the number of those whose done status matches it.
+// Only keys are fetched, so no task entities are transferred, and the
+// equality filters are served by merging the built-in indexes.
+func CountTasks(ctx context.Context, client *datastore.Client, done *bool) (int, error) {
+	query := taskQuery(ctx).Filter("deleted =", false).KeysOnly()
+	if done != nil {
+		query = query.Filter("done =", *done)
+	}
+	return client.Count(ctx, query)
+}
+
+// CountTasksByStatus returns the number of tasks that are done and the number
+// that are open, leaving out those that have been soft-deleted. Both come
+// from a single projection query on done, so they are consistent with each
+// other. The query requires the composite index on deleted and done defined
+// in index.yaml.
+func CountTasksByStatus(ctx context.Context, client *datastore.Client) (done, open int, err error) {
+	query := taskQuery(ctx).Filter("deleted =", false).Project("done")
+	it := client.Run(ctx, query)
+	for {
+		var row struct {
+			Done bool `datastore:"done"`
+		}
+		_, err := it.Next(&row)
+		if err == iterator.Done {
+			return done, open, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if row.Done {
+			done++
+		} else {
+			open++
+		}
+	}
+}
+
+// CountOpenTasks returns the number of tasks that are neither done nor in
+// the recycle bin. As with CountTasks, only keys are fetched. The equality
+// filters are served by merging the built-in indexes on done and deleted.
+func CountOpenTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	return client.Count(ctx, taskQuery(ctx).Filter("done =", false).Filter("deleted =", false).KeysOnly())
+}
+
+// CountListedTasks returns the number of tasks that ListTasks and
+// ListTasksPage list: those that have not been soft-deleted and are not
+// snoozed. Few tasks are snoozed at once, so they are read and subtracted
+// from the count of live tasks; counting them in a query would need a
+// composite index on deleted and snoozed_until.
+func CountListedTasks(ctx context.Context, client *datastore.Client) (int, error) {
+	n, err := client.Count(ctx, taskQuery(ctx).Filter("deleted =", false).KeysOnly())
+	if err != nil {
+		return 0, err
+	}
+	snoozed, err := getLiveTasks(ctx, client, taskQuery(ctx).Filter("snoozed_until >", time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return n - len(snoozed), nil
+}
+
+// Ping checks that the datastore can be reached by running a cheap keys-only
+// query.
+func Ping(ctx context.Context, client *datastore.Client) error {
+	_, err := client.Count(ctx, taskQuery(ctx).KeysOnly().Limit(1))
+	return err
+}
+
+// maxMsgSize is the largest request body, in bytes, that readMsg accepts.
+var maxMsgSize int64 = 64 << 10
+
+// errMsgTooLarge is returned by readMsg when the body exceeds maxMsgSize.
+var errMsgTooLarge = errors.New("message too large")
+
+// readMsg reads all of r, failing with errMsgTooLarge rather than truncating
+// the message when it is longer than maxMsgSize.
+func readMsg(r io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxMsgSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(b)) > maxMsgSize {
+		return "", errMsgTooLarge
 	}
 
-	return buf.String(), nil
+	return string(b), nil
 }
@@ -0,0 +1,2556 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// newTestClient returns a datastore client for tests that need a real
+// datastore. It uses the emulator when DATASTORE_EMULATOR_HOST is set, and
+// otherwise the project in GOLANG_SAMPLES_PROJECT_ID, skipping the test when
+// neither is configured.
+func newTestClient(t testing.TB) *datastore.Client {
+	var projectID string
+	if os.Getenv("DATASTORE_EMULATOR_HOST") != "" {
+		projectID = os.Getenv("DATASTORE_PROJECT_ID")
+		if projectID == "" {
+			projectID = "golang-samples-tasks"
+		}
+	} else {
+		projectID = os.Getenv("GOLANG_SAMPLES_PROJECT_ID")
+		if projectID == "" {
+			t.Skip("GOLANG_SAMPLES_PROJECT_ID not set")
+		}
+	}
+
+	client, err := datastore.NewClient(context.Background(), projectID)
+	if err != nil {
+		t.Fatalf("datastore.NewClient: %v", err)
+	}
+	return client
+}
+
+// newUnreachableClient returns a datastore client whose RPCs all fail, for
+// testing error handling without a datastore.
+func newUnreachableClient(t *testing.T) *datastore.Client {
+	client, err := datastore.NewClient(context.Background(), "unreachable",
+		option.WithEndpoint("localhost:1"),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatalf("datastore.NewClient: %v", err)
+	}
+	return client
+}
+
+func TestListenAddrFromEnv(t *testing.T) {
+	defer os.Unsetenv("HOST")
+	defer os.Unsetenv("PORT")
+
+	for _, tt := range []struct {
+		host, port, want string
+	}{
+		{"", "", ":8080"},
+		{"", "9000", ":9000"},
+		{"127.0.0.1", "", "127.0.0.1:8080"},
+		{"127.0.0.1", "9000", "127.0.0.1:9000"},
+		{"::1", "9000", "[::1]:9000"},
+		{"localhost", "9000", "localhost:9000"},
+	} {
+		os.Setenv("HOST", tt.host)
+		os.Setenv("PORT", tt.port)
+		if got := listenAddrFromEnv(); got != tt.want {
+			t.Errorf("listenAddrFromEnv() with HOST %q and PORT %q = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDatabaseID(t *testing.T) {
+	for _, tt := range []struct {
+		id      string
+		wantErr bool
+	}{
+		{"", false},
+		{"(default)", false},
+		{"tasks-eu", true},
+	} {
+		if err := checkDatabaseID(tt.id); (err != nil) != tt.wantErr {
+			t.Errorf("checkDatabaseID(%q) got error %v, want error: %v", tt.id, err, tt.wantErr)
+		}
+	}
+}
+
+// TestNewClientDatabase checks, against the emulator, that a client from
+// newClient with DATASTORE_DATABASE_ID set to the default database stores
+// tasks where the test client finds them, and that newClient refuses a named
+// database rather than quietly using the default one.
+func TestNewClientDatabase(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	ctx := WithNamespace(context.Background(), fmt.Sprint("database-", time.Now().UnixNano()))
+	defer os.Setenv("DATASTORE_DATABASE_ID", os.Getenv("DATASTORE_DATABASE_ID"))
+	if os.Getenv("DATASTORE_PROJECT_ID") == "" {
+		defer os.Unsetenv("DATASTORE_PROJECT_ID")
+		os.Setenv("DATASTORE_PROJECT_ID", "golang-samples-tasks")
+	}
+
+	os.Setenv("DATASTORE_DATABASE_ID", "tasks-eu")
+	if _, err := newClient(ctx); err == nil {
+		t.Errorf("newClient with DATASTORE_DATABASE_ID=tasks-eu got no error")
+	}
+
+	os.Setenv("DATASTORE_DATABASE_ID", defaultDatabaseID)
+	client, err := newClient(ctx)
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	key, err := AddTask(ctx, client, "in the default database")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	if _, err := GetTask(ctx, newTestClient(t), key.ID); err != nil {
+		t.Errorf("GetTask(%d) with the test client: %v", key.ID, err)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	for _, env := range []string{"VCAP_SERVICES", "SERVICE_NAME"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	// Outside Cloud Foundry, Application Default Credentials are used.
+	opts, err := clientOptions()
+	if err != nil || len(opts) != 0 {
+		t.Errorf("without VCAP_SERVICES clientOptions = %v, %v, want no options", opts, err)
+	}
+
+	// On Cloud Foundry, the credentials come from the bound service.
+	creds := base64.StdEncoding.EncodeToString([]byte(`{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`))
+	os.Setenv("SERVICE_NAME", "datastore")
+	os.Setenv("VCAP_SERVICES", fmt.Sprintf(`{"datastore": {"credentials": {"PrivateKeyData": %q}}}`, creds))
+	opts, err = clientOptions()
+	if err != nil || len(opts) != 1 {
+		t.Errorf("with VCAP_SERVICES clientOptions = %v, %v, want the service's credentials", opts, err)
+	}
+
+	// A half-configured Cloud Foundry app is an error, not a fallback.
+	os.Unsetenv("VCAP_SERVICES")
+	if _, err := clientOptions(); err == nil {
+		t.Errorf("with only SERVICE_NAME clientOptions got no error")
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	got, err := readMsg(strings.NewReader(long))
+	if err != nil {
+		t.Fatalf("readMsg: %v", err)
+	}
+	if got != long {
+		t.Errorf("readMsg returned %d bytes, want %d", len(got), len(long))
+	}
+
+	tooLong := strings.Repeat("x", int(maxMsgSize)+1)
+	if _, err := readMsg(strings.NewReader(tooLong)); err != errMsgTooLarge {
+		t.Errorf("readMsg(%d bytes) got err %v, want %v", len(tooLong), err, errMsgTooLarge)
+	}
+}
+
+func TestTaskJSON(t *testing.T) {
+	data, err := json.Marshal(&Task{Desc: "buy milk", Id: 42})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	var got []string
+	for k := range fields {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	want := []string{
+		"color", "completed_at", "completed_by", "created", "deleted", "deleted_at", "depends_on",
+		"description", "done", "due", "estimate_minutes", "id", "next_due", "owner", "position",
+		"priority", "recurrence", "snoozed_until", "starred", "tags",
+		"updated_at", "version",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Task JSON got keys %q, want %q", got, want)
+	}
+	if fields["description"] != "buy milk" || fields["id"] != float64(42) {
+		t.Errorf("Task JSON got %s, want description \"buy milk\" and id 42", data)
+	}
+}
+
+func TestListTasksEmulator(t *testing.T) {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	var ids []int64
+	for _, desc := range []string{"first", "second", "third"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask(%q): %v", desc, err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		ids = append(ids, key.ID)
+	}
+
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	var got []int64
+	for _, task := range tasks {
+		for _, id := range ids {
+			if task.Id == id {
+				got = append(got, id)
+			}
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		t.Errorf("ListTasks returned the new tasks in order %v, want %v", got, ids)
+	}
+}
+
+func TestSetDone(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithUser(context.Background(), "alice")
+
+	key, err := AddTask(ctx, client, "reopen me")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !task.CompletedAt.IsZero() {
+		t.Errorf("new task got CompletedAt = %v, want zero", task.CompletedAt)
+	}
+
+	for _, done := range []bool{true, false} {
+		if err := SetDone(ctx, client, key.ID, done); err != nil {
+			t.Fatalf("SetDone(%v): %v", done, err)
+		}
+		task, err := GetTask(ctx, client, key.ID)
+		if err != nil {
+			t.Fatalf("GetTask: %v", err)
+		}
+		if task.Done != done {
+			t.Errorf("after SetDone(%v) got Done = %v", done, task.Done)
+		}
+		if task.CompletedAt.IsZero() == done {
+			t.Errorf("after SetDone(%v) got CompletedAt = %v", done, task.CompletedAt)
+		}
+		if want := map[bool]string{true: "alice"}[done]; task.CompletedBy != want {
+			t.Errorf("after SetDone(%v) got CompletedBy = %q, want %q", done, task.CompletedBy, want)
+		}
+	}
+	for _, done := range []bool{true, false} {
+		task, err := UpdateTask(WithUser(ctx, "bob"), client, key.ID, TaskPatch{Done: &done})
+		if err != nil {
+			t.Fatalf("UpdateTask(done: %v): %v", done, err)
+		}
+		if want := map[bool]string{true: "bob"}[done]; task.CompletedBy != want {
+			t.Errorf("after UpdateTask(done: %v) got CompletedBy = %q, want %q", done, task.CompletedBy, want)
+		}
+	}
+
+	if err := DeleteTask(ctx, client, key.ID); err != nil {
+		t.Fatalf("DeleteTask: %v", err)
+	}
+	if err := MarkUndone(ctx, client, key.ID); err != ErrTaskNotFound {
+		t.Errorf("MarkUndone on deleted task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestMarkDoneTwice(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("donetwice-", time.Now().UnixNano()))
+
+	key, err := AddTask(ctx, client, "finish once")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	first, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone again: %v", err)
+	}
+	second, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !second.CompletedAt.Equal(first.CompletedAt) || second.Version != first.Version {
+		t.Errorf("MarkDone again changed CompletedAt from %v to %v and version from %d to %d", first.CompletedAt, second.CompletedAt, first.Version, second.Version)
+	}
+}
+
+func TestUpdateTaskDescription(t *testing.T) {
+	if err := UpdateTaskDescription(context.Background(), nil, 1, ""); err != ErrEmptyDescription {
+		t.Errorf("UpdateTaskDescription with empty description got err %v, want %v", err, ErrEmptyDescription)
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	key, err := AddTask(ctx, client, "before")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	if err := UpdateTaskDescription(ctx, client, key.ID, "after"); err != nil {
+		t.Fatalf("UpdateTaskDescription: %v", err)
+	}
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.Desc != "after" {
+		t.Errorf("got Desc %q, want %q", task.Desc, "after")
+	}
+}
+
+func TestListTasksByStatus(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	key, err := AddTask(ctx, client, "filter me")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	for _, done := range []bool{true, false} {
+		tasks, err := ListTasksByStatus(ctx, client, done)
+		if err != nil {
+			t.Fatalf("ListTasksByStatus(%v): %v", done, err)
+		}
+		found := false
+		for _, task := range tasks {
+			if task.Done != done {
+				t.Errorf("ListTasksByStatus(%v) returned task %d with Done = %v", done, task.Id, task.Done)
+			}
+			if task.Id == key.ID {
+				found = true
+			}
+		}
+		if found != done {
+			t.Errorf("ListTasksByStatus(%v) contains done task: %v", done, found)
+		}
+	}
+}
+
+func TestListTasksPage(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	want := map[int64]bool{}
+	for i := 0; i < 3; i++ {
+		key, err := AddTask(ctx, client, "page me")
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		want[key.ID] = true
+	}
+
+	seen := map[int64]bool{}
+	cursor := ""
+	for {
+		tasks, next, err := ListTasksPage(ctx, client, cursor, 2)
+		if err != nil {
+			t.Fatalf("ListTasksPage: %v", err)
+		}
+		if len(tasks) > 2 {
+			t.Errorf("ListTasksPage returned %d tasks, want at most 2", len(tasks))
+		}
+		for _, task := range tasks {
+			if seen[task.Id] {
+				t.Errorf("task %d returned on more than one page", task.Id)
+			}
+			seen[task.Id] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("task %d missing from pages", id)
+		}
+	}
+
+	first, _, err := ListTasksPage(ctx, client, "", 1)
+	if err != nil {
+		t.Fatalf("ListTasksPage: %v", err)
+	}
+	invalid, _, err := ListTasksPage(ctx, client, "not-a-cursor", 1)
+	if err != nil {
+		t.Fatalf("ListTasksPage with invalid cursor: %v", err)
+	}
+	if len(first) != 1 || len(invalid) != 1 || first[0].Id != invalid[0].Id {
+		t.Errorf("ListTasksPage with invalid cursor did not start from the first task")
+	}
+}
+
+// legacyTask is a Task as it was stored before priorities were introduced.
+type legacyTask struct {
+	Desc    string    `datastore:"description"`
+	Created time.Time `datastore:"created"`
+	Done    bool      `datastore:"done"`
+}
+
+// unstarredTask is a task as stored before starring was introduced.
+type unstarredTask struct {
+	Desc    string    `datastore:"description"`
+	Created time.Time `datastore:"created"`
+	Done    bool      `datastore:"done"`
+	Deleted bool      `datastore:"deleted"`
+}
+
+func TestPriority(t *testing.T) {
+	for _, p := range []int{-1, PriorityHigh + 1} {
+		if _, err := CreateTask(context.Background(), nil, &Task{Desc: "bad", Priority: p}); err != ErrInvalidPriority {
+			t.Errorf("CreateTask with priority %d got err %v, want %v", p, err, ErrInvalidPriority)
+		}
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	legacyKey, err := client.Put(ctx, datastore.IncompleteKey("Task", nil), &legacyTask{Desc: "legacy", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("Put legacy task: %v", err)
+	}
+	defer DeleteTask(ctx, client, legacyKey.ID)
+	lowKey, err := CreateTask(ctx, client, &Task{Desc: "low", Priority: PriorityLow})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, lowKey.ID)
+	highKey, err := CreateTask(ctx, client, &Task{Desc: "high", Priority: PriorityHigh})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, highKey.ID)
+
+	legacy, err := GetTask(ctx, client, legacyKey.ID)
+	if err != nil {
+		t.Fatalf("GetTask(legacy): %v", err)
+	}
+	if legacy.Priority != PriorityNone {
+		t.Errorf("legacy task got Priority %d, want %d", legacy.Priority, PriorityNone)
+	}
+
+	tasks, err := ListTasksByPriority(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasksByPriority: %v", err)
+	}
+	pos := map[int64]int{}
+	for i, task := range tasks {
+		if i > 0 && task.Priority > tasks[i-1].Priority {
+			t.Errorf("task %d with priority %d listed after priority %d", task.Id, task.Priority, tasks[i-1].Priority)
+		}
+		pos[task.Id] = i
+	}
+	if pos[highKey.ID] > pos[lowKey.ID] {
+		t.Errorf("high priority task listed after low priority task")
+	}
+}
+
+func TestListOverdueTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	now := time.Now()
+	create := func(task *Task) int64 {
+		key, err := CreateTask(ctx, client, task)
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		return key.ID
+	}
+	overdue := create(&Task{Desc: "overdue", Due: now.Add(-time.Hour)})
+	doneOverdue := create(&Task{Desc: "done overdue", Due: now.Add(-time.Hour)})
+	future := create(&Task{Desc: "future", Due: now.Add(time.Hour)})
+	noDue := create(&Task{Desc: "no due date"})
+	for _, id := range []int64{overdue, doneOverdue, future, noDue} {
+		defer DeleteTask(ctx, client, id)
+	}
+	if err := MarkDone(ctx, client, doneOverdue); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	tasks, err := ListOverdueTasks(ctx, client, now)
+	if err != nil {
+		t.Fatalf("ListOverdueTasks: %v", err)
+	}
+	got := map[int64]bool{}
+	for _, task := range tasks {
+		got[task.Id] = true
+	}
+	if !got[overdue] {
+		t.Errorf("ListOverdueTasks is missing the overdue task")
+	}
+	for _, id := range []int64{doneOverdue, future, noDue} {
+		if got[id] {
+			t.Errorf("ListOverdueTasks returned task %d, which is not overdue", id)
+		}
+	}
+}
+
+func TestDayBounds(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time.LoadLocation: %v", err)
+	}
+	for _, tt := range []struct {
+		t          time.Time
+		start, end time.Time
+	}{
+		// 03:30 UTC is still the previous evening in New York.
+		{time.Date(2019, 3, 11, 3, 30, 0, 0, time.UTC), time.Date(2019, 3, 10, 0, 0, 0, 0, ny), time.Date(2019, 3, 11, 0, 0, 0, 0, ny)},
+		// Daylight saving time began on 10 March 2019, a 23-hour day.
+		{time.Date(2019, 3, 10, 12, 0, 0, 0, ny), time.Date(2019, 3, 10, 0, 0, 0, 0, ny), time.Date(2019, 3, 11, 0, 0, 0, 0, ny)},
+		{time.Date(2019, 3, 11, 0, 0, 0, 0, ny), time.Date(2019, 3, 11, 0, 0, 0, 0, ny), time.Date(2019, 3, 12, 0, 0, 0, 0, ny)},
+	} {
+		start, end := dayBounds(tt.t, ny)
+		if !start.Equal(tt.start) || !end.Equal(tt.end) {
+			t.Errorf("dayBounds(%v) = %v, %v, want %v, %v", tt.t, start, end, tt.start, tt.end)
+		}
+	}
+	if start, end := dayBounds(time.Date(2019, 3, 10, 12, 0, 0, 0, ny), ny); end.Sub(start) != 23*time.Hour {
+		t.Errorf("the day daylight saving time began lasted %v, want 23h", end.Sub(start))
+	}
+}
+
+func TestListTasksUnderEstimate(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("estimate-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, task := range []*Task{
+		{Desc: "an hour", EstimateMinutes: 60},
+		{Desc: "five minutes", EstimateMinutes: 5},
+		{Desc: "unestimated"},
+		{Desc: "half an hour", EstimateMinutes: 30},
+		{Desc: "done", EstimateMinutes: 5, Done: true},
+		{Desc: "deleted", EstimateMinutes: 5, Deleted: true},
+	} {
+		key, err := CreateTask(ctx, client, task)
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	if _, err := CreateTask(ctx, client, &Task{Desc: "negative", EstimateMinutes: -1}); err != ErrInvalidEstimate {
+		t.Errorf("CreateTask with a negative estimate got err %v, want %v", err, ErrInvalidEstimate)
+	}
+
+	for _, tt := range []struct {
+		maxMinutes int
+		want       []string
+	}{
+		{30, []string{"five minutes", "half an hour"}},
+		{60, []string{"five minutes", "half an hour", "an hour"}},
+		{4, nil},
+		// Unestimated tasks are left out, even with no limit to speak of.
+		{0, nil},
+	} {
+		tasks, err := ListTasksUnderEstimate(ctx, client, tt.maxMinutes)
+		if err != nil {
+			t.Fatalf("ListTasksUnderEstimate: %v", err)
+		}
+		var got []string
+		for _, task := range tasks {
+			got = append(got, task.Desc)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ListTasksUnderEstimate(%d) got %q, want %q", tt.maxMinutes, got, tt.want)
+		}
+	}
+
+	// Removing an estimate leaves the task out.
+	zero := 0
+	if _, err := UpdateTask(ctx, client, keys[1].ID, TaskPatch{EstimateMinutes: &zero}); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+	if tasks, err := ListTasksUnderEstimate(ctx, client, 30); err != nil || len(tasks) != 1 || tasks[0].Desc != "half an hour" {
+		t.Errorf("after removing an estimate, ListTasksUnderEstimate(30) = %+v, %v, want only half an hour", tasks, err)
+	}
+}
+
+func TestListTasksDueToday(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("duetoday-", time.Now().UnixNano()))
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time.LoadLocation: %v", err)
+	}
+
+	// In New York it is late on 10 March; in UTC it is already 11 March.
+	now := time.Date(2019, 3, 10, 23, 30, 0, 0, ny)
+	create := func(desc string, due time.Time) int64 {
+		key, err := CreateTask(ctx, client, &Task{Desc: desc, Due: due})
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		return key.ID
+	}
+	today := create("today", time.Date(2019, 3, 10, 8, 0, 0, 0, ny))
+	tomorrow := create("tomorrow", time.Date(2019, 3, 11, 0, 30, 0, 0, ny))
+	yesterday := create("yesterday", time.Date(2019, 3, 9, 23, 0, 0, 0, ny))
+	for _, id := range []int64{today, tomorrow, yesterday} {
+		defer DeleteTask(ctx, client, id)
+	}
+
+	ids := func(loc *time.Location) []int64 {
+		tasks, err := ListTasksDueToday(ctx, client, loc, now)
+		if err != nil {
+			t.Fatalf("ListTasksDueToday: %v", err)
+		}
+		var ids []int64
+		for _, task := range tasks {
+			ids = append(ids, task.Id)
+		}
+		return ids
+	}
+	if got := ids(ny); len(got) != 1 || got[0] != today {
+		t.Errorf("ListTasksDueToday in New York got tasks %v, want [%d]", got, today)
+	}
+	// 11 March in UTC includes the task due just after midnight in New York.
+	if got := ids(time.UTC); len(got) != 1 || got[0] != tomorrow {
+		t.Errorf("ListTasksDueToday in UTC got tasks %v, want [%d]", got, tomorrow)
+	}
+}
+
+func TestEmptyTagsNotStored(t *testing.T) {
+	for _, tags := range [][]string{nil, {}} {
+		props, err := datastore.SaveStruct(&Task{Desc: "untagged", Tags: tags})
+		if err != nil {
+			t.Fatalf("SaveStruct: %v", err)
+		}
+		for _, p := range props {
+			if p.Name == "tags" {
+				t.Errorf("SaveStruct(Tags: %#v) stored a tags property: %#v", tags, p)
+			}
+		}
+	}
+}
+
+func TestListTasksByTag(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	tagged, err := CreateTask(ctx, client, &Task{Desc: "tagged", Tags: []string{"work", "urgent"}})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, tagged.ID)
+	untagged, err := CreateTask(ctx, client, &Task{Desc: "untagged"})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, untagged.ID)
+
+	tasks, err := ListTasksByTag(ctx, client, "urgent")
+	if err != nil {
+		t.Fatalf("ListTasksByTag: %v", err)
+	}
+	found := false
+	for _, task := range tasks {
+		if task.Id == untagged.ID {
+			t.Errorf("ListTasksByTag returned the untagged task")
+		}
+		if task.Id == tagged.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ListTasksByTag is missing the tagged task")
+	}
+
+	task, err := GetTask(ctx, client, untagged.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if len(task.Tags) != 0 {
+		t.Errorf("untagged task got Tags %q, want none", task.Tags)
+	}
+}
+
+func TestDescribeMultiError(t *testing.T) {
+	me := datastore.MultiError{nil, errors.New("boom"), nil}
+	got := describeMultiError("add", me).Error()
+	if want := "failed to add 1 of 3 tasks: task 1: boom"; got != want {
+		t.Errorf("describeMultiError got %q, want %q", got, want)
+	}
+}
+
+func TestAddTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	descs := []string{"one", "two", "three"}
+	keys, err := AddTasks(ctx, client, descs)
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	if len(keys) != len(descs) {
+		t.Fatalf("AddTasks returned %d keys, want %d", len(keys), len(descs))
+	}
+	for i, key := range keys {
+		defer DeleteTask(ctx, client, key.ID)
+		task, err := GetTask(ctx, client, key.ID)
+		if err != nil {
+			t.Fatalf("GetTask(%d): %v", key.ID, err)
+		}
+		if task.Desc != descs[i] {
+			t.Errorf("task %d has description %q, want %q", i, task.Desc, descs[i])
+		}
+	}
+}
+
+func TestCountTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	done, open := true, false
+	filters := []struct {
+		name   string
+		done   *bool
+		before int
+		added  int // How many tasks AddTask adds to the count.
+	}{
+		{name: "all", done: nil, added: 1},
+		{name: "done", done: &done, added: 0},
+		{name: "open", done: &open, added: 1},
+	}
+	for i, f := range filters {
+		n, err := CountTasks(ctx, client, f.done)
+		if err != nil {
+			t.Fatalf("CountTasks(%s): %v", f.name, err)
+		}
+		filters[i].before = n
+	}
+
+	key, err := AddTask(ctx, client, "count me")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	for _, f := range filters {
+		got, err := CountTasks(ctx, client, f.done)
+		if err != nil {
+			t.Fatalf("CountTasks(%s): %v", f.name, err)
+		}
+		if want := f.before + f.added; got != want {
+			t.Errorf("CountTasks(%s) = %d, want %d", f.name, got, want)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	suffix := fmt.Sprint(time.Now().UnixNano())
+	ctxA := WithNamespace(context.Background(), "a-"+suffix)
+	ctxB := WithNamespace(context.Background(), "b-"+suffix)
+
+	key, err := AddTask(ctxA, client, "tenant a")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctxA, client, key.ID)
+	if key.Namespace != namespace(ctxA) {
+		t.Errorf("AddTask created key in namespace %q, want %q", key.Namespace, namespace(ctxA))
+	}
+
+	tasks, err := ListTasks(ctxA, client)
+	if err != nil {
+		t.Fatalf("ListTasks(a): %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != key.ID {
+		t.Errorf("ListTasks(a) = %v, want only task %d", tasks, key.ID)
+	}
+
+	tasks, err = ListTasks(ctxB, client)
+	if err != nil {
+		t.Fatalf("ListTasks(b): %v", err)
+	}
+	if len(tasks) != 0 {
+		t.Errorf("ListTasks(b) returned %d tasks from another namespace", len(tasks))
+	}
+	if _, err := GetTask(ctxB, client, key.ID); err != ErrTaskNotFound {
+		t.Errorf("GetTask(b) got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestTaskLists(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("lists-", time.Now().UnixNano()))
+
+	key, err := AddTaskToList(ctx, client, "groceries", "buy milk")
+	if err != nil {
+		t.Fatalf("AddTaskToList: %v", err)
+	}
+	defer DeleteTask(WithList(ctx, "groceries"), client, key.ID)
+	if key.Parent == nil || key.Parent.Kind != "TaskList" || key.Parent.Name != "groceries" {
+		t.Errorf("AddTaskToList created key with parent %v, want TaskList groceries", key.Parent)
+	}
+
+	tasks, err := ListTasksInList(ctx, client, "groceries")
+	if err != nil {
+		t.Fatalf("ListTasksInList: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != key.ID {
+		t.Errorf("ListTasksInList(groceries) = %v, want only task %d", tasks, key.ID)
+	}
+
+	tasks, err = ListTasksInList(ctx, client, "chores")
+	if err != nil {
+		t.Fatalf("ListTasksInList: %v", err)
+	}
+	if len(tasks) != 0 {
+		t.Errorf("ListTasksInList(chores) returned %d tasks from another list", len(tasks))
+	}
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("consistency-", time.Now().UnixNano()))
+
+	// Eventual consistency for queries does not weaken lookups by key.
+	for _, ctx := range []context.Context{ctx, WithEventualConsistency(WithList(ctx, "groceries"))} {
+		for i := 0; i < 10; i++ {
+			desc := fmt.Sprint("task ", i)
+			key, err := AddTask(ctx, client, desc)
+			if err != nil {
+				t.Fatalf("AddTask: %v", err)
+			}
+			defer DeleteTask(ctx, client, key.ID)
+			task, err := GetTask(ctx, client, key.ID)
+			if err != nil || task.Desc != desc {
+				t.Fatalf("GetTask right after AddTask = %+v, %v, want %q", task, err, desc)
+			}
+
+			if err := MarkDone(ctx, client, key.ID); err != nil {
+				t.Fatalf("MarkDone: %v", err)
+			}
+			if task, err := GetTask(ctx, client, key.ID); err != nil || !task.Done {
+				t.Fatalf("GetTask right after MarkDone = %+v, %v, want it done", task, err)
+			}
+		}
+	}
+}
+
+func TestCountTasksByStatus(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("countstatus-", time.Now().UnixNano()))
+
+	keys, err := AddTasks(ctx, client, []string{"open", "done", "recycled"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	if err := MarkDone(ctx, client, keys[1].ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	if err := SoftDeleteTask(ctx, client, keys[2].ID); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	if done, open, err := CountTasksByStatus(ctx, client); err != nil || done != 1 || open != 1 {
+		t.Errorf("CountTasksByStatus = %d, %d, %v, want 1 done and 1 open", done, open, err)
+	}
+}
+
+func TestListTaskDescriptions(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("descriptions-", time.Now().UnixNano()))
+
+	keys, err := AddTasks(ctx, client, []string{"walk dog", "buy milk", "call mom", "recycled"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	if err := SoftDeleteTask(ctx, client, keys[3].ID); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	var want []string
+	for _, task := range tasks {
+		want = append(want, task.Desc)
+	}
+	sort.Strings(want)
+
+	got, err := ListTaskDescriptions(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTaskDescriptions: %v", err)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ListTaskDescriptions() = %q, want %q", got, want)
+	}
+	for _, desc := range got {
+		if desc == "recycled" {
+			t.Errorf("ListTaskDescriptions() = %q, want the soft-deleted task left out", got)
+		}
+	}
+}
+
+func TestIterateTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("iterate-", time.Now().UnixNano()))
+
+	var want []string
+	for _, desc := range []string{"one", "two", "three"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		want = append(want, fmt.Sprintf("%d:%s", key.ID, desc))
+	}
+
+	var got []string
+	err := IterateTasks(ctx, client, func(task *Task) error {
+		got = append(got, fmt.Sprintf("%d:%s", task.Id, task.Desc))
+		return nil
+	})
+	if err != nil || strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("IterateTasks got %v, %v, want %v", got, err, want)
+	}
+
+	// An error from fn stops the iteration.
+	errStop := errors.New("stop")
+	calls := 0
+	err = IterateTasks(ctx, client, func(task *Task) error {
+		calls++
+		if calls == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || calls != 2 {
+		t.Errorf("IterateTasks stopping at the second task got err %v after %d calls, want %v after 2", err, calls, errStop)
+	}
+}
+
+func TestListTaskIDs(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("ids-", time.Now().UnixNano()))
+
+	keys, err := AddTasks(ctx, client, []string{"one", "two", "three", "recycled"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	recycled := keys[3].ID
+	if err := SoftDeleteTask(ctx, client, recycled); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	ids, err := ListTaskIDs(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTaskIDs: %v", err)
+	}
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	if len(ids) != len(tasks) {
+		t.Fatalf("ListTaskIDs returned %d IDs, want %d", len(ids), len(tasks))
+	}
+	for i, task := range tasks {
+		if ids[i] != task.Id {
+			t.Errorf("ListTaskIDs()[%d] = %d, want %d", i, ids[i], task.Id)
+		}
+		if ids[i] == recycled {
+			t.Errorf("ListTaskIDs() = %v, want the soft-deleted task %d left out", ids, recycled)
+		}
+	}
+}
+
+// benchmarkContext returns a context for a namespace holding n tasks, and a
+// function that deletes them.
+func benchmarkContext(b *testing.B, client *datastore.Client, n int) (context.Context, func()) {
+	ctx := WithNamespace(context.Background(), fmt.Sprint("bench-", time.Now().UnixNano()))
+	descs := make([]string, n)
+	for i := range descs {
+		descs[i] = fmt.Sprintf("task %d with a longer description than usual", i)
+	}
+	keys, err := AddTasks(ctx, client, descs)
+	if err != nil {
+		b.Fatalf("AddTasks: %v", err)
+	}
+	return ctx, func() { client.DeleteMulti(ctx, keys) }
+}
+
+func BenchmarkListTaskIDs(b *testing.B) {
+	client := newTestClient(b)
+	defer client.Close()
+	ctx, cleanup := benchmarkContext(b, client, 200)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ListTaskIDs(ctx, client); err != nil {
+			b.Fatalf("ListTaskIDs: %v", err)
+		}
+	}
+}
+
+func BenchmarkListTasks(b *testing.B) {
+	client := newTestClient(b)
+	defer client.Close()
+	ctx, cleanup := benchmarkContext(b, client, 200)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ListTasks(ctx, client); err != nil {
+			b.Fatalf("ListTasks: %v", err)
+		}
+	}
+}
+
+func TestCreateTaskOnce(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("once-", time.Now().UnixNano()))
+
+	first := &Task{Desc: "first request"}
+	key, created, err := CreateTaskOnce(ctx, client, "retried-request", first)
+	if err != nil || !created {
+		t.Fatalf("CreateTaskOnce = %v, %v, %v, want a new task", key, created, err)
+	}
+	defer client.Delete(ctx, key)
+
+	retry := &Task{Desc: "retried request"}
+	again, created, err := CreateTaskOnce(ctx, client, "retried-request", retry)
+	if err != nil || created || !again.Equal(key) {
+		t.Errorf("CreateTaskOnce with a used key = %v, %v, %v, want %v, false, nil", again, created, err, key)
+	}
+	if retry.Desc != first.Desc || retry.Id != key.ID {
+		t.Errorf("CreateTaskOnce with a used key got task %+v, want %+v", retry, first)
+	}
+
+	// The task's ID is allocated, so it cannot collide with another task.
+	other, err := AddTask(ctx, client, "without a key")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, other)
+	if other.ID == key.ID {
+		t.Errorf("AddTask got ID %d, the same as the task created once", other.ID)
+	}
+
+	// Once the task is purged, the key creates a new one.
+	if err := client.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	renewed, created, err := CreateTaskOnce(ctx, client, "retried-request", &Task{Desc: "after purging"})
+	if err != nil || !created || renewed.Equal(key) {
+		t.Errorf("CreateTaskOnce after purging = %v, %v, %v, want a new task", renewed, created, err)
+	}
+	if renewed != nil {
+		defer client.Delete(ctx, renewed)
+	}
+}
+
+func TestListTasksModifiedSince(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("modified-", time.Now().UnixNano()))
+
+	old, err := AddTask(ctx, client, "untouched")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, old.ID)
+	changed, err := AddTask(ctx, client, "changed")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, changed.ID)
+
+	task, err := GetTask(ctx, client, changed.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !task.UpdatedAt.Equal(task.Created) {
+		t.Errorf("new task got UpdatedAt = %v, want its creation time %v", task.UpdatedAt, task.Created)
+	}
+
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	if err := MarkDone(ctx, client, changed.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+
+	tasks, err := ListTasksModifiedSince(ctx, client, since)
+	if err != nil {
+		t.Fatalf("ListTasksModifiedSince: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != changed.ID {
+		t.Errorf("ListTasksModifiedSince = %v, want only task %d", tasks, changed.ID)
+	}
+	if len(tasks) > 0 && !tasks[0].UpdatedAt.After(since) {
+		t.Errorf("task marked done got UpdatedAt = %v, want after %v", tasks[0].UpdatedAt, since)
+	}
+}
+
+func TestUpgradeLegacyTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("legacy-", time.Now().UnixNano()))
+
+	legacyKey, err := client.Put(ctx, newTaskKey(ctx), &legacyTask{Desc: "legacy", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("Put legacy task: %v", err)
+	}
+	defer DeleteTask(ctx, client, legacyKey.ID)
+	unstarredKey, err := client.Put(ctx, newTaskKey(ctx), &unstarredTask{Desc: "unstarred", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("Put unstarred task: %v", err)
+	}
+	defer DeleteTask(ctx, client, unstarredKey.ID)
+	key, err := AddTask(ctx, client, "current")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	if tasks, err := ListTasks(ctx, client); err != nil || len(tasks) != 1 {
+		t.Fatalf("before upgrade ListTasks = %v, %v, want only the current task", tasks, err)
+	}
+	n, err := UpgradeLegacyTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("UpgradeLegacyTasks: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("UpgradeLegacyTasks updated %d tasks, want 2", n)
+	}
+	if tasks, err := ListTasks(ctx, client); err != nil || len(tasks) != 3 {
+		t.Errorf("after upgrade ListTasks = %v, %v, want all three tasks", tasks, err)
+	}
+}
+
+func TestFilteredListingsLeaveOutDeleted(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("filtered-", time.Now().UnixNano()))
+
+	now := time.Now()
+	task := func() *Task {
+		return &Task{Desc: "chore", Tags: []string{"home"}, Owner: "alex", Due: now.Add(-time.Hour)}
+	}
+	live, err := CreateTask(ctx, client, task())
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, live.ID)
+	deleted, err := CreateTask(ctx, client, task())
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, deleted.ID)
+	if err := SoftDeleteTask(ctx, client, deleted.ID); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		list func() ([]*Task, error)
+	}{
+		{"ListTasksOrdered", func() ([]*Task, error) { return ListTasksOrdered(ctx, client, "priority", true) }},
+		{"ListTasksByTag", func() ([]*Task, error) { return ListTasksByTag(ctx, client, "home") }},
+		{"ListTasksByAllTags", func() ([]*Task, error) { return ListTasksByAllTags(ctx, client, []string{"home"}) }},
+		{"ListTasksByOwner", func() ([]*Task, error) { return ListTasksByOwner(ctx, client, "alex") }},
+		{"ListOverdueTasks", func() ([]*Task, error) { return ListOverdueTasks(ctx, client, now) }},
+		{"ListTasksBetween", func() ([]*Task, error) { return ListTasksBetween(ctx, client, now.Add(-time.Minute), time.Now()) }},
+		{"ListTasksByStatus", func() ([]*Task, error) { return ListTasksByStatus(ctx, client, false) }},
+	} {
+		tasks, err := test.list()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(tasks) != 1 || tasks[0].Id != live.ID {
+			t.Errorf("%s = %v, want only task %d", test.name, tasks, live.ID)
+		}
+	}
+}
+
+func TestMarkAllDone(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("alldone-", time.Now().UnixNano()))
+
+	// More tasks than fit in one batch, added in batches that do fit.
+	const n = 600
+	var keys []*datastore.Key
+	for len(keys) < n {
+		descs := make([]string, n/2)
+		for i := range descs {
+			descs[i] = fmt.Sprintf("task %d", len(keys)+i)
+		}
+		added, err := AddTasks(ctx, client, descs)
+		if err != nil {
+			t.Fatalf("AddTasks: %v", err)
+		}
+		keys = append(keys, added...)
+	}
+	defer func() {
+		for start := 0; start < len(keys); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			client.DeleteMulti(ctx, keys[start:end])
+		}
+	}()
+
+	updated, err := MarkAllDone(ctx, client)
+	if err != nil {
+		t.Fatalf("MarkAllDone: %v", err)
+	}
+	if updated != n {
+		t.Errorf("MarkAllDone updated %d tasks, want %d", updated, n)
+	}
+	done := false
+	if open, err := CountTasks(ctx, client, &done); err != nil || open != 0 {
+		t.Errorf("after MarkAllDone, CountTasks(open) = %d, %v, want 0", open, err)
+	}
+	if updated, err := MarkAllDone(ctx, client); err != nil || updated != 0 {
+		t.Errorf("second MarkAllDone = %d, %v, want 0", updated, err)
+	}
+	for _, key := range []*datastore.Key{keys[0], keys[n-1]} {
+		history, err := GetTaskHistory(ctx, client, key.ID)
+		if err != nil {
+			t.Fatalf("GetTaskHistory: %v", err)
+		}
+		if len(history) != 1 || history[0].Action != ActionDone {
+			t.Errorf("task %d got history %+v, want one %q event", key.ID, history, ActionDone)
+		}
+	}
+}
+
+func TestMarkDoneMulti(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("donemulti-", time.Now().UnixNano()))
+
+	keys, err := AddTasks(ctx, client, []string{"open", "done"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	open, done := keys[0].ID, keys[1].ID
+	if err := MarkDone(ctx, client, done); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	before, err := GetTask(ctx, client, done)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+
+	const missing = 1 << 62
+	results, err := MarkDoneMulti(ctx, client, []int64{missing, open, done, open})
+	if err != nil {
+		t.Fatalf("MarkDoneMulti: %v", err)
+	}
+	want := []DoneResult{
+		{missing, doneStatusNotFound},
+		{open, doneStatusDone},
+		{done, doneStatusAlreadyDone},
+		{open, doneStatusDone},
+	}
+	if fmt.Sprint(results) != fmt.Sprint(want) {
+		t.Errorf("MarkDoneMulti got %v, want %v", results, want)
+	}
+
+	task, err := GetTask(ctx, client, open)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !task.Done || task.CompletedAt.IsZero() {
+		t.Errorf("after MarkDoneMulti, task %d is done %v, completed at %v, want done", open, task.Done, task.CompletedAt)
+	}
+	after, err := GetTask(ctx, client, done)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if after.Version != before.Version || !after.CompletedAt.Equal(before.CompletedAt) {
+		t.Errorf("MarkDoneMulti changed the task that was already done: got %+v, want %+v", after, before)
+	}
+	if _, err := GetTask(ctx, client, missing); err != ErrTaskNotFound {
+		t.Errorf("GetTask of the missing task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestPurgeDoneTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("purgedone-", time.Now().UnixNano()))
+
+	open, err := AddTask(ctx, client, "open")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, open)
+	if purged, err := PurgeDoneTasks(ctx, client); err != nil || purged != 0 {
+		t.Errorf("PurgeDoneTasks with no done tasks = %d, %v, want 0", purged, err)
+	}
+
+	// More done tasks than can be deleted in one batch.
+	const n = 600
+	var keys []*datastore.Key
+	for len(keys) < n {
+		descs := make([]string, n/2)
+		for i := range descs {
+			descs[i] = fmt.Sprintf("task %d", len(keys)+i)
+		}
+		added, err := AddTasks(ctx, client, descs)
+		if err != nil {
+			t.Fatalf("AddTasks: %v", err)
+		}
+		keys = append(keys, added...)
+	}
+	// Marks the task "open" done too; undo that below.
+	if _, err := MarkAllDone(ctx, client); err != nil {
+		t.Fatalf("MarkAllDone: %v", err)
+	}
+	if err := SetDone(ctx, client, open.ID, false); err != nil {
+		t.Fatalf("SetDone: %v", err)
+	}
+
+	purged, err := PurgeDoneTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("PurgeDoneTasks: %v", err)
+	}
+	if purged != n {
+		t.Errorf("PurgeDoneTasks deleted %d tasks, want %d", purged, n)
+	}
+	tasks, err := ListAllTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListAllTasks: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != open.ID {
+		t.Errorf("after PurgeDoneTasks got %d tasks, want only task %d", len(tasks), open.ID)
+	}
+}
+
+func TestDeleteAllTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("deleteall-", time.Now().UnixNano()))
+
+	// More tasks than can be deleted in one batch, some of them in a list.
+	const n = 600
+	descs := make([]string, n/2)
+	for i := range descs {
+		descs[i] = fmt.Sprintf("task %d", i)
+	}
+	for _, ctx := range []context.Context{ctx, WithList(ctx, "groceries")} {
+		if _, err := AddTasks(ctx, client, descs); err != nil {
+			t.Fatalf("AddTasks: %v", err)
+		}
+	}
+
+	deleted, err := DeleteAllTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("DeleteAllTasks: %v", err)
+	}
+	if deleted != n {
+		t.Errorf("DeleteAllTasks deleted %d tasks, want %d", deleted, n)
+	}
+	keys, err := client.GetAll(ctx, taskQuery(ctx).KeysOnly(), nil)
+	if err != nil {
+		t.Fatalf("GetAll: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("after DeleteAllTasks got %d tasks, want none", len(keys))
+	}
+	if deleted, err := DeleteAllTasks(ctx, client); err != nil || deleted != 0 {
+		t.Errorf("DeleteAllTasks with no tasks = %d, %v, want 0", deleted, err)
+	}
+}
+
+func TestDedupeTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("dedupe-", time.Now().UnixNano()))
+
+	add := func(desc string) int64 {
+		t.Helper()
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		return key.ID
+	}
+	milk := add("buy milk")
+	dog := add("Walk the dog")
+	unique := add("call mum")
+	var dups []int64
+	for _, desc := range []string{"Buy  milk", "walk the DOG", "buy milk"} {
+		dups = append(dups, add(desc))
+	}
+	// Duplicates that are done or in the recycle bin are kept.
+	done, deleted := add("buy milk"), add("walk the dog")
+	if err := MarkDone(ctx, client, done); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	if err := SoftDeleteTask(ctx, client, deleted); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+	defer DeleteAllTasks(ctx, client)
+
+	removed, err := DedupeTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("DedupeTasks: %v", err)
+	}
+	if removed != len(dups) {
+		t.Errorf("DedupeTasks removed %d tasks, want %d", removed, len(dups))
+	}
+	tasks, err := GetTasks(ctx, client, append([]int64{milk, dog, unique, done, deleted}, dups...))
+	if err != nil {
+		t.Fatalf("GetTasks: %v", err)
+	}
+	for i, task := range tasks {
+		if keep := i < 5; (task != nil) != keep {
+			t.Errorf("after DedupeTasks, task %d is %+v, want kept: %v", i, task, keep)
+		}
+	}
+	if removed, err := DedupeTasks(ctx, client); err != nil || removed != 0 {
+		t.Errorf("second DedupeTasks = %d, %v, want 0", removed, err)
+	}
+}
+
+func TestListTasksBetween(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("between-", time.Now().UnixNano()))
+
+	before, err := AddTask(ctx, client, "before")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, before.ID)
+	time.Sleep(10 * time.Millisecond)
+	from := time.Now()
+	inside, err := AddTask(ctx, client, "inside")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, inside.ID)
+	to := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	after, err := AddTask(ctx, client, "after")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, after.ID)
+
+	tasks, err := ListTasksBetween(ctx, client, from, to)
+	if err != nil {
+		t.Fatalf("ListTasksBetween: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != inside.ID {
+		t.Errorf("ListTasksBetween = %v, want only task %d", tasks, inside.ID)
+	}
+}
+
+func TestGetTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	keys, err := AddTasks(ctx, client, []string{"first", "second"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	missing, err := AddTask(ctx, client, "missing")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	if err := DeleteTask(ctx, client, missing.ID); err != nil {
+		t.Fatalf("DeleteTask: %v", err)
+	}
+
+	ids := []int64{keys[1].ID, missing.ID, keys[0].ID}
+	tasks, err := GetTasks(ctx, client, ids)
+	if err != nil {
+		t.Fatalf("GetTasks: %v", err)
+	}
+	if len(tasks) != len(ids) {
+		t.Fatalf("GetTasks returned %d tasks, want %d", len(tasks), len(ids))
+	}
+	if tasks[0] == nil || tasks[0].Id != keys[1].ID || tasks[0].Desc != "second" {
+		t.Errorf("GetTasks()[0] = %+v, want task %d, second", tasks[0], keys[1].ID)
+	}
+	if tasks[1] != nil {
+		t.Errorf("GetTasks()[1] = %+v for a deleted task, want nil", tasks[1])
+	}
+	if tasks[2] == nil || tasks[2].Id != keys[0].ID || tasks[2].Desc != "first" {
+		t.Errorf("GetTasks()[2] = %+v, want task %d, first", tasks[2], keys[0].ID)
+	}
+}
+
+func TestListTasksByOwner(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("owners-", time.Now().UnixNano()))
+
+	mine, err := CreateTask(ctx, client, &Task{Desc: "mine", Owner: "alex"})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, mine.ID)
+	theirs, err := CreateTask(ctx, client, &Task{Desc: "theirs", Owner: "robin"})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, theirs.ID)
+
+	tasks, err := ListTasksByOwner(ctx, client, "alex")
+	if err != nil {
+		t.Fatalf("ListTasksByOwner: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].Id != mine.ID || tasks[0].Owner != "alex" {
+		t.Errorf("ListTasksByOwner(alex) = %v, want only task %d", tasks, mine.ID)
+	}
+}
+
+func TestUpdateTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	key, err := AddTask(ctx, client, "original")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+	before, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+
+	// A patch that changes nothing leaves the task as it was.
+	same := "original"
+	task, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &same})
+	if err != nil {
+		t.Fatalf("UpdateTask with no changes: %v", err)
+	}
+	if !task.UpdatedAt.Equal(before.UpdatedAt) {
+		t.Errorf("UpdateTask with no changes got UpdatedAt %v, want %v", task.UpdatedAt, before.UpdatedAt)
+	}
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{}); err != nil {
+		t.Errorf("UpdateTask with an empty patch: %v", err)
+	}
+
+	due := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	task, err = UpdateTask(ctx, client, key.ID, TaskPatch{Due: &due})
+	if err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+	if task.Id != key.ID || task.Desc != "original" || task.Done || !task.Due.Equal(due) {
+		t.Errorf("UpdateTask(due) = %+v, want task %d, original, not done, due %v", task, key.ID, due)
+	}
+	if !task.UpdatedAt.After(before.UpdatedAt) {
+		t.Errorf("UpdateTask(due) got UpdatedAt %v, want after %v", task.UpdatedAt, before.UpdatedAt)
+	}
+
+	// Only the patch that marks the task done reports completing it.
+	done := true
+	for _, want := range []bool{true, false} {
+		if _, completed, err := updateTask(ctx, client, key.ID, TaskPatch{Done: &done}); err != nil || completed != want {
+			t.Fatalf("updateTask(done) = %v, %v, want completed %v", completed, err, want)
+		}
+	}
+	got, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !got.Done || got.CompletedAt.IsZero() || !got.Due.Equal(due) {
+		t.Errorf("after UpdateTask(done) got %+v, want done with CompletedAt set and due %v", got, due)
+	}
+
+	tags := []string{" Home ", "home", "Errands"}
+	task, err = UpdateTask(ctx, client, key.ID, TaskPatch{Tags: &tags})
+	if err != nil {
+		t.Fatalf("UpdateTask(tags): %v", err)
+	}
+	if got, want := fmt.Sprintf("%q", task.Tags), `["home" "errands"]`; got != want {
+		t.Errorf("UpdateTask(tags) got tags %s, want %s", got, want)
+	}
+
+	color := "#1E90FF"
+	if task, err = UpdateTask(ctx, client, key.ID, TaskPatch{Color: &color}); err != nil || task.Color != "#1e90ff" {
+		t.Errorf("UpdateTask(color) = %+v, %v, want color #1e90ff", task, err)
+	}
+	color = "teal"
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Color: &color}); err != ErrInvalidColor {
+		t.Errorf("UpdateTask with an invalid color got err %v, want %v", err, ErrInvalidColor)
+	}
+
+	empty := " "
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &empty}); err != ErrEmptyDescription {
+		t.Errorf("UpdateTask with an empty description got err %v, want %v", err, ErrEmptyDescription)
+	}
+	if err := DeleteTask(ctx, client, key.ID); err != nil {
+		t.Fatalf("DeleteTask: %v", err)
+	}
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Done: &done}); err != ErrTaskNotFound {
+		t.Errorf("UpdateTask of a deleted task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestVersionConflict(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	key, err := AddTask(ctx, client, "shared")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+
+	// Two clients read the task, then both try to change it.
+	read, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	first, second := "first edit", "second edit"
+	updated, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &first, Version: &read.Version})
+	if err != nil {
+		t.Fatalf("first UpdateTask: %v", err)
+	}
+	if updated.Version != read.Version+1 {
+		t.Errorf("first UpdateTask got version %d, want %d", updated.Version, read.Version+1)
+	}
+	if _, err := UpdateTask(ctx, client, key.ID, TaskPatch{Desc: &second, Version: &read.Version}); err != ErrVersionConflict {
+		t.Errorf("stale UpdateTask got err %v, want %v", err, ErrVersionConflict)
+	}
+	if err := MarkDoneIfVersion(ctx, client, key.ID, read.Version); err != ErrVersionConflict {
+		t.Errorf("stale MarkDoneIfVersion got err %v, want %v", err, ErrVersionConflict)
+	}
+
+	got, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if got.Desc != first || got.Done || got.Version != updated.Version {
+		t.Errorf("after stale updates got %+v, want the first edit at version %d", got, updated.Version)
+	}
+
+	if err := MarkDoneIfVersion(ctx, client, key.ID, got.Version); err != nil {
+		t.Fatalf("MarkDoneIfVersion with the current version: %v", err)
+	}
+	if got, err = GetTask(ctx, client, key.ID); err != nil || !got.Done || got.Version != updated.Version+1 {
+		t.Errorf("after MarkDoneIfVersion got %+v, %v, want done at version %d", got, err, updated.Version+1)
+	}
+}
+
+func TestListTasksByAllTags(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("alltags-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, tags := range [][]string{
+		{"home"},
+		{"home", "urgent"},
+		{"work", "urgent"},
+		{"urgent", "home", "work"},
+	} {
+		key, err := CreateTask(ctx, client, &Task{Desc: strings.Join(tags, "+"), Tags: tags})
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	tests := []struct {
+		tags []string
+		want []string
+	}{
+		{[]string{"home"}, []string{"home", "home+urgent", "urgent+home+work"}},
+		{[]string{"home", "urgent"}, []string{"home+urgent", "urgent+home+work"}},
+		{[]string{"urgent", "work"}, []string{"work+urgent", "urgent+home+work"}},
+		{[]string{"home", "work", "urgent"}, []string{"urgent+home+work"}},
+		{[]string{"home", "play"}, nil},
+	}
+	for _, test := range tests {
+		tasks, err := ListTasksByAllTags(ctx, client, test.tags)
+		if err != nil {
+			t.Fatalf("ListTasksByAllTags(%q): %v", test.tags, err)
+		}
+		var got []string
+		for _, task := range tasks {
+			got = append(got, task.Desc)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("ListTasksByAllTags(%q) = %q, want %q", test.tags, got, test.want)
+		}
+	}
+
+	tooMany := make([]string, maxTagFilters+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprint("tag", i)
+	}
+	if _, err := ListTasksByAllTags(ctx, client, tooMany); err != ErrTooManyTags {
+		t.Errorf("ListTasksByAllTags with %d tags got err %v, want %v", len(tooMany), err, ErrTooManyTags)
+	}
+}
+
+func TestTagCounts(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("tagcounts-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, tags := range [][]string{
+		{"home"},
+		{"home", "urgent"},
+		{"work", "urgent"},
+		{"urgent", "home", "work"},
+		nil,
+		{"deleted", "home"},
+	} {
+		key, err := CreateTask(ctx, client, &Task{Desc: fmt.Sprint(tags), Tags: tags})
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	if err := SoftDeleteTask(ctx, client, keys[len(keys)-1].ID); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	counts, err := TagCounts(ctx, client)
+	if err != nil {
+		t.Fatalf("TagCounts: %v", err)
+	}
+	if got, want := fmt.Sprint(counts), "map[home:3 urgent:3 work:2]"; got != want {
+		t.Errorf("TagCounts got %s, want %s", got, want)
+	}
+}
+
+func TestTagStatusBreakdown(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("tagstatus-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, task := range []*Task{
+		{Tags: []string{"home"}},
+		{Tags: []string{"home", "urgent"}, Done: true},
+		{Tags: []string{"work", "urgent"}},
+		{Tags: []string{"urgent", "home", "work"}, Done: true},
+		{},
+		{Tags: []string{"deleted", "home"}, Deleted: true},
+	} {
+		task.Desc = fmt.Sprint(task.Tags)
+		key, err := CreateTask(ctx, client, task)
+		if err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	breakdown, err := TagStatusBreakdown(ctx, client)
+	if err != nil {
+		t.Fatalf("TagStatusBreakdown: %v", err)
+	}
+	want := map[string]TagStatus{
+		"home":   {Open: 1, Done: 2},
+		"urgent": {Open: 1, Done: 2},
+		"work":   {Open: 1, Done: 1},
+	}
+	if fmt.Sprint(breakdown) != fmt.Sprint(want) {
+		t.Errorf("TagStatusBreakdown got %v, want %v", breakdown, want)
+	}
+}
+
+func TestAddTasksAtomic(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("atomic-", time.Now().UnixNano()))
+
+	keys, err := AddTasksAtomic(ctx, client, []string{"pack", " travel "})
+	if err != nil {
+		t.Fatalf("AddTasksAtomic: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	tasks, err := GetTasks(ctx, client, keyIDs(keys))
+	if err != nil {
+		t.Fatalf("GetTasks: %v", err)
+	}
+	if len(tasks) != 2 || tasks[0] == nil || tasks[0].Desc != "pack" || tasks[1] == nil || tasks[1].Desc != "travel" {
+		t.Fatalf("after AddTasksAtomic got tasks %+v, want pack and travel", tasks)
+	}
+
+	other := WithNamespace(context.Background(), fmt.Sprint("atomic-fail-", time.Now().UnixNano()))
+	if _, err := AddTasksAtomic(other, client, []string{"first", strings.Repeat("x", maxDescLen+1), "third"}); err != ErrDescriptionTooLong {
+		t.Fatalf("AddTasksAtomic with an oversized description got err %v, want %v", err, ErrDescriptionTooLong)
+	}
+	if n, err := CountTasks(other, client, nil); err != nil || n != 0 {
+		t.Errorf("after a failed AddTasksAtomic, CountTasks = %d, %v, want 0", n, err)
+	}
+}
+
+func TestAddTasksAtomicInvalid(t *testing.T) {
+	client := newUnreachableClient(t)
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := AddTasksAtomic(ctx, client, make([]string, addTasksBatchSize+1)); err != ErrBatchTooLarge {
+		t.Errorf("AddTasksAtomic with %d tasks got err %v, want %v", addTasksBatchSize+1, err, ErrBatchTooLarge)
+	}
+	if _, err := AddTasksAtomic(ctx, client, []string{"ok", " "}); err != ErrEmptyDescription {
+		t.Errorf("AddTasksAtomic with an empty description got err %v, want %v", err, ErrEmptyDescription)
+	}
+}
+
+func TestCreateTaskAtRetry(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("createat-", time.Now().UnixNano()))
+
+	key, err := allocateTaskKey(ctx, client)
+	if err != nil {
+		t.Fatalf("allocateTaskKey: %v", err)
+	}
+	defer client.Delete(ctx, key)
+	first := &Task{Desc: "first attempt"}
+	if err := createTaskAt(ctx, client, key, first); err != nil {
+		t.Fatalf("createTaskAt: %v", err)
+	}
+	// A retry of a write that was committed finds the stored task.
+	retry := &Task{Desc: "retried attempt"}
+	if err := createTaskAt(ctx, client, key, retry); err != nil {
+		t.Fatalf("createTaskAt again: %v", err)
+	}
+	if retry.Desc != first.Desc || retry.Id != key.ID || !retry.Created.Equal(first.Created) {
+		t.Errorf("retried createTaskAt got task %+v, want the stored task %+v", retry, first)
+	}
+	if n, err := CountTasks(ctx, client, nil); err != nil || n != 1 {
+		t.Errorf("after a retried createTaskAt, CountTasks = %d, %v, want 1", n, err)
+	}
+	if history, err := GetTaskHistory(ctx, client, key.ID); err != nil || len(history) != 1 {
+		t.Errorf("after a retried createTaskAt, GetTaskHistory = %+v, %v, want one event", history, err)
+	}
+}
+
+func TestCheckDesc(t *testing.T) {
+	longest := strings.Repeat("x", maxDescLen)
+	for _, test := range []struct {
+		desc    string
+		want    string
+		wantErr error
+	}{
+		{"  buy milk\n", "buy milk", nil},
+		{" \t", "", ErrEmptyDescription},
+		{" " + longest + " ", longest, nil},
+		{longest + "x", "", ErrDescriptionTooLong},
+	} {
+		got, err := checkDesc(test.desc)
+		if got != test.want || err != test.wantErr {
+			t.Errorf("checkDesc(%.20q) = %.20q, %v, want %.20q, %v", test.desc, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestDuplicateTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("duplicate-", time.Now().UnixNano()))
+
+	key, err := CreateTask(ctx, client, &Task{Desc: "file taxes", Tags: []string{"home"}, Priority: PriorityHigh, Due: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+	if err := MarkDone(ctx, client, key.ID); err != nil {
+		t.Fatalf("MarkDone: %v", err)
+	}
+	source, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+
+	dupKey, err := DuplicateTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("DuplicateTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, dupKey.ID)
+	if dupKey.ID == key.ID {
+		t.Fatalf("DuplicateTask returned the source's key %v", key)
+	}
+	dup, err := GetTask(ctx, client, dupKey.ID)
+	if err != nil {
+		t.Fatalf("GetTask of the duplicate: %v", err)
+	}
+	if dup.Desc != source.Desc || fmt.Sprint(dup.Tags) != fmt.Sprint(source.Tags) || dup.Priority != source.Priority || !dup.Due.Equal(source.Due) {
+		t.Errorf("duplicate of %+v is %+v", source, dup)
+	}
+	if dup.Done || !dup.CompletedAt.IsZero() || !dup.Created.After(source.Created) || dup.Version != 0 {
+		t.Errorf("duplicate is not a fresh task: %+v", dup)
+	}
+	if history, err := GetTaskHistory(ctx, client, dupKey.ID); err != nil || len(history) != 1 {
+		t.Errorf("GetTaskHistory of the duplicate = %+v, %v, want one event", history, err)
+	}
+
+	if _, err := DuplicateTask(ctx, client, 1<<62); err != ErrTaskNotFound {
+		t.Errorf("DuplicateTask of a missing task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestListRecentlyCompleted(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("completed-", time.Now().UnixNano()))
+
+	var ids []int64
+	for _, desc := range []string{"first", "second", "third", "open", "deleted"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		ids = append(ids, key.ID)
+	}
+	// Complete the tasks out of creation order.
+	for _, i := range []int{1, 0, 4, 2} {
+		if err := MarkDone(ctx, client, ids[i]); err != nil {
+			t.Fatalf("MarkDone: %v", err)
+		}
+	}
+	if err := SoftDeleteTask(ctx, client, ids[4]); err != nil {
+		t.Fatalf("SoftDeleteTask: %v", err)
+	}
+
+	for _, tt := range []struct {
+		limit int
+		want  []int64
+	}{
+		{10, []int64{ids[2], ids[0], ids[1]}},
+		{2, []int64{ids[2], ids[0]}},
+	} {
+		tasks, err := ListRecentlyCompleted(ctx, client, tt.limit)
+		if err != nil {
+			t.Fatalf("ListRecentlyCompleted: %v", err)
+		}
+		var got []int64
+		for _, task := range tasks {
+			got = append(got, task.Id)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("ListRecentlyCompleted(%d) got %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestReorderTask(t *testing.T) {
+	if err := ReorderTask(context.Background(), nil, 1, math.NaN()); err != ErrInvalidPosition {
+		t.Errorf("ReorderTask to NaN got err %v, want %v", err, ErrInvalidPosition)
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("reorder-", time.Now().UnixNano()))
+
+	tasks := make(map[string]*Task)
+	for _, desc := range []string{"first", "second", "third"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		defer DeleteTask(ctx, client, key.ID)
+		if tasks[desc], err = GetTask(ctx, client, key.ID); err != nil {
+			t.Fatalf("GetTask: %v", err)
+		}
+	}
+	if p1, p2, p3 := tasks["first"].Position, tasks["second"].Position, tasks["third"].Position; p1 == 0 || p2 <= p1 || p3 <= p2 {
+		t.Errorf("new tasks got positions %v, %v, %v, want each after the last", p1, p2, p3)
+	}
+
+	// Move the third task between the first two.
+	mid := (tasks["first"].Position + tasks["second"].Position) / 2
+	if err := ReorderTask(ctx, client, tasks["third"].Id, mid); err != nil {
+		t.Fatalf("ReorderTask: %v", err)
+	}
+	listed, err := ListTasksByPosition(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasksByPosition: %v", err)
+	}
+	var got []string
+	for _, task := range listed {
+		got = append(got, task.Desc)
+	}
+	if want := []string{"first", "third", "second"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("after ReorderTask, ListTasksByPosition got %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	many := make([]string, maxTaskTags+1)
+	for i := range many {
+		many[i] = fmt.Sprint("tag", i)
+	}
+	for _, test := range []struct {
+		tags    []string
+		want    []string
+		wantErr error
+	}{
+		{nil, nil, nil},
+		{[]string{" Work ", "work", "WORK", "", "\t", "Home"}, []string{"work", "home"}, nil},
+		{[]string{strings.Repeat("x", maxTagLen)}, []string{strings.Repeat("x", maxTagLen)}, nil},
+		{[]string{strings.Repeat("x", maxTagLen+1)}, nil, ErrTagTooLong},
+		{many, nil, ErrTooManyTaskTags},
+		// Repeats do not count towards the limit.
+		{append(many[:maxTaskTags:maxTaskTags], "TAG0"), many[:maxTaskTags], nil},
+	} {
+		got, err := normalizeTags(test.tags)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) || err != test.wantErr {
+			t.Errorf("normalizeTags(%.40q) = %.40q, %v, want %.40q, %v", test.tags, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestNormalizeColor(t *testing.T) {
+	for _, test := range []struct {
+		color, want string
+		wantErr     error
+	}{
+		{"", "", nil},
+		{"blue", "blue", nil},
+		{" Red ", "red", nil},
+		{"#1E90FF", "#1e90ff", nil},
+		{"teal", "", ErrInvalidColor},
+		{"#1e90f", "", ErrInvalidColor},
+		{"#1e90ffcc", "", ErrInvalidColor},
+		{"1e90ff", "", ErrInvalidColor},
+		{"#gggggg", "", ErrInvalidColor},
+	} {
+		if got, err := normalizeColor(test.color); got != test.want || err != test.wantErr {
+			t.Errorf("normalizeColor(%q) = %q, %v, want %q, %v", test.color, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestNormalizeDesc(t *testing.T) {
+	for _, test := range []struct {
+		desc, want string
+	}{
+		{"buy milk", "buy milk"},
+		{"  Buy\tMILK \n", "buy milk"},
+		{"buy  milk now", "buy milk now"},
+		{"buymilk", "buymilk"},
+	} {
+		if got := normalizeDesc(test.desc); got != test.want {
+			t.Errorf("normalizeDesc(%q) = %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestDescPrefix(t *testing.T) {
+	long := strings.Repeat("x", descPrefixLen-1) + "é"
+	for _, test := range []struct {
+		desc, want string
+	}{
+		{"buy milk", "buy milk"},
+		{strings.Repeat("x", descPrefixLen+1), strings.Repeat("x", descPrefixLen)},
+		// The prefix does not split é, which takes two bytes.
+		{long, long[:descPrefixLen-1]},
+	} {
+		if got := descPrefix(test.desc); got != test.want {
+			t.Errorf("descPrefix(%.20q) = %.20q, want %.20q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestLongDescription(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("longdesc-", time.Now().UnixNano()))
+
+	// Longer than datastore could index.
+	desc := strings.Repeat("word ", 410) + "end"
+	key, err := AddTask(ctx, client, desc)
+	if err != nil {
+		t.Fatalf("AddTask with a %d-byte description: %v", len(desc), err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if task.Desc != desc {
+		t.Errorf("GetTask got a %d-byte description, want the %d bytes stored", len(task.Desc), len(desc))
+	}
+	tasks, err := ListTasksOrdered(ctx, client, "desc_prefix", false)
+	if err != nil || len(tasks) != 1 || tasks[0].Id != key.ID {
+		t.Errorf("ListTasksOrdered(desc_prefix) = %v, %v, want the task", tasks, err)
+	}
+}
+
+func TestStarredFirst(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("starred-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, desc := range []string{"oldest", "middle", "newest"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	// Star the newest task, and star and unstar the oldest.
+	for _, id := range []int64{keys[2].ID, keys[0].ID} {
+		if err := StarTask(ctx, client, id); err != nil {
+			t.Fatalf("StarTask: %v", err)
+		}
+	}
+	if err := UnstarTask(ctx, client, keys[0].ID); err != nil {
+		t.Fatalf("UnstarTask: %v", err)
+	}
+
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	var got []string
+	for _, task := range tasks {
+		got = append(got, task.Desc)
+	}
+	if want := []string{"newest", "oldest", "middle"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ListTasks got %q, want %q", got, want)
+	}
+	if !tasks[0].Starred || tasks[1].Starred {
+		t.Errorf("ListTasks got starred %v and %v, want true and false", tasks[0].Starred, tasks[1].Starred)
+	}
+
+	if err := StarTask(ctx, client, keys[2].ID+1000); err != ErrTaskNotFound {
+		t.Errorf("StarTask of a missing task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestHideSnoozed(t *testing.T) {
+	now := time.Now()
+	tasks := []*Task{
+		{Desc: "never snoozed"},
+		{Desc: "snoozed", SnoozedUntil: now.Add(time.Hour)},
+		{Desc: "woken", SnoozedUntil: now.Add(-time.Minute)},
+		{Desc: "waking", SnoozedUntil: now},
+	}
+	var got []string
+	for _, task := range hideSnoozed(tasks, now) {
+		got = append(got, task.Desc)
+	}
+	if want := []string{"never snoozed", "woken", "waking"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("hideSnoozed got %q, want %q", got, want)
+	}
+}
+
+func TestSnoozeTaskFor(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Hour, (maxSnoozeDays*24 + 1) * time.Hour} {
+		if _, err := SnoozeTaskFor(context.Background(), nil, 1, d); err != ErrInvalidSnooze {
+			t.Errorf("SnoozeTaskFor(%v) got err %v, want %v", d, err, ErrInvalidSnooze)
+		}
+	}
+
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("snoozefor-", time.Now().UnixNano()))
+
+	key, err := AddTask(ctx, client, "later")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer DeleteTask(ctx, client, key.ID)
+	before := time.Now()
+	until, err := SnoozeTaskFor(ctx, client, key.ID, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("SnoozeTaskFor: %v", err)
+	}
+	if until.Before(before.Add(2*time.Hour)) || until.After(time.Now().Add(2*time.Hour)) {
+		t.Errorf("SnoozeTaskFor(2h) returned %v, want about 2h after %v", until, before)
+	}
+	task, err := GetTask(ctx, client, key.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	// Datastore keeps times to the microsecond.
+	if diff := task.SnoozedUntil.Sub(until); diff < -time.Microsecond || diff > time.Microsecond {
+		t.Errorf("after SnoozeTaskFor got SnoozedUntil %v, want %v", task.SnoozedUntil, until)
+	}
+}
+
+func TestSnoozeTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("snooze-", time.Now().UnixNano()))
+
+	var keys []*datastore.Key
+	for _, desc := range []string{"active", "snoozed", "woken"} {
+		key, err := AddTask(ctx, client, desc)
+		if err != nil {
+			t.Fatalf("AddTask: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer client.DeleteMulti(ctx, keys)
+
+	if err := SnoozeTask(ctx, client, keys[1].ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SnoozeTask: %v", err)
+	}
+	if err := SnoozeTask(ctx, client, keys[2].ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SnoozeTask: %v", err)
+	}
+	if err := SnoozeTask(ctx, client, keys[2].ID, time.Time{}); err != nil {
+		t.Fatalf("SnoozeTask to wake: %v", err)
+	}
+
+	tasks, err := ListTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+	var got []string
+	for _, task := range tasks {
+		got = append(got, task.Desc)
+	}
+	if want := []string{"active", "woken"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ListTasks got %q, want %q", got, want)
+	}
+
+	all, err := ListAllTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("ListAllTasks: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("ListAllTasks got %d tasks, want 3", len(all))
+	}
+
+	// Paging skips the snoozed task, and counts the same tasks as ListTasks.
+	got = nil
+	cursor := ""
+	for page := 0; page == 0 || cursor != ""; page++ {
+		if page == 3 {
+			t.Fatalf("ListTasksPage did not finish after %d pages", page)
+		}
+		tasks, next, err := ListTasksPage(ctx, client, cursor, 1)
+		if err != nil {
+			t.Fatalf("ListTasksPage: %v", err)
+		}
+		for _, task := range tasks {
+			got = append(got, task.Desc)
+		}
+		cursor = next
+	}
+	if want := []string{"active", "woken"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("pages of ListTasksPage got %q, want %q", got, want)
+	}
+	if n, err := CountListedTasks(ctx, client); err != nil || n != 2 {
+		t.Errorf("CountListedTasks() = %d, %v, want 2", n, err)
+	}
+
+	if err := SnoozeTask(ctx, client, keys[2].ID+1000, time.Now()); err != ErrTaskNotFound {
+		t.Errorf("SnoozeTask of a missing task got err %v, want %v", err, ErrTaskNotFound)
+	}
+}
+
+func TestBackfillTask(t *testing.T) {
+	now := time.Now()
+	updated := now.Add(-time.Hour)
+	completed := now.Add(-2 * time.Hour)
+	tests := []struct {
+		desc        string
+		task        Task
+		wantCreated time.Time
+		wantUpdated time.Time
+		wantChanged bool
+	}{
+		{"current", Task{Created: completed, UpdatedAt: updated}, completed, updated, false},
+		{"current with a description", Task{Desc: "x", DescPrefix: "x", Created: completed, UpdatedAt: updated}, completed, updated, false},
+		{"without a description prefix", Task{Desc: "x", Created: completed, UpdatedAt: updated}, completed, updated, true},
+		{"never updated", Task{Created: completed}, completed, completed, true},
+		{"undated", Task{}, now, now, true},
+		{"undated but changed", Task{UpdatedAt: updated, CompletedAt: completed}, completed, updated, true},
+	}
+	for _, test := range tests {
+		task := test.task
+		changed := backfillTask(&task, 7, now)
+		if changed != test.wantChanged {
+			t.Errorf("%s: backfillTask changed %v, want %v", test.desc, changed, test.wantChanged)
+		}
+		if task.Id != 7 {
+			t.Errorf("%s: backfillTask set Id %d, want 7", test.desc, task.Id)
+		}
+		if !task.Created.Equal(test.wantCreated) || !task.UpdatedAt.Equal(test.wantUpdated) {
+			t.Errorf("%s: backfillTask set Created %v and UpdatedAt %v, want %v and %v", test.desc, task.Created, task.UpdatedAt, test.wantCreated, test.wantUpdated)
+		}
+	}
+}
+
+func TestBackfillTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("backfill-", time.Now().UnixNano()))
+
+	// A task saved before update times were kept, and one saved without even
+	// a creation time.
+	created := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	legacyKey, err := client.Put(ctx, newTaskKey(ctx), &legacyTask{Desc: "legacy", Created: created})
+	if err != nil {
+		t.Fatalf("Put legacy task: %v", err)
+	}
+	defer client.Delete(ctx, legacyKey)
+	undatedKey, err := client.Put(ctx, newTaskKey(ctx), &unstarredTask{Desc: "undated"})
+	if err != nil {
+		t.Fatalf("Put undated task: %v", err)
+	}
+	defer client.Delete(ctx, undatedKey)
+	key, err := AddTask(ctx, client, "current")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+
+	start := time.Now()
+	n, err := BackfillTasks(ctx, client)
+	if err != nil {
+		t.Fatalf("BackfillTasks: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("BackfillTasks repaired %d tasks, want 2", n)
+	}
+
+	legacy, err := GetTask(ctx, client, legacyKey.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !legacy.Created.Equal(created) || !legacy.UpdatedAt.Equal(created) {
+		t.Errorf("legacy task got Created %v and UpdatedAt %v, want both %v", legacy.Created, legacy.UpdatedAt, created)
+	}
+	undated, err := GetTask(ctx, client, undatedKey.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if undated.Created.Before(start.Truncate(time.Microsecond)) || !undated.UpdatedAt.Equal(undated.Created) {
+		t.Errorf("undated task got Created %v and UpdatedAt %v, want both after %v", undated.Created, undated.UpdatedAt, start)
+	}
+
+	if n, err := BackfillTasks(ctx, client); err != nil || n != 0 {
+		t.Errorf("second BackfillTasks = %d, %v, want nothing to repair", n, err)
+	}
+}
+
+func TestKeywords(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"Buy milk", []string{"buy", "milk"}},
+		{"milk, MILK and more milk!", []string{"milk", "and", "more"}},
+		{"call Zoë re: Q3-plan", []string{"call", "zoë", "re", "q3", "plan"}},
+		{" !? ", nil},
+	}
+	for _, test := range tests {
+		if got := keywords(test.s); strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("keywords(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestSearchTasks(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("search-", time.Now().UnixNano()))
+
+	keys, err := AddTasks(ctx, client, []string{"Buy milk", "buy bread", "Milkshake"})
+	if err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	defer client.DeleteMulti(ctx, keys)
+	renamed, err := AddTask(ctx, client, "walk the dog")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, renamed)
+	if err := UpdateTaskDescription(ctx, client, renamed.ID, "milk the cow"); err != nil {
+		t.Fatalf("UpdateTaskDescription: %v", err)
+	}
+
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{"MILK", []string{"Buy milk", "milk the cow"}},
+		{"buy milk", []string{"Buy milk"}},
+		{"mil", nil},
+		{"dog", nil},
+	}
+	for _, test := range tests {
+		tasks, err := SearchTasks(ctx, client, test.term)
+		if err != nil {
+			t.Fatalf("SearchTasks(%q): %v", test.term, err)
+		}
+		var got []string
+		for _, task := range tasks {
+			got = append(got, task.Desc)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("SearchTasks(%q) got %q, want %q", test.term, got, test.want)
+		}
+	}
+
+	if _, err := SearchTasks(ctx, client, "?"); err != ErrEmptySearch {
+		t.Errorf("SearchTasks of no words got err %v, want %v", err, ErrEmptySearch)
+	}
+}
+
+func TestMoveTask(t *testing.T) {
+	client := newTestClient(t)
+	defer client.Close()
+	ctx := WithNamespace(context.Background(), fmt.Sprint("move-", time.Now().UnixNano()))
+	home, work := WithList(ctx, "home"), WithList(ctx, "work")
+
+	key, err := AddTask(home, client, "file taxes")
+	if err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defer client.Delete(ctx, key)
+
+	newKey, err := MoveTask(ctx, client, key.ID, "home", "work")
+	if err != nil {
+		t.Fatalf("MoveTask: %v", err)
+	}
+	defer client.Delete(ctx, newKey)
+	if newKey.Parent == nil || newKey.Parent.Name != "work" || newKey.Namespace != namespace(ctx) {
+		t.Errorf("MoveTask got key %v, want one in the work list", newKey)
+	}
+
+	if _, err := GetTask(home, client, key.ID); err != ErrTaskNotFound {
+		t.Errorf("GetTask from the old list got err %v, want %v", err, ErrTaskNotFound)
+	}
+	task, err := GetTask(work, client, newKey.ID)
+	if err != nil {
+		t.Fatalf("GetTask from the new list: %v", err)
+	}
+	if task.Desc != "file taxes" || task.Version != 1 {
+		t.Errorf("moved task got %q at version %d, want %q at version 1", task.Desc, task.Version, "file taxes")
+	}
+	history, err := GetTaskHistory(work, client, newKey.ID)
+	if err != nil {
+		t.Fatalf("GetTaskHistory of the moved task: %v", err)
+	}
+	if len(history) != 1 || history[0].Action != ActionCreated || history[0].TaskID != newKey.ID {
+		t.Errorf("moved task got history %+v, want its %q event", history, ActionCreated)
+	}
+	for _, list := range []context.Context{home, work} {
+		tasks, err := ListTasks(list, client)
+		if err != nil {
+			t.Fatalf("ListTasks: %v", err)
+		}
+		want := 0
+		if listName(list) == "work" {
+			want = 1
+		}
+		if len(tasks) != want {
+			t.Errorf("ListTasks of %s got %d tasks, want %d", listName(list), len(tasks), want)
+		}
+	}
+
+	if _, err := MoveTask(ctx, client, key.ID, "home", "work"); err != ErrTaskNotFound {
+		t.Errorf("MoveTask of a moved task got err %v, want %v", err, ErrTaskNotFound)
+	}
+	if _, err := MoveTask(ctx, client, newKey.ID, "work", "work"); err != ErrSameList {
+		t.Errorf("MoveTask to the same list got err %v, want %v", err, ErrSameList)
+	}
+}
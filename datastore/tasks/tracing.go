@@ -0,0 +1,288 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+)
+
+// withTracing starts a server span for each request served by h, continuing
+// the trace in the request's W3C traceparent header if it has one. The span
+// is carried by the request's context, so the spans of the datastore client,
+// which is instrumented with OpenCensus, are its children.
+func withTracing(h http.Handler) http.Handler {
+	return &ochttp.Handler{
+		Handler:     h,
+		Propagation: &tracecontext.HTTPFormat{},
+		FormatSpanName: func(r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		},
+	}
+}
+
+// otlpBatchSize is the most spans an otlpExporter sends at once.
+const otlpBatchSize = 512
+
+// otlpExporter is a trace.Exporter that sends spans to an OpenTelemetry
+// collector with the OTLP/HTTP protocol, using its JSON encoding. Spans are
+// sent in batches, at least every interval.
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	spans []*trace.SpanData
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// otlpExporterFromEnv returns an exporter that sends spans to
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or, if that is not set, to the
+// /v1/traces path of OTEL_EXPORTER_OTLP_ENDPOINT. The spans' service name
+// is OTEL_SERVICE_NAME, or "tasks". It returns nil if neither endpoint is
+// set.
+func otlpExporterFromEnv() *otlpExporter {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if url == "" {
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil
+		}
+		url = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "tasks"
+	}
+	return newOTLPExporter(url, service, 5*time.Second)
+}
+
+// newOTLPExporter returns an exporter that sends spans to url. Close must
+// be called to send the last batch and stop it.
+func newOTLPExporter(url, service string, interval time.Duration) *otlpExporter {
+	e := &otlpExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.loop(interval)
+	return e
+}
+
+// ExportSpan implements trace.Exporter.
+func (e *otlpExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= otlpBatchSize
+	e.mu.Unlock()
+	if full {
+		go e.flush()
+	}
+}
+
+func (e *otlpExporter) loop(interval time.Duration) {
+	defer close(e.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			e.flush()
+		case <-e.stop:
+			e.flush()
+			return
+		}
+	}
+}
+
+// Close sends any spans that have not been sent yet and stops the exporter.
+func (e *otlpExporter) Close() {
+	close(e.stop)
+	<-e.done
+}
+
+// flush sends the spans exported since the last flush.
+func (e *otlpExporter) flush() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpBatchSize {
+			n = otlpBatchSize
+		}
+		if err := e.send(spans[:n]); err != nil {
+			logError(nil, "Could not export spans", err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (e *otlpExporter) send(spans []*trace.SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// The types below are the parts of an OTLP ExportTraceServiceRequest that
+// the exporter sends, in the protobuf JSON mapping. IDs are hex encoded and
+// 64-bit integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusError = 2
+)
+
+func (e *otlpExporter) request(spans []*trace.SpanData) *otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "go.opencensus.io"}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, newOTLPSpan(s))
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": e.service})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func newOTLPSpan(s *trace.SpanData) otlpSpan {
+	span := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		Attributes:        otlpAttributes(s.Attributes),
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		span.ParentSpanID = s.ParentSpanID.String()
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		span.Kind = otlpKindServer
+	case trace.SpanKindClient:
+		span.Kind = otlpKindClient
+	}
+	// OpenCensus status codes are gRPC codes, where 0 is OK.
+	if s.Code != 0 {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.Message}
+	}
+	return span
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	var out []otlpAttribute
+	for k, v := range attrs {
+		var val otlpValue
+		switch v := v.(type) {
+		case string:
+			val.StringValue = &v
+		case bool:
+			val.BoolValue = &v
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			val.IntValue = &s
+		case float64:
+			val.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			val.StringValue = &s
+		}
+		out = append(out, otlpAttribute{Key: k, Value: val})
+	}
+	return out
+}
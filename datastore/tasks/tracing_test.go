@@ -0,0 +1,152 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// recordingExporter keeps the spans exported to it.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(s *trace.SpanData) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func (e *recordingExporter) span(name string) *trace.SpanData {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range e.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTracingPropagation(t *testing.T) {
+	e := &recordingExporter{}
+	trace.RegisterExporter(e)
+	defer trace.UnregisterExporter(e)
+
+	client := newUnreachableClient(t)
+	defer client.Close()
+	s := &server{client: client, timeout: 100 * time.Millisecond}
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest("GET", "/tasks", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	s.routes().ServeHTTP(httptest.NewRecorder(), req)
+
+	handler := e.span("GET /tasks")
+	if handler == nil {
+		t.Fatalf("no span for the handler in %d exported spans", len(e.spans))
+	}
+	if got := handler.TraceID.String(); got != traceID {
+		t.Errorf("handler span trace ID got %s, want %s", got, traceID)
+	}
+	if got := handler.ParentSpanID.String(); got != parentID {
+		t.Errorf("handler span parent got %s, want %s", got, parentID)
+	}
+
+	query := e.span("cloud.google.com/go/datastore.Query.GetAll")
+	if query == nil {
+		t.Fatalf("no span for the datastore query in %d exported spans", len(e.spans))
+	}
+	if query.TraceID != handler.TraceID || query.ParentSpanID != handler.SpanID {
+		t.Errorf("datastore span has trace %s and parent %s, want %s and %s", query.TraceID, query.ParentSpanID, handler.TraceID, handler.SpanID)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []otlpRequest
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	e := newOTLPExporter(collector.URL+"/v1/traces", "test", time.Hour)
+	start := time.Unix(1, 0)
+	e.ExportSpan(&trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			SpanID:  trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		ParentSpanID: trace.SpanID{8, 7, 6, 5, 4, 3, 2, 1},
+		SpanKind:     trace.SpanKindServer,
+		Name:         "GET /tasks",
+		StartTime:    start,
+		EndTime:      start.Add(time.Second),
+		Attributes:   map[string]interface{}{"http.status_code": int64(500)},
+		Status:       trace.Status{Code: 13, Message: "internal"},
+	})
+	e.Close()
+
+	if len(reqs) != 1 || len(reqs[0].ResourceSpans) != 1 || len(reqs[0].ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("collector got %+v, want one request with one resource and scope", reqs)
+	}
+	rs := reqs[0].ResourceSpans[0]
+	if attrs := rs.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || *attrs[0].Value.StringValue != "test" {
+		t.Errorf("resource attributes got %+v, want service.name test", attrs)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("collector got %d spans, want 1", len(spans))
+	}
+	got := spans[0]
+	want := otlpSpan{
+		TraceID:           "0102030405060708090a0b0c0d0e0f10",
+		SpanID:            "0102030405060708",
+		ParentSpanID:      "0807060504030201",
+		Name:              "GET /tasks",
+		Kind:              otlpKindServer,
+		StartTimeUnixNano: "1000000000",
+		EndTimeUnixNano:   "2000000000",
+		Status:            otlpStatus{Code: otlpStatusError, Message: "internal"},
+	}
+	attrs := got.Attributes
+	got.Attributes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("span got %+v, want %+v", got, want)
+	}
+	if len(attrs) != 1 || attrs[0].Key != "http.status_code" || *attrs[0].Value.IntValue != "500" {
+		t.Errorf("span attributes got %+v, want http.status_code 500", attrs)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// webhookQueueSize is the most notifications a webhook holds while waiting to
+// send them. Notifications beyond that are dropped.
+const webhookQueueSize = 100
+
+// doneNotification is the JSON body a webhook posts when a task is done.
+type doneNotification struct {
+	ID          int64     `json:"id"`
+	Desc        string    `json:"description"`
+	CompletedAt time.Time `json:"completedAt"`
+}
+
+// webhook posts a doneNotification to a URL each time a task is marked done,
+// such as for a Slack or Zapier integration. Notifications are sent one at a
+// time in the background, so a slow or unavailable endpoint never delays or
+// fails the request that marked the task done; failures are logged.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan doneNotification
+	done   chan struct{}
+}
+
+// webhookFromEnv returns a webhook posting to DONE_WEBHOOK_URL if
+// DONE_WEBHOOK_ENABLED is "true", and otherwise nil.
+func webhookFromEnv() (*webhook, error) {
+	if os.Getenv("DONE_WEBHOOK_ENABLED") != "true" {
+		return nil, nil
+	}
+	url := os.Getenv("DONE_WEBHOOK_URL")
+	if url == "" {
+		return nil, fmt.Errorf("DONE_WEBHOOK_ENABLED is true but DONE_WEBHOOK_URL is not set")
+	}
+	return newWebhook(url), nil
+}
+
+// newWebhook returns a webhook posting to url. Close must be called to send
+// the queued notifications and stop it.
+func newWebhook(url string) *webhook {
+	h := &webhook{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan doneNotification, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// taskDone queues a notification that the task is done. It does nothing if h
+// is nil.
+func (h *webhook) taskDone(task *Task) {
+	if h == nil {
+		return
+	}
+	n := doneNotification{ID: task.Id, Desc: task.Desc, CompletedAt: task.CompletedAt}
+	select {
+	case h.queue <- n:
+	default:
+		logError(nil, "Dropped task done notification", fmt.Errorf("%d notifications are already queued for task %d", webhookQueueSize, task.Id))
+	}
+}
+
+func (h *webhook) run() {
+	defer close(h.done)
+	for n := range h.queue {
+		if err := h.post(n); err != nil {
+			logError(nil, fmt.Sprintf("Could not notify webhook that task %d is done", n.ID), err)
+		}
+	}
+}
+
+func (h *webhook) post(n doneNotification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Close sends the queued notifications and stops the webhook. taskDone must
+// not be called after Close.
+func (h *webhook) Close() {
+	close(h.queue)
+	<-h.done
+}
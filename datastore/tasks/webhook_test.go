@@ -0,0 +1,113 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		got []doneNotification
+	)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("webhook request got Content-Type %q, want application/json", ct)
+		}
+		var n doneNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		mu.Lock()
+		got = append(got, n)
+		mu.Unlock()
+	}))
+	defer target.Close()
+
+	h := newWebhook(target.URL)
+	completed := time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC)
+	h.taskDone(&Task{Id: 1, Desc: "first", Done: true, CompletedAt: completed})
+	h.taskDone(&Task{Id: 2, Desc: "second", Done: true, CompletedAt: completed})
+	h.Close()
+
+	want := []doneNotification{
+		{ID: 1, Desc: "first", CompletedAt: completed},
+		{ID: 2, Desc: "second", CompletedAt: completed},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("webhook got %d notifications, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Desc != want[i].Desc || !got[i].CompletedAt.Equal(want[i].CompletedAt) {
+			t.Errorf("notification %d got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWebhookUnavailable(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stderr }()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	h := newWebhook(target.URL)
+	h.taskDone(&Task{Id: 7, Desc: "unlucky", Done: true})
+	h.Close()
+
+	if !strings.Contains(buf.String(), "task 7") || !strings.Contains(buf.String(), "503") {
+		t.Errorf("after a failed notification got log %q, want an error for task 7", buf.String())
+	}
+
+	// A nil webhook, as when none is configured, ignores tasks.
+	var none *webhook
+	none.taskDone(&Task{Id: 7})
+}
+
+func TestWebhookFromEnv(t *testing.T) {
+	defer os.Unsetenv("DONE_WEBHOOK_ENABLED")
+	defer os.Unsetenv("DONE_WEBHOOK_URL")
+
+	os.Setenv("DONE_WEBHOOK_URL", "http://example.com/hook")
+	if h, err := webhookFromEnv(); h != nil || err != nil {
+		t.Errorf("webhookFromEnv without DONE_WEBHOOK_ENABLED = %v, %v, want nil, nil", h, err)
+	}
+
+	os.Setenv("DONE_WEBHOOK_ENABLED", "true")
+	h, err := webhookFromEnv()
+	if err != nil || h == nil || h.url != "http://example.com/hook" {
+		t.Errorf("webhookFromEnv = %v, %v, want a webhook for http://example.com/hook", h, err)
+	}
+	if h != nil {
+		h.Close()
+	}
+
+	os.Unsetenv("DONE_WEBHOOK_URL")
+	if _, err := webhookFromEnv(); err == nil {
+		t.Errorf("webhookFromEnv without DONE_WEBHOOK_URL got no error")
+	}
+}